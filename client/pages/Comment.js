@@ -1,6 +1,7 @@
 import { sanitizeInput } from "../services/utils.js";
+import { WebSocketService } from "../services/websocket.js";
 
-let offset = 3;
+let offset = 0;
 let isLoading = false;
 let hasMoreComments = true;
 let commentCleanupFunctions = [];
@@ -65,7 +66,7 @@ function cleanupCommentListeners() {
 
 async function initializeCommentPage(postId) {
     // Reset state
-    offset = 3;
+    offset = 0;
     isLoading = false;
     hasMoreComments = true;
 
@@ -86,11 +87,36 @@ async function initializeCommentPage(postId) {
     // Render post details
     renderPost(data.post);
 
-    // Render comments
+    // Render comments, the next page starts after them
     renderComments(data.comments);
+    offset = data.comments?.length || 0;
 
     // Initialize comment form
     initializeCommentForm(postId);
+
+    initializeLiveUpdates(postId);
+}
+
+function initializeLiveUpdates(postId) {
+    commentCleanupFunctions.push(WebSocketService.subscribe(`post:${postId}`));
+
+    commentCleanupFunctions.push(WebSocketService.on('comment_created', (payload) => {
+        if (String(payload.post_id) !== String(postId)) return;
+        // Our own comments are already added by the form
+        if (document.getElementById(`like_post-${payload.comment.Id}`)) return;
+
+        const commentsContainer = document.getElementById('commentsContainer');
+        commentsContainer.insertBefore(createCommentElement(payload.comment), commentsContainer.firstChild);
+        offset += 1;
+    }));
+
+    commentCleanupFunctions.push(WebSocketService.on('reaction_updated', (payload) => {
+        if (payload.type !== 'comment') return;
+        const likeSpan = document.getElementById(`like_post-${payload.id}`);
+        const dislikeSpan = document.getElementById(`dislike_post-${payload.id}`);
+        if (likeSpan) likeSpan.textContent = payload.likes;
+        if (dislikeSpan) dislikeSpan.textContent = payload.dislikes;
+    }));
 }
 
 function renderPost(post) {
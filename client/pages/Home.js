@@ -1,9 +1,12 @@
 import { renderChatList } from "../components/chatlist.js";
+import { WebSocketService } from "../services/websocket.js";
 
 let currentOffset = 0;
 let isLoading = false;
 let hasMorePosts = true;
 let currentFilter = '';
+// The server pins a feed to the time of its first page, later pages pass it back
+let feedAsOf = null;
 let cleanupFunctions = [];
 
 export async function loadHomePage(container) {
@@ -40,6 +43,9 @@ export async function loadHomePage(container) {
         // 4 like/dislike functionality
         initializeLikeDislike();
 
+        // 5 live post and reaction updates
+        initializeLiveUpdates();
+
     } catch (error) {
         console.error('Error loading home page:', error);
         container.innerHTML = `<div class="error">Error: ${error.message}</div>`;
@@ -68,6 +74,29 @@ async function initializeHome() {
     await loadPosts();
 }
 
+function initializeLiveUpdates() {
+    cleanupFunctions.push(WebSocketService.subscribe('feed'));
+
+    cleanupFunctions.push(WebSocketService.on('post_created', (post) => {
+        // Only the unfiltered feed knows where a new post goes
+        if (currentFilter) return;
+        const postsContainer = document.getElementById('postsContainer');
+        if (!postsContainer || document.getElementById(`like_post-${post.ID}`)) return;
+
+        postsContainer.querySelector('.no-posts')?.remove();
+        // The pinned feed leaves it out, so the offset doesn't move
+        postsContainer.insertBefore(createPostElement(post, true), postsContainer.firstChild);
+    }));
+
+    cleanupFunctions.push(WebSocketService.on('reaction_updated', (payload) => {
+        if (payload.type !== 'post') return;
+        const likeSpan = document.getElementById(`like_post-${payload.id}`);
+        const dislikeSpan = document.getElementById(`dislike_post-${payload.id}`);
+        if (likeSpan) likeSpan.textContent = payload.likes;
+        if (dislikeSpan) dislikeSpan.textContent = payload.dislikes;
+    }));
+}
+
 function initializeFilters() {
     const filterContainer = document.getElementById('filterContainer');
 
@@ -172,9 +201,12 @@ async function loadPosts(append = false, isFilter = false) {
         loadingContainer.style.display = 'block';
 
         // Determine which endpoint to use
-        const endpoint = currentFilter ?
+        let endpoint = currentFilter ?
             `/api/filter?type=${currentFilter}&offset=${currentOffset}` :
             `/api/home?offset=${currentOffset}`;
+        if (currentOffset > 0 && feedAsOf) {
+            endpoint += `&as_of=${encodeURIComponent(feedAsOf)}`;
+        }
 
         const response = await fetch(endpoint);
 
@@ -221,10 +253,13 @@ async function loadPosts(append = false, isFilter = false) {
         }
 
         // Update state
+        if (currentOffset === 0) {
+            feedAsOf = data.asOf;
+        }
         if (data.posts.length > 0) {
             currentOffset += data.posts.length;
         }
-        hasMorePosts = data.posts.length === 4; // If we got less than 4 posts, there are no more
+        hasMorePosts = data.hasMore; // A short page means there are no more
 
         // Update loading visibility
         loadingContainer.style.display = hasMorePosts ? 'block' : 'none';
@@ -286,6 +321,8 @@ function createPostElement(post, isLoggedIn) {
         </div>
     `;
 
+    cleanupFunctions.push(WebSocketService.subscribe(`post:${post.ID}`));
+
     const categories = postDiv.querySelectorAll('.category');
     categories.forEach(categorySpan => {
         const categoryClickHandler = () => {
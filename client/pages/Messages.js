@@ -1,10 +1,25 @@
-import { sanitizeInput } from "../services/utils.js";
+import { sanitizeInput, formatLastSeen } from "../services/utils.js";
 
 const WebSocketService = window.WebSocketService;
 
 // let messageCleanupFunctions = [];
 let currentOffset = 0;
 let currentChatId = null;
+// Set instead of currentChatId while a group is open
+let currentGroupId = null;
+// Slug of the public channel open instead of a conversation
+let currentChannel = null;
+// Id of the oldest channel message shown, to page through the history
+let oldestChannelMessageId = 0;
+// Usernames to ids of the users in the chat list, to pick group members
+let knownUsers = new Map();
+// Current search of the user directory and how many results are shown
+let userSearch = '';
+let userSearchOffset = 0;
+// Last online_status payload of each user
+let userPresence = new Map();
+// Users whose presence topic we're subscribed to, see syncPresenceSubscriptions
+let presenceSubscriptions = new Set();
 let hasMoreMessages = true;
 let isLoadingMessages = false;
 let typingTimeout = null;
@@ -23,6 +38,16 @@ export async function loadMessagesPage(container) {
         container.innerHTML = `
             <div class="messages-container">
                 <div class="chat-sidebar">
+                    <div class="presence-picker">
+                        <select id="presenceStatus">
+                            <option value="online">Online</option>
+                            <option value="away">Away</option>
+                            <option value="dnd">Do not disturb</option>
+                            <option value="invisible">Invisible</option>
+                        </select>
+                        <input id="presenceText" maxlength="100" placeholder="Set a status...">
+                    </div>
+                    <button class="new-group-button" id="newGroupButton">New group</button>
                     <div class="chat-list" id="chatList"></div>
                 </div>
                 <div class="chat-main">
@@ -48,13 +73,18 @@ export async function loadMessagesPage(container) {
         // initializeWebSocketListeners();
         initializeMessageInput();
         initializeScrollListener();
+        document.getElementById('newGroupButton').addEventListener('click', createGroup);
+        initializePresencePicker();
 
-        // Load conversations and new users
+        // Load conversations and the user directory
         await loadConversations(true);
 
         // Restore last active chat if exists
+        const lastActiveGroup = sessionStorage.getItem('lastActiveGroup');
         const lastActiveChat = sessionStorage.getItem('lastActiveChat');
-        if (lastActiveChat) {
+        if (lastActiveGroup) {
+            await loadGroupChat(parseInt(lastActiveGroup));
+        } else if (lastActiveChat) {
             await loadChat(parseInt(lastActiveChat));
         }
     } catch (error) {
@@ -73,16 +103,23 @@ export async function loadConversations(isMessagePage) {
         }
 
         const data = await response.json();
-        renderConversations(data.conversations, data.newUsers, isMessagePage);
+        renderConversations(data.conversations, data.requests, isMessagePage);
+        if (isMessagePage) {
+            await loadChannels();
+        }
     } catch (error) {
         console.error('Error loading conversations:', error);
     }
 }
 
-function renderConversations(conversations, newUsers, isMessagePage) {
+function renderConversations(conversations, requests, isMessagePage) {
 
     const chatList = document.getElementById(isMessagePage ? "chatList" : "chatListPages");
     chatList.innerHTML = '';
+    knownUsers = new Map();
+    [...(conversations || []), ...(requests || [])]
+        .filter(conv => conv.type !== 'group')
+        .forEach(conv => knownUsers.set(conv.username.toLowerCase(), conv.user_id));
     const separator1 = document.createElement('div');
     separator1.textContent = 'Chat List';
     separator1.className = 'chat-list-separator';
@@ -97,23 +134,205 @@ function renderConversations(conversations, newUsers, isMessagePage) {
         });
     }
 
-    // Add separator if there are new users
-    if (newUsers?.length > 0) {
+    // Requests from users we never talked to wait for an answer
+    if (requests?.length > 0) {
         const separator = document.createElement('div');
-
-
         separator.className = 'chat-list-separator';
-        separator.textContent = 'New Contacts';
+        separator.textContent = 'Message Requests';
         chatList.appendChild(separator);
 
-        // Render new users
-        newUsers.forEach(user => {
-            const userElement = createConversationElement(user, true, isMessagePage);
-            chatList.appendChild(userElement);
+        requests.forEach(request => {
+            chatList.appendChild(createRequestElement(request, isMessagePage));
+        });
+    }
+
+    renderUserDirectory(chatList, isMessagePage);
+    syncPresenceSubscriptions();
+}
+
+// online_status events only come for users we subscribe to. Keeps the
+// subscriptions to the users in the chat lists and the open chat, so
+// rebuilding the lists doesn't pile up topics.
+function syncPresenceSubscriptions() {
+    const shown = new Set();
+    document.querySelectorAll('.chat-list-item[data-user-id]')
+        .forEach(item => shown.add(Number(item.dataset.userId)));
+    if (currentChatId !== null) {
+        shown.add(currentChatId);
+    }
+
+    presenceSubscriptions.forEach(userId => {
+        if (!shown.has(userId)) {
+            WebSocketService.unsubscribe(`user:${userId}:presence`);
+        }
+    });
+    shown.forEach(userId => {
+        if (!presenceSubscriptions.has(userId)) {
+            WebSocketService.subscribe(`user:${userId}:presence`);
+        }
+    });
+    presenceSubscriptions = shown;
+}
+
+// Lists suggested users, or the users matching the search, under the
+// conversations.
+function renderUserDirectory(chatList, isMessagePage) {
+    const separator = document.createElement('div');
+    separator.className = 'chat-list-separator';
+    separator.textContent = 'Find People';
+    chatList.appendChild(separator);
+
+    const search = document.createElement('input');
+    search.className = 'user-search';
+    search.placeholder = 'Search users...';
+    search.value = userSearch;
+    chatList.appendChild(search);
+
+    const results = document.createElement('div');
+    chatList.appendChild(results);
+
+    const runSearch = debounce(() => {
+        userSearch = search.value.trim();
+        loadUserDirectory(results, isMessagePage, false);
+    }, 300);
+    search.addEventListener('input', runSearch);
+
+    loadUserDirectory(results, isMessagePage, false);
+}
+
+async function loadUserDirectory(results, isMessagePage, append) {
+    if (!append) {
+        userSearchOffset = 0;
+    }
+    const url = userSearch ?
+        `/api/users?q=${encodeURIComponent(userSearch)}&offset=${userSearchOffset}` :
+        '/api/users/suggestions';
+
+    try {
+        const response = await fetch(url);
+        if (!response.ok) {
+            throw new Error('Failed to load users');
+        }
+        const data = await response.json();
+
+        if (!append) {
+            results.innerHTML = '';
+        }
+        results.querySelector('.load-more-users')?.remove();
+        if (data.users.length === 0 && !append) {
+            results.innerHTML = `<div class="chat-list-empty">${userSearch ? 'No users found' : 'No suggestions yet'}</div>`;
+            return;
+        }
+
+        data.users.forEach(user => {
+            knownUsers.set(user.username.toLowerCase(), user.user_id);
+            results.appendChild(createConversationElement(user, true, isMessagePage));
+        });
+        userSearchOffset += data.users.length;
+
+        if (data.hasMore) {
+            const more = document.createElement('button');
+            more.className = 'load-more-users group-action';
+            more.textContent = 'Load more';
+            more.addEventListener('click', () => loadUserDirectory(results, isMessagePage, true));
+            results.appendChild(more);
+        }
+    } catch (error) {
+        console.error('Error loading users:', error);
+    } finally {
+        syncPresenceSubscriptions();
+    }
+}
+
+async function loadChannels() {
+    try {
+        const response = await fetch('/api/channels');
+        if (!response.ok) return;
+        const channels = await response.json();
+
+        const chatList = document.getElementById('chatList');
+        const separator = document.createElement('div');
+        separator.className = 'chat-list-separator';
+        separator.textContent = 'Channels';
+        chatList.prepend(separator);
+
+        channels.reverse().forEach(channel => {
+            const div = document.createElement('div');
+            div.className = 'chat-list-item';
+            div.dataset.channel = channel.slug;
+            div.innerHTML = `
+                <div class="channel-hash">#</div>
+                <div class="chat-info">
+                    <div class="username">${channel.name}</div>
+                    <div class="last-message channel-count">${channel.member_count} here</div>
+                </div>
+            `;
+            div.addEventListener('click', () => loadChannel(channel.slug, channel.name));
+            separator.after(div);
         });
+    } catch (error) {
+        console.error('Error loading channels:', error);
+    }
+}
+
+function leaveCurrentChannel() {
+    if (currentChannel !== null) {
+        WebSocketService.leaveChannel(currentChannel);
+        currentChannel = null;
     }
 }
 
+function updateChannelCount(slug, memberCount) {
+    document.querySelectorAll(`[data-channel="${slug}"] .channel-count, #channelCount-${slug}`)
+        .forEach(el => el.textContent = `${memberCount} here`);
+}
+
+async function loadChannel(slug, name) {
+    try {
+        leaveCurrentChannel();
+        processedMessages.clear();
+        currentChatId = null;
+        currentGroupId = null;
+        currentChannel = slug;
+        oldestChannelMessageId = 0;
+        hasMoreMessages = true;
+        sessionStorage.removeItem('lastActiveChat');
+        sessionStorage.removeItem('lastActiveGroup');
+
+        document.getElementById('chatMessages').innerHTML = '';
+        document.getElementById('chatInput').style.display = 'flex';
+        document.getElementById('chatHeader').innerHTML = `
+        <div class="chat-header-info">
+            <span class="username">#${name}</span>
+            <span class="group-members" id="channelCount-${slug}"></span>
+        </div>
+    `;
+
+        const { member_count } = await WebSocketService.joinChannel(slug);
+        updateChannelCount(slug, member_count);
+        await loadMessages();
+    } catch (error) {
+        console.error('Error loading channel:', error);
+    }
+}
+
+function createChannelMessageElement(message) {
+    const div = document.createElement('div');
+    div.className = `message ${message.user_id === currentUserID ? 'sent' : 'received'}`;
+    const timestamp = new Date(message.sent_at).toLocaleTimeString([], {
+        hour: '2-digit',
+        minute: '2-digit'
+    });
+    div.innerHTML = `
+        <div class="message-content">
+            <div style="font-weight: bold">${message.username}:</div>
+            <span>${message.content}</span>
+            <span class="message-time">${timestamp}</span>
+        </div>
+    `;
+    return div;
+}
+
 function updatLastMessageInCahtList(senderId, message) {
     const chatLists = document.querySelectorAll(".chat-list-item");
     chatLists.forEach(chatItem => {
@@ -124,6 +343,10 @@ function updatLastMessageInCahtList(senderId, message) {
 }
 
 function createConversationElement(conv, isNewUser = false, isMessagePage) {
+    if (conv.type === 'group') {
+        return createGroupElement(conv, isMessagePage);
+    }
+
     const div = document.createElement('div');
     div.className = 'chat-list-item';
     div.dataset.userId = conv.user_id;
@@ -153,6 +376,7 @@ function createConversationElement(conv, isNewUser = false, isMessagePage) {
     } else {
         // initializeWebSocketListeners();
         div.addEventListener('click', () => {
+            sessionStorage.removeItem('lastActiveGroup');
             sessionStorage.setItem('lastActiveChat', conv.user_id);
             window.dispatchEvent(new CustomEvent('navigate', {
                 detail: { path: '/messages' }
@@ -162,12 +386,214 @@ function createConversationElement(conv, isNewUser = false, isMessagePage) {
     return div;
 }
 
+function createRequestElement(request, isMessagePage) {
+    const div = createConversationElement(request, false, isMessagePage);
+    div.classList.add('message-request');
+
+    const actions = document.createElement('div');
+    actions.className = 'request-actions';
+    ['accept', 'decline', 'block'].forEach(action => {
+        const button = document.createElement('button');
+        button.className = 'group-action';
+        button.textContent = action.charAt(0).toUpperCase() + action.slice(1);
+        button.addEventListener('click', async (e) => {
+            e.stopPropagation();
+            await answerRequest(request.conversation_id, action);
+        });
+        actions.appendChild(button);
+    });
+    div.querySelector('.chat-info').appendChild(actions);
+    return div;
+}
+
+async function answerRequest(conversationId, action) {
+    try {
+        const response = await fetch('/api/messages/requests', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ conversation_id: conversationId, action })
+        });
+        if (!response.ok) {
+            const data = await response.json();
+            alert(data.error);
+            return;
+        }
+        await updateConversationList(window.location.pathname === "/messages");
+    } catch (error) {
+        console.error('Error answering message request:', error);
+    }
+}
+
+function createGroupElement(conv, isMessagePage) {
+    const div = document.createElement('div');
+    div.className = 'chat-list-item';
+    div.dataset.conversationId = conv.conversation_id;
+
+    const lastMessage = conv.last_message || `${conv.member_count} members`;
+    div.innerHTML = `
+        <div class="user-status group"></div>
+        <div class="chat-info">
+            <div class="username">${conv.name}</div>
+            <div class="last-message">
+                ${lastMessage.length > 20 ? lastMessage.substring(0, 20) + "..." : lastMessage}
+            </div>
+            <span class="typing-indicator" id="typing-indicator-group-${conv.conversation_id}"></span>
+            ${conv.unread_count ? `<span class="unread-count">${conv.unread_count}</span>` : ''}
+        </div>
+    `;
+
+    if (isMessagePage) {
+        div.addEventListener('click', () => loadGroupChat(conv.conversation_id));
+    } else {
+        div.addEventListener('click', () => {
+            sessionStorage.removeItem('lastActiveChat');
+            sessionStorage.setItem('lastActiveGroup', conv.conversation_id);
+            window.dispatchEvent(new CustomEvent('navigate', {
+                detail: { path: '/messages' }
+            }));
+        });
+    }
+    return div;
+}
+
+// Maps comma separated usernames to ids, looking up the names not in the
+// chat list and ignoring unknown ones
+async function usernamesToIds(input) {
+    const ids = [];
+    for (const raw of input.split(',')) {
+        const name = raw.trim().toLowerCase();
+        if (!name) continue;
+        if (!knownUsers.has(name)) {
+            const response = await fetch(`/api/users?q=${encodeURIComponent(name)}&limit=50`);
+            if (response.ok) {
+                const data = await response.json();
+                data.users.forEach(user => knownUsers.set(user.username.toLowerCase(), user.user_id));
+            }
+        }
+        if (knownUsers.has(name)) {
+            ids.push(knownUsers.get(name));
+        }
+    }
+    return ids;
+}
+
+async function createGroup() {
+    const name = prompt('Group name');
+    if (!name || !name.trim()) return;
+    const members = prompt('Members (comma separated usernames)');
+    if (members === null) return;
+
+    try {
+        const response = await fetch('/api/conversations', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({
+                name: sanitizeInput(name.trim()),
+                member_ids: await usernamesToIds(members)
+            })
+        });
+        const data = await response.json();
+        if (!response.ok) {
+            alert(data.error);
+            return;
+        }
+
+        await loadConversations(true);
+        await loadGroupChat(data.id);
+    } catch (error) {
+        console.error('Error creating group:', error);
+    }
+}
+
+async function groupAction(path, body) {
+    const response = await fetch(`/api/conversations/${path}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+    });
+    if (!response.ok) {
+        const data = await response.json();
+        alert(data.error);
+    }
+    return response.ok;
+}
+
+function closeChat() {
+    leaveCurrentChannel();
+    currentChatId = null;
+    currentGroupId = null;
+    sessionStorage.removeItem('lastActiveChat');
+    sessionStorage.removeItem('lastActiveGroup');
+    document.getElementById('chatMessages').innerHTML = '';
+    document.getElementById('chatHeader').innerHTML = '';
+    document.getElementById('chatInput').style.display = 'none';
+}
+
+async function loadGroupChat(conversationId) {
+    try {
+        const response = await fetch(`/api/conversations?id=${conversationId}`);
+        if (!response.ok) {
+            closeChat();
+            return;
+        }
+        const group = await response.json();
+
+        leaveCurrentChannel();
+        processedMessages.clear();
+        currentChatId = null;
+        currentGroupId = conversationId;
+        sessionStorage.removeItem('lastActiveChat');
+        sessionStorage.setItem('lastActiveGroup', conversationId);
+        currentOffset = 0;
+        hasMoreMessages = true;
+
+        const chatMessages = document.getElementById('chatMessages');
+        const chatHeader = document.getElementById('chatHeader');
+        chatMessages.innerHTML = '';
+        document.getElementById('chatInput').style.display = 'flex';
+
+        const isOwner = group.members.some(m => m.user_id === currentUserID && m.role === 'owner');
+        chatHeader.innerHTML = `
+        <div class="chat-header-info">
+            <span class="username">${group.name}</span>
+            <span class="group-members">${group.members.map(m => m.username).join(', ')}</span>
+            ${isOwner ? '<button class="group-action" data-action="invite">Invite</button>' : ''}
+            <button class="group-action" data-action="leave">Leave</button>
+        </div>
+    `;
+
+        chatHeader.querySelector('[data-action="invite"]')?.addEventListener('click', async () => {
+            const members = prompt('Invite (comma separated usernames)');
+            if (!members) return;
+            if (await groupAction('invite', { conversation_id: conversationId, user_ids: await usernamesToIds(members) })) {
+                loadGroupChat(conversationId);
+            }
+        });
+
+        chatHeader.querySelector('[data-action="leave"]').addEventListener('click', async () => {
+            if (!confirm(`Leave ${group.name}?`)) return;
+            if (await groupAction('leave', { conversation_id: conversationId })) {
+                closeChat();
+                loadConversations(true);
+            }
+        });
+
+        await loadMessages();
+        await markGroupAsRead(conversationId);
+    } catch (error) {
+        console.error('Error loading group chat:', error);
+    }
+}
+
 async function loadChat(userId) {
     try {
         // console.log(`Loading chat with user ID: ${userId}`);
+        leaveCurrentChannel();
         processedMessages.clear();
 
         currentChatId = userId;
+        currentGroupId = null;
+        sessionStorage.removeItem('lastActiveGroup');
         sessionStorage.setItem('lastActiveChat', userId);
         currentOffset = 0;
         hasMoreMessages = true;
@@ -186,8 +612,27 @@ async function loadChat(userId) {
         chatHeader.innerHTML = `
         <div class="chat-header-info">
             <span class="username">${username}</span>
+            <span class="presence-text" id="presence-text-${userId}"></span>
+            <button class="group-action" data-action="block">Block</button>
         </div>
     `;
+        const presence = userPresence.get(userId);
+        if (presence) {
+            handleStatusChange(userId, presence.is_online, presence);
+        }
+
+        chatHeader.querySelector('[data-action="block"]').addEventListener('click', async () => {
+            if (!confirm(`Block ${username}? They won't be able to message you or see when you're online.`)) return;
+            const response = await fetch('/api/blocks', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ user_id: userId })
+            });
+            if (response.ok) {
+                closeChat();
+                loadConversations(true);
+            }
+        });
 
         // Load initial messages
         await loadMessages();
@@ -205,7 +650,12 @@ async function loadMessages(append = false) {
 
     try {
         isLoadingMessages = true;
-        const response = await fetch(`/api/messages?chat_id=${currentChatId}&offset=${currentOffset}`);
+        if (currentChannel !== null) {
+            await loadChannelMessages(append);
+            return;
+        }
+        const chat = currentGroupId !== null ? `conversation_id=${currentGroupId}` : `chat_id=${currentChatId}`;
+        const response = await fetch(`/api/messages?${chat}&offset=${currentOffset}`);
         const data = await response.json();
 
         if (!data.messages || data.messages.length === 0) {
@@ -224,6 +674,27 @@ async function loadMessages(append = false) {
     }
 }
 
+async function loadChannelMessages(append) {
+    const before = oldestChannelMessageId ? `&before_id=${oldestChannelMessageId}` : '';
+    const response = await fetch(`/api/channels/${currentChannel}/messages?limit=20${before}`);
+    const data = await response.json();
+    if (!response.ok || data.channel !== currentChannel) return;
+
+    hasMoreMessages = data.hasMore;
+    if (data.messages.length === 0) return;
+    oldestChannelMessageId = data.messages[0].id;
+
+    const chatMessages = document.getElementById('chatMessages');
+    const fragment = document.createDocumentFragment();
+    data.messages.forEach(msg => fragment.appendChild(createChannelMessageElement(msg)));
+    if (append) {
+        chatMessages.insertBefore(fragment, chatMessages.firstChild);
+    } else {
+        chatMessages.appendChild(fragment);
+        chatMessages.scrollTop = chatMessages.scrollHeight;
+    }
+}
+
 function renderMessages(messages, currentUserID, append = false) {
     const chatMessages = document.getElementById('chatMessages');
     // to prevent Browser from repaint itself each time we create a msg
@@ -250,6 +721,7 @@ function createMessageElement(message, currentUserID) {
     let isSender = message.sender_id === currentUserID // Compare with current user's ID
     // if (addMsgFromClient) isSender = true  
     div.className = `message ${isSender ? 'sent' : 'received'}`;
+    div.dataset.messageId = message.id;
 
     // const date = addMsgFromClient ? new Date() : new Date(message.sent_at);
 
@@ -258,17 +730,70 @@ function createMessageElement(message, currentUserID) {
         minute: '2-digit'
     });
 
+    const body = message.is_deleted
+        ? '<span class="message-deleted">Message deleted</span>'
+        : `<span>${message.content}</span>${message.edited_at ? '<span class="message-edited">(edited)</span>' : ''}`;
+
     div.innerHTML = `
         <div class="message-content">
             <div style="font-weight: bold">${message.sender_name}:</div>
-            <span>${message.content}</span>
+            ${body}
             <span class="message-time">${timestamp}</span>
+            ${isSender ? `<span class="message-status">${messageStatusTicks(message)}</span>` : ''}
+            ${isSender && !message.is_deleted ? `
+            <span class="message-actions">
+                <button class="message-action" data-action="edit">Edit</button>
+                <button class="message-action" data-action="delete">Delete</button>
+            </span>` : ''}
         </div>
     `;
 
+    div.querySelector('[data-action="edit"]')?.addEventListener('click', () => {
+        const content = prompt('Edit message', message.content);
+        if (content === null || !content.trim() || content.trim() === message.content) return;
+        WebSocketService.request('edit_message', {
+            message_id: message.id,
+            content: sanitizeInput(content.trim())
+        }).catch(error => console.error(`Edit rejected (${error.code}):`, error.message));
+    });
+
+    div.querySelector('[data-action="delete"]')?.addEventListener('click', () => {
+        if (!confirm('Delete this message for everyone?')) return;
+        WebSocketService.request('delete_message', { message_id: message.id })
+            .catch(error => console.error(`Delete rejected (${error.code}):`, error.message));
+    });
+
     return div;
 }
 
+// Re-render a message after it was edited or deleted
+function replaceMessage(message) {
+    const existing = document.querySelector(`.message[data-message-id="${message.id}"]`);
+    if (existing) {
+        existing.replaceWith(createMessageElement(message, currentUserID));
+    }
+}
+
+// One tick once sent, two once delivered, highlighted once read
+function messageStatusTicks(message) {
+    if (message.read_at) return '<span class="ticks read" title="Read">✓✓</span>';
+    if (message.delivered_at) return '<span class="ticks" title="Delivered">✓✓</span>';
+    return '<span class="ticks" title="Sent">✓</span>';
+}
+
+function updateMessageStatus(messageIds, status) {
+    messageIds.forEach(id => {
+        const statusEl = document.querySelector(`.message.sent[data-message-id="${id}"] .message-status`);
+        if (!statusEl) return;
+        // A late delivered receipt must not downgrade a read message
+        if (status === 'delivered' && statusEl.querySelector('.read')) return;
+        statusEl.innerHTML = messageStatusTicks({
+            delivered_at: true,
+            read_at: status === 'read'
+        });
+    });
+}
+
 async function markMessagesAsRead(senderId) {
     try {
         console.log(`Marking messages from sender ${senderId} as read`);
@@ -307,6 +832,41 @@ async function markMessagesAsRead(senderId) {
     }
 }
 
+async function markGroupAsRead(conversationId) {
+    try {
+        const response = await fetch(`/api/messages/mark-read`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ conversation_id: conversationId })
+        });
+
+        if (response.ok) {
+            document.querySelector(`.chat-list-item[data-conversation-id="${conversationId}"] .unread-count`)?.remove();
+            if (typeof window.updateUnreadBadge === 'function') {
+                window.updateUnreadBadge();
+            }
+        }
+    } catch (error) {
+        console.error('Error marking group as read:', error);
+    }
+}
+
+// Group messages have no receiver
+function handleGroupMessage(message) {
+    if (window.location.pathname != "/messages") {
+        loadConversations(false);
+        return;
+    }
+
+    if (message.conversation_id === currentGroupId) {
+        renderMessages([message], currentUserID);
+        if (message.sender_id !== currentUserID) {
+            markGroupAsRead(currentGroupId);
+        }
+    }
+    updateConversationList(true);
+}
+
 export function initializeWebSocketListeners() {
     const messageCleanup = WebSocketService.onMessage(message => {
         // console.log("WebSocket message received:", message);
@@ -320,6 +880,10 @@ export function initializeWebSocketListeners() {
         }
 
         processedMessages.add(messageId);
+        if (!message.receiver_id) {
+            handleGroupMessage(message);
+            return;
+        }
         console.log(currentChatId, message.sender_id, message.receiver_id, currentUserID);
         if (window.location.pathname == "/messages") {
             if (currentChatId !== null &&
@@ -341,27 +905,120 @@ export function initializeWebSocketListeners() {
         } else loadConversations(false)
     });
 
-    const statusCleanup = WebSocketService.onStatusChange(({ user_id, is_online }) => handleStatusChange(user_id, is_online));
+    const statusCleanup = WebSocketService.onStatusChange(presence => handleStatusChange(presence.user_id, presence.is_online, presence));
 
     const newUserCleanup = WebSocketService.onNewUser(() => {
         updateConversationList(window.location.pathname === "/messages");
     });
 
-    const typingCleanup = WebSocketService.onTypingStatus(({ user_id, is_typing }) => handleTyping(user_id, is_typing));
+    const typingCleanup = WebSocketService.onTypingStatus(({ user_id, conversation_id, is_typing }) => handleTyping(user_id, is_typing, conversation_id));
+
+    const deliveredCleanup = WebSocketService.on('message_delivered', ({ message_ids }) => updateMessageStatus(message_ids, 'delivered'));
+    const readCleanup = WebSocketService.on('message_read', ({ message_ids }) => updateMessageStatus(message_ids, 'read'));
+
+    const editedCleanup = WebSocketService.on('message_edited', replaceMessage);
+    const deletedCleanup = WebSocketService.on('message_deleted', replaceMessage);
+
+    const channelMessageCleanup = WebSocketService.on('channel_message', message => {
+        if (message.channel !== currentChannel) return;
+        const chatMessages = document.getElementById('chatMessages');
+        chatMessages.appendChild(createChannelMessageElement(message));
+        chatMessages.scrollTop = chatMessages.scrollHeight;
+    });
+    const channelPresenceCleanup = WebSocketService.on('channel_presence', ({ channel, member_count }) =>
+        updateChannelCount(channel, member_count));
+
+    const groupUpdatedCleanup = WebSocketService.on('conversation_updated', group => {
+        const isMessagePage = window.location.pathname === "/messages";
+        updateConversationList(isMessagePage);
+        if (isMessagePage && group.id === currentGroupId) {
+            loadGroupChat(currentGroupId);
+        }
+    });
+    const groupRemovedCleanup = WebSocketService.on('conversation_removed', ({ conversation_id }) => {
+        const isMessagePage = window.location.pathname === "/messages";
+        if (isMessagePage && conversation_id === currentGroupId) {
+            closeChat();
+        }
+        updateConversationList(isMessagePage);
+    });
+
+    const requestAcceptedCleanup = WebSocketService.on('message_request_accepted', ({ user_id }) => {
+        const isMessagePage = window.location.pathname === "/messages";
+        updateConversationList(isMessagePage);
+        if (isMessagePage && currentChatId === user_id) {
+            loadChat(currentChatId);
+        }
+    });
+
+    // Some messages were missed while disconnected, reload what's shown
+    const resyncCleanup = WebSocketService.on('resync_required', () => {
+        const isMessagePage = window.location.pathname === "/messages";
+        updateConversationList(isMessagePage);
+        if (isMessagePage && currentChatId !== null) {
+            loadChat(currentChatId);
+        } else if (isMessagePage && currentGroupId !== null) {
+            loadGroupChat(currentGroupId);
+        }
+    });
 
     // messageCleanupFunctions.push(messageCleanup, statusCleanup, typingCleanup,);
 }
 
-export function handleStatusChange(user_id, is_online) {
+// presence is the online_status payload: the status (online, away, dnd or
+// offline), a custom status_text and last_seen for offline users
+export function handleStatusChange(user_id, is_online, presence = {}) {
+    if (user_id === undefined) return;
+    userPresence.set(user_id, { ...presence, is_online });
+
+    const status = presence.status || (is_online ? 'online' : 'offline');
+    const description = is_online ?
+        (presence.status_text || status.replace('dnd', 'do not disturb')) :
+        formatLastSeen(presence.last_seen);
+
     const userElement = document.querySelector(`.chat-list-item[data-user-id="${user_id}"]`);
     if (userElement) {
         const statusDot = userElement.querySelector('.user-status');
-        statusDot.className = `user-status ${is_online ? 'online' : 'offline'}`;
+        statusDot.className = `user-status ${status}`;
+        statusDot.title = description;
+    }
+
+    const presenceText = document.getElementById(`presence-text-${user_id}`);
+    if (presenceText) {
+        presenceText.textContent = description;
+    }
+}
+
+// Shows the status the user picked and saves their changes
+async function initializePresencePicker() {
+    const select = document.getElementById('presenceStatus');
+    const text = document.getElementById('presenceText');
+
+    try {
+        const response = await fetch('/api/profile');
+        if (response.ok) {
+            const profile = await response.json();
+            select.value = profile.status === 'offline' ? 'online' : profile.status;
+            text.value = profile.status_text || '';
+        }
+    } catch (error) {
+        console.error('Error loading presence:', error);
     }
+
+    const save = async () => {
+        try {
+            await WebSocketService.setPresence(select.value, text.value.trim());
+        } catch (error) {
+            alert(error.message);
+        }
+    };
+    select.addEventListener('change', save);
+    text.addEventListener('change', save);
 }
 
-export function handleTyping(user_id, is_typing) {
-    const typingIndicator = document.getElementById(`typing-indicator-${user_id}`);
+export function handleTyping(user_id, is_typing, conversation_id) {
+    const typingIndicator = document.getElementById(conversation_id ?
+        `typing-indicator-group-${conversation_id}` : `typing-indicator-${user_id}`);
     
     if (typingIndicator) {
         if (is_typing) {
@@ -389,9 +1046,18 @@ function initializeMessageInput() {
         if (!content || pendingMsg || content.length > 1000) return;
         pendingMsg = true;
 
-        if (WebSocketService.sendMessage(currentChatId, sanitizeInput(content))) {
-            messageInput.value = '';
-        }
+        // Keep the text in the input until the server has stored it
+        const sent = currentChannel !== null
+            ? WebSocketService.sendChannelMessage(currentChannel, sanitizeInput(content))
+            : currentGroupId !== null
+                ? WebSocketService.sendGroupMessage(currentGroupId, sanitizeInput(content))
+                : WebSocketService.sendMessage(currentChatId, sanitizeInput(content));
+        sent.then(() => {
+                messageInput.value = '';
+            })
+            .catch(error => {
+                console.error(`Message rejected (${error.code}):`, error.message);
+            });
 
         setTimeout(() => {
             pendingMsg = false
@@ -401,13 +1067,16 @@ function initializeMessageInput() {
     sendButton.addEventListener('click', sendMessage);
 
     const inputHandler = () => {
+        // Public channels have no typing indicator
+        if (currentChannel !== null) return;
         if (typingTimeout) {
             clearTimeout(typingTimeout);
         }
-        WebSocketService.updateTypingStatus(currentChatId, true);
-        typingTimeout = setTimeout(() => {
-            WebSocketService.updateTypingStatus(currentChatId, false);
-        }, 1000);
+        const updateTypingStatus = isTyping => currentGroupId !== null
+            ? WebSocketService.updateGroupTypingStatus(currentGroupId, isTyping)
+            : WebSocketService.updateTypingStatus(currentChatId, isTyping);
+        updateTypingStatus(true);
+        typingTimeout = setTimeout(() => updateTypingStatus(false), 1000);
     };
 
     const keypressHandler = (e) => {
@@ -450,6 +1119,14 @@ function initializeScrollListener() {
     // );
 }
 
+const debounce = (func, wait) => {
+    let timeout;
+    return function (...args) {
+        clearTimeout(timeout);
+        timeout = setTimeout(() => func.apply(this, args), wait);
+    };
+};
+
 const throttle = (func, limit) => {
     let inThrottle;
     return function (...args) {
@@ -6,4 +6,18 @@ export function sanitizeInput(input) {
         .replace(/"/g, '&quot;')
         .replace(/'/g, '&#x27;')
         .replace(/\//g, '&#x2F;');
-}
\ No newline at end of file
+}
+// Describes when a user was last online, e.g. "last seen 5 minutes ago"
+export function formatLastSeen(timestamp) {
+    if (!timestamp) return '';
+    const seconds = Math.max(0, Math.floor((Date.now() - new Date(timestamp)) / 1000));
+    if (seconds < 60) return 'last seen just now';
+
+    const units = [['day', 86400], ['hour', 3600], ['minute', 60]];
+    for (const [unit, size] of units) {
+        const count = Math.floor(seconds / size);
+        if (count >= 1) {
+            return `last seen ${count} ${unit}${count > 1 ? 's' : ''} ago`;
+        }
+    }
+}
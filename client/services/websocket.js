@@ -2,11 +2,36 @@ let ws = null;
 let reconnectAttempts = 0;
 const MAX_RECONNECT_ATTEMPTS = 5;
 const RECONNECT_DELAY = 3000;
+// Delay the server asked for in its server_shutdown frame, used for the
+// next reconnection attempt
+let shutdownReconnectDelay = null;
+const PROTOCOL_VERSION = 1;
+const REQUEST_TIMEOUT = 10000;
 
 const messageCallbacks = new Set();
 const statusCallbacks = new Set();
 const typingCallbacks = new Set();
 const newUserCallbacks = new Set();
+// Callbacks for the other event types, keyed by type
+const eventCallbacks = new Map();
+// Topics we are subscribed to; re-sent after a reconnect
+const subscribedTopics = new Set();
+// Public channels we joined; re-joined after a reconnect
+const joinedChannels = new Set();
+// Requests waiting for their ack or error frame, keyed by request_id
+const pendingRequests = new Map();
+let nextRequestId = 1;
+// Seq of the last durable event received, sent back on reconnect so the
+// server replays what we missed
+let lastSeq = null;
+
+// Error carrying the code of an error frame, e.g. 'invalid_payload'
+export class WebSocketError extends Error {
+    constructor(code, message) {
+        super(message);
+        this.code = code;
+    }
+}
 
 export const WebSocketService = {
     isInitialized: false,
@@ -21,6 +46,17 @@ export const WebSocketService = {
             this.isInitialized = true;
         }
 
+        // Tell the server the user is active, at most once a minute, so
+        // they don't show as away
+        let lastActivity = 0;
+        const reportActivity = () => {
+            if (Date.now() - lastActivity < 60000 || !ws || ws.readyState !== WebSocket.OPEN) return;
+            lastActivity = Date.now();
+            this.send('activity', {});
+        };
+        ['mousemove', 'keydown', 'click', 'scroll'].forEach(type =>
+            document.addEventListener(type, reportActivity, { passive: true }));
+
         // Auto-reconnect on visibility change
         document.addEventListener('visibilitychange', () => {
             if (document.visibilityState === 'visible' && !ws) {
@@ -40,16 +76,16 @@ export const WebSocketService = {
                 return;
             }
 
-            ws = new WebSocket(`ws://${window.location.host}/api/ws`);
+            const query = lastSeq !== null ? `?last_seq=${lastSeq}` : '';
+            ws = new WebSocket(`ws://${window.location.host}/api/ws${query}`);
 
             ws.onopen = () => {
                 console.log('WebSocket connected');
                 reconnectAttempts = 0;
                 // Send a reconnection message to update online status
-                ws.send(JSON.stringify({
-                    type: 'reconnect',
-                    payload: { is_online: true }
-                }));
+                this.send('reconnect', { is_online: true });
+                subscribedTopics.forEach(topic => this.send('subscribe', { topic }));
+                joinedChannels.forEach(channel => this.send('join_channel', { channel }));
                 this.notifyStatusCallbacks(true);
                 resolve();
             };
@@ -57,6 +93,7 @@ export const WebSocketService = {
             ws.onclose = () => {
                 console.log('WebSocket disconnected');
                 ws = null;
+                this.rejectPendingRequests();
                 this.notifyStatusCallbacks(false);
                 this.attemptReconnect();
             };
@@ -69,7 +106,35 @@ export const WebSocketService = {
             ws.onmessage = (event) => {
                 try {
                     const data = JSON.parse(event.data);
+                    if (data.seq) {
+                        // Skip events replayed twice
+                        if (lastSeq !== null && data.seq <= lastSeq) return;
+                        lastSeq = data.seq;
+                    }
                     switch (data.type) {
+                        case 'hello':
+                            if (lastSeq === null) lastSeq = data.payload.seq;
+                            break;
+                        case 'resync_required':
+                            // Missed events are gone, callers refetch over REST
+                            lastSeq = data.payload.seq;
+                            (eventCallbacks.get(data.type) || []).forEach(callback => callback(data.payload));
+                            break;
+                        case 'ack':
+                            this.settleRequest(data.request_id, request => request.resolve(data.payload));
+                            break;
+                        case 'error':
+                            if (!this.settleRequest(data.request_id, request => request.reject(
+                                new WebSocketError(data.payload.code, data.payload.message)))) {
+                                console.error('WebSocket error frame:', data.payload);
+                            }
+                            break;
+                        case 'server_shutdown':
+                            // The server is restarting: come back when it asked,
+                            // with the full number of attempts
+                            shutdownReconnectDelay = data.payload.reconnect_after_ms;
+                            reconnectAttempts = 0;
+                            break;
                         case "session_expired":
                             this.handleSessionExpired();
                             break;
@@ -85,6 +150,8 @@ export const WebSocketService = {
                         case 'new_user':
                             newUserCallbacks.forEach(callback => callback(data.payload));
                             break;
+                        default:
+                            (eventCallbacks.get(data.type) || []).forEach(callback => callback(data.payload));
                     }
                 } catch (error) {
                     console.error('Error processing message:', error);
@@ -104,14 +171,13 @@ export const WebSocketService = {
     },
 
     disconnect() {
+        // The next connection may be another user's
+        lastSeq = null;
         if (ws) {
             try {
                 // Send offline status before disconnecting if connection is open
                 if (ws.readyState === WebSocket.OPEN) {
-                    ws.send(JSON.stringify({
-                        type: 'offline_status',
-                        payload: { is_online: false }
-                    }));
+                    this.send('offline_status', { is_online: false });
 
                     // Also make API call to ensure offline status is recorded
                     fetch('/api/user/status/offline', {
@@ -150,39 +216,134 @@ export const WebSocketService = {
             return;
         }
 
+        const delay = shutdownReconnectDelay ?? RECONNECT_DELAY;
+        shutdownReconnectDelay = null;
         setTimeout(() => {
             reconnectAttempts++;
             console.log(`Attempting to reconnect (${reconnectAttempts}/${MAX_RECONNECT_ATTEMPTS})`);
             this.connect();
-        }, RECONNECT_DELAY);
+        }, delay);
     },
 
-    sendMessage(receiverId, content) {
-        if (!ws) return false;
+    // Fire-and-forget frame; failures still come back as error frames
+    send(type, payload) {
+        if (!ws || ws.readyState !== WebSocket.OPEN) return false;
+
+        ws.send(JSON.stringify({ v: PROTOCOL_VERSION, type, payload }));
+        return true;
+    },
 
-        ws.send(JSON.stringify({
-            type: 'new_message',
-            payload: {
-                receiver_id: receiverId,
-                content: content
+    // Send a frame and resolve with the ack payload, or reject with a
+    // WebSocketError when the server answers with an error frame
+    request(type, payload) {
+        return new Promise((resolve, reject) => {
+            if (!ws || ws.readyState !== WebSocket.OPEN) {
+                reject(new WebSocketError('not_connected', 'WebSocket is not connected'));
+                return;
             }
-        }));
+
+            const requestId = `r-${nextRequestId++}`;
+            const timer = setTimeout(() => {
+                pendingRequests.delete(requestId);
+                reject(new WebSocketError('timeout', 'No answer from the server'));
+            }, REQUEST_TIMEOUT);
+            pendingRequests.set(requestId, { resolve, reject, timer });
+
+            ws.send(JSON.stringify({
+                v: PROTOCOL_VERSION,
+                type,
+                request_id: requestId,
+                payload
+            }));
+        });
+    },
+
+    settleRequest(requestId, settle) {
+        const request = pendingRequests.get(requestId);
+        if (!request) return false;
+
+        pendingRequests.delete(requestId);
+        clearTimeout(request.timer);
+        settle(request);
         return true;
     },
 
+    rejectPendingRequests() {
+        pendingRequests.forEach((request, requestId) => this.settleRequest(requestId,
+            request => request.reject(new WebSocketError('not_connected', 'WebSocket disconnected'))));
+    },
+
+    // Resolves with the stored message once the server acknowledges it
+    sendMessage(receiverId, content) {
+        return this.request('new_message', {
+            receiver_id: receiverId,
+            content: content
+        });
+    },
+
+    sendGroupMessage(conversationId, content) {
+        return this.request('new_message', {
+            conversation_id: conversationId,
+            content: content
+        });
+    },
+
     updateTypingStatus(receiverId, isTyping) {
-        if (!ws) return;
+        this.send('typing', {
+            receiver_id: receiverId,
+            is_typing: isTyping
+        });
+    },
 
-        ws.send(JSON.stringify({
-            type: 'typing',
-            payload: {
-                receiver_id: receiverId,
-                is_typing: isTyping
-            }
-        }));
+    updateGroupTypingStatus(conversationId, isTyping) {
+        this.send('typing', {
+            conversation_id: conversationId,
+            is_typing: isTyping
+        });
+    },
+
+    // Receive the events of a topic such as 'feed', 'post:42',
+    // 'category:news' or 'user:7:presence'
+    subscribe(topic) {
+        subscribedTopics.add(topic);
+        this.send('subscribe', { topic });
+        return () => this.unsubscribe(topic);
+    },
+
+    unsubscribe(topic) {
+        subscribedTopics.delete(topic);
+        this.send('unsubscribe', { topic });
+    },
+
+    // Resolves with the channel's member_count and members
+    joinChannel(channel) {
+        joinedChannels.add(channel);
+        return this.request('join_channel', { channel });
+    },
+
+    leaveChannel(channel) {
+        joinedChannels.delete(channel);
+        this.send('leave_channel', { channel });
+    },
+
+    sendChannelMessage(channel, content) {
+        return this.request('channel_message', { channel, content });
+    },
+
+    // status is online, away, dnd or invisible
+    setPresence(status, status_text) {
+        return this.request('set_presence', { status, status_text });
     },
 
     // Callback registration methods
+    on(type, callback) {
+        if (!eventCallbacks.has(type)) {
+            eventCallbacks.set(type, new Set());
+        }
+        eventCallbacks.get(type).add(callback);
+        return () => eventCallbacks.get(type).delete(callback);
+    },
+
     onMessage(callback) {
         messageCallbacks.add(callback);
         return () => messageCallbacks.delete(callback);
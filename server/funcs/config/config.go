@@ -0,0 +1,254 @@
+package forum
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventLogSize is how many durable websocket events are kept per user to
+// replay to a reconnecting client. A full replay must fit in a send queue,
+// so ws-send-queue has to be above it.
+const EventLogSize = 200
+
+// Config holds the server settings. Load starts from Default and
+// overrides it with a JSON file, then FORUM_* environment variables,
+// then command line flags.
+type Config struct {
+	Addr      string // address the HTTP server listens on
+	DBPath    string // SQLite database file
+	ImagesDir string // where post images are stored
+	ClientDir string // static files of the web client
+
+	SessionTTL        time.Duration // how long a login lasts
+	MessageEditWindow time.Duration // how long messages stay editable
+	Admin             string        // user promoted to admin at startup
+
+	PostsPageSize    int
+	CommentsPageSize int
+	MessagesPageSize int
+
+	WSReadBufferSize  int   // websocket read buffer, in bytes
+	WSWriteBufferSize int   // websocket write buffer, in bytes
+	WSSendQueueSize   int   // frames queued per connection before eviction
+	WSMaxMessageSize  int64 // largest frame accepted from clients, in bytes
+}
+
+func Default() *Config {
+	return &Config{
+		Addr:      ":8081",
+		DBPath:    "./database.db",
+		ImagesDir: "./images",
+		ClientDir: "../client",
+
+		SessionTTL:        time.Hour,
+		MessageEditWindow: 15 * time.Minute,
+
+		PostsPageSize:    4,
+		CommentsPageSize: 3,
+		MessagesPageSize: 10,
+
+		WSReadBufferSize:  1024,
+		WSWriteBufferSize: 1024,
+		WSSendQueueSize:   256,
+		WSMaxMessageSize:  64 * 1024,
+	}
+}
+
+// setting is a Config field as named in flags and config files. Its
+// environment variable is FORUM_ followed by the name in upper case with
+// dashes as underscores.
+type setting struct {
+	name  string
+	usage string
+	value interface{} // pointer to the field
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"addr", "address to listen on", &c.Addr},
+		{"db", "SQLite database file", &c.DBPath},
+		{"images-dir", "directory of post images", &c.ImagesDir},
+		{"client-dir", "directory of the web client", &c.ClientDir},
+		{"session-ttl", "how long a login lasts, e.g. 1h", &c.SessionTTL},
+		{"message-edit-window", "how long messages stay editable, e.g. 30m", &c.MessageEditWindow},
+		{"admin", "user to promote to admin at startup", &c.Admin},
+		{"posts-page-size", "posts per page", &c.PostsPageSize},
+		{"comments-page-size", "comments per page", &c.CommentsPageSize},
+		{"messages-page-size", "messages per page", &c.MessagesPageSize},
+		{"ws-read-buffer", "websocket read buffer size in bytes", &c.WSReadBufferSize},
+		{"ws-write-buffer", "websocket write buffer size in bytes", &c.WSWriteBufferSize},
+		{"ws-send-queue", "frames queued per websocket before it's dropped", &c.WSSendQueueSize},
+		{"ws-max-message", "largest websocket frame accepted in bytes", &c.WSMaxMessageSize},
+	}
+}
+
+func envName(name string) string {
+	return "FORUM_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func (s setting) String() string {
+	switch v := s.value.(type) {
+	case *string:
+		return *v
+	case *int:
+		return strconv.Itoa(*v)
+	case *int64:
+		return strconv.FormatInt(*v, 10)
+	case *time.Duration:
+		return v.String()
+	}
+	return ""
+}
+
+func (s setting) set(raw string) error {
+	var err error
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		*v, err = strconv.Atoi(raw)
+	case *int64:
+		*v, err = strconv.ParseInt(raw, 10, 64)
+	case *time.Duration:
+		*v, err = time.ParseDuration(raw)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", s.name, raw)
+	}
+	return nil
+}
+
+// Load builds the config from args (without the program name) and the
+// environment. The file named by -config or FORUM_CONFIG is a JSON object
+// keyed by flag name, e.g. {"addr": ":8080", "session-ttl": "2h"}. It
+// returns the arguments left after the flags.
+func Load(args []string) (*Config, []string, error) {
+	c := Default()
+	settings := c.settings()
+
+	fs := flag.NewFlagSet("forum", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("FORUM_CONFIG"), "JSON config file")
+	// Flags are applied last, so they are only collected here
+	flagValues := make(map[string]*string)
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (default %q, env %s)", s.usage, s.String(), envName(s.name))
+		flagValues[s.name] = fs.String(s.name, "", usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(envName(s.name)); ok && raw != "" {
+			if err := s.set(raw); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", envName(s.name), err)
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.name == f.Name && err == nil {
+				err = s.set(*flagValues[s.name])
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+func (c *Config) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	settings := c.settings()
+	for name, value := range values {
+		var s *setting
+		for i := range settings {
+			if settings[i].name == name {
+				s = &settings[i]
+			}
+		}
+		if s == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+
+		// Strings are unquoted, numbers used as written
+		raw := string(bytes.TrimSpace(value))
+		var text string
+		if json.Unmarshal(value, &text) == nil {
+			raw = text
+		}
+		if err := s.set(raw); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the settings make sense together.
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Addr)
+	check(err == nil, "addr %q must be host:port", c.Addr)
+	check(c.DBPath != "", "db is required")
+	check(c.ImagesDir != "", "images-dir is required")
+	check(c.ClientDir != "", "client-dir is required")
+	check(c.SessionTTL > 0, "session-ttl must be positive")
+	check(c.MessageEditWindow >= 0, "message-edit-window can't be negative")
+
+	for _, size := range []struct {
+		name  string
+		value int
+	}{
+		{"posts-page-size", c.PostsPageSize},
+		{"comments-page-size", c.CommentsPageSize},
+		{"messages-page-size", c.MessagesPageSize},
+	} {
+		check(size.value >= 1 && size.value <= 100, "%s must be between 1 and 100", size.name)
+	}
+
+	check(c.WSReadBufferSize > 0, "ws-read-buffer must be positive")
+	check(c.WSWriteBufferSize > 0, "ws-write-buffer must be positive")
+	check(c.WSSendQueueSize > EventLogSize, "ws-send-queue must be above %d, the replayed events", EventLogSize)
+	check(c.WSMaxMessageSize >= 1024, "ws-max-message must be at least 1024")
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package forum
+
+import (
+	"errors"
+	"time"
+)
+
+// DM privacy settings: who may start or continue a direct conversation
+// with a user.
+const (
+	DMEveryone  = "everyone"
+	DMFollowing = "following" // only users they follow
+	DMNobody    = "nobody"
+)
+
+type BlockedUser struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+func IsDMPrivacy(value string) bool {
+	return value == DMEveryone || value == DMFollowing || value == DMNobody
+}
+
+// Block makes blockerID block blockedID. Follows between them are
+// removed both ways.
+func Block(blockerID, blockedID int) error {
+	if blockerID == blockedID {
+		return errors.New("users can't block themselves")
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+    INSERT OR IGNORE INTO blocks (blocker_id, blocked_id)
+    VALUES (?, ?)`,
+		blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+    DELETE FROM follows
+    WHERE (follower_id = ? AND followee_id = ?) OR (follower_id = ? AND followee_id = ?)`,
+		blockerID, blockedID, blockedID, blockerID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func Unblock(blockerID, blockedID int) error {
+	_, err := Db.Exec("DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerID, blockedID)
+	return err
+}
+
+func HasBlocked(blockerID, blockedID int) bool {
+	var id int
+	err := Db.QueryRow("SELECT blocker_id FROM blocks WHERE blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Scan(&id)
+	return err == nil
+}
+
+// IsBlockedEither reports whether either user blocked the other.
+func IsBlockedEither(a, b int) bool {
+	return HasBlocked(a, b) || HasBlocked(b, a)
+}
+
+func GetBlockedUsers(userID int) ([]BlockedUser, error) {
+	rows, err := Db.Query(`
+    SELECT u.id, u.uname, b.created_at
+    FROM blocks b
+    JOIN users u ON u.id = b.blocked_id
+    WHERE b.blocker_id = ?
+    ORDER BY u.uname`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []BlockedUser{}
+	for rows.Next() {
+		var user BlockedUser
+		if err := rows.Scan(&user.UserID, &user.Username, &user.BlockedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetBlockedIDs returns the users userID blocked.
+func GetBlockedIDs(userID int) (map[int]bool, error) {
+	return scanIDSet("SELECT blocked_id FROM blocks WHERE blocker_id = ?", userID)
+}
+
+// GetBlockerIDs returns the users who blocked userID.
+func GetBlockerIDs(userID int) (map[int]bool, error) {
+	return scanIDSet("SELECT blocker_id FROM blocks WHERE blocked_id = ?", userID)
+}
+
+func scanIDSet(query string, args ...interface{}) (map[int]bool, error) {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+func GetDMPrivacy(userID int) (string, error) {
+	var privacy string
+	err := Db.QueryRow("SELECT dm_privacy FROM users WHERE id = ?", userID).Scan(&privacy)
+	return privacy, err
+}
+
+func SetDMPrivacy(userID int, privacy string) error {
+	if !IsDMPrivacy(privacy) {
+		return errors.New("invalid DM privacy setting")
+	}
+	_, err := Db.Exec("UPDATE users SET dm_privacy = ? WHERE id = ?", privacy, userID)
+	return err
+}
+
+// CanMessage reports whether senderID may send a direct message to
+// receiverID: neither blocked the other, the receiver didn't decline a
+// request from the sender and their DM privacy lets the sender in.
+func CanMessage(senderID, receiverID int) (bool, error) {
+	if IsBlockedEither(senderID, receiverID) || requestDeclined(senderID, receiverID) {
+		return false, nil
+	}
+
+	privacy, err := GetDMPrivacy(receiverID)
+	if err != nil {
+		return false, err
+	}
+
+	switch privacy {
+	case DMNobody:
+		return false, nil
+	case DMFollowing:
+		return IsFollowing(receiverID, senderID), nil
+	}
+	return true, nil
+}
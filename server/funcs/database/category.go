@@ -0,0 +1,122 @@
+package forum
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	types "forum/funcs/types"
+)
+
+var ErrCategoryInUse = errors.New("category is used by existing posts")
+
+func GetCategories(includeArchived bool) ([]types.Category, error) {
+	query := `
+    SELECT id, slug, name, description, position, archived
+    FROM categories`
+	if !includeArchived {
+		query += " WHERE archived = false"
+	}
+	query += " ORDER BY position, name"
+
+	rows, err := Db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []types.Category
+	for rows.Next() {
+		var c types.Category
+		err := rows.Scan(&c.ID, &c.Slug, &c.Name, &c.Description, &c.Position, &c.Archived)
+		if err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+
+	return categories, rows.Err()
+}
+
+// GetCategoryNames returns the display names of the active categories,
+// in the order they should be shown.
+func GetCategoryNames() ([]string, error) {
+	categories, err := GetCategories(false)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(categories))
+	for _, c := range categories {
+		names = append(names, c.Name)
+	}
+	return names, nil
+}
+
+// ResolveCategory looks a category up by slug or display name, case
+// insensitively, and returns it.
+func ResolveCategory(value string) (types.Category, error) {
+	var c types.Category
+	value = strings.ToLower(strings.TrimSpace(value))
+	err := Db.QueryRow(`
+    SELECT id, slug, name, description, position, archived
+    FROM categories
+    WHERE slug = ? OR LOWER(name) = ?`,
+		value, value).Scan(&c.ID, &c.Slug, &c.Name, &c.Description, &c.Position, &c.Archived)
+	return c, err
+}
+
+func InsertCategory(c types.Category) (int, error) {
+	result, err := Db.Exec(`
+    INSERT INTO categories (slug, name, description, position, archived)
+    VALUES (?, ?, ?, ?, ?)`,
+		c.Slug, c.Name, c.Description, c.Position, c.Archived)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+func UpdateCategory(slug string, c types.Category) error {
+	result, err := Db.Exec(`
+    UPDATE categories
+    SET name = ?, description = ?, position = ?, archived = ?
+    WHERE slug = ?`,
+		c.Name, c.Description, c.Position, c.Archived, slug)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteCategory removes a category that no post uses. Categories with
+// posts should be archived instead so old posts keep their labels.
+func DeleteCategory(slug string) error {
+	var used int
+	err := Db.QueryRow("SELECT COUNT(*) FROM post_categories WHERE category = ?", slug).Scan(&used)
+	if err != nil {
+		return err
+	}
+	if used > 0 {
+		return ErrCategoryInUse
+	}
+
+	result, err := Db.Exec("DELETE FROM categories WHERE slug = ?", slug)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package forum
+
+import (
+	"strings"
+	"time"
+)
+
+// ChannelMessage is a message posted in the public channel of a category.
+type ChannelMessage struct {
+	ID       int       `json:"id"`
+	Channel  string    `json:"channel"`
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Content  string    `json:"content"`
+	SentAt   time.Time `json:"sent_at"`
+}
+
+type ChannelMember struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+func InsertChannelMessage(channel string, userID int, content string) (ChannelMessage, error) {
+	var message ChannelMessage
+	err := Db.QueryRow(`
+    INSERT INTO channel_messages (category, user_id, content)
+    VALUES (?, ?, ?)
+    RETURNING id, category, user_id, content, sent_at`,
+		channel, userID, content).Scan(&message.ID, &message.Channel, &message.UserID, &message.Content, &message.SentAt)
+	if err != nil {
+		return message, err
+	}
+
+	err = Db.QueryRow("SELECT uname FROM users WHERE id = ?", userID).Scan(&message.Username)
+	return message, err
+}
+
+// GetChannelMessages returns up to limit messages of a channel sent before
+// the message beforeID, or the latest ones when beforeID is 0, oldest
+// first.
+func GetChannelMessages(channel string, beforeID, limit int) ([]ChannelMessage, error) {
+	rows, err := Db.Query(`
+    SELECT * FROM (
+        SELECT cm.id, cm.category, cm.user_id, u.uname, cm.content, cm.sent_at
+        FROM channel_messages cm
+        JOIN users u ON u.id = cm.user_id
+        WHERE cm.category = ? AND (? = 0 OR cm.id < ?)
+        ORDER BY cm.id DESC
+        LIMIT ?
+    ) ORDER BY id ASC`,
+		channel, beforeID, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []ChannelMessage{}
+	for rows.Next() {
+		var m ChannelMessage
+		if err := rows.Scan(&m.ID, &m.Channel, &m.UserID, &m.Username, &m.Content, &m.SentAt); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// GetChannelMembers returns the ids and usernames of the given users,
+// sorted by username.
+func GetChannelMembers(userIDs []int) ([]ChannelMember, error) {
+	members := []ChannelMember{}
+	if len(userIDs) == 0 {
+		return members, nil
+	}
+
+	args := make([]interface{}, len(userIDs))
+	for i, id := range userIDs {
+		args[i] = id
+	}
+	rows, err := Db.Query(`
+    SELECT id, uname FROM users
+    WHERE id IN (?`+strings.Repeat(", ?", len(userIDs)-1)+`)
+    ORDER BY uname`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m ChannelMember
+		if err := rows.Scan(&m.UserID, &m.Username); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
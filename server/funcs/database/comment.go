@@ -19,7 +19,14 @@ func InsertComment(postid, user_id int, content string) (int, error) {
 }
 
 func GetComment(id, userID, limit, offset int) ([]Data.COMMENT, error) {
-	rows, err := Db.Query("SELECT comments.id,users.uname,comments.content FROM comments JOIN users ON comments.user_id = users.id WHERE comments.post_id = ? ORDER BY comments.id DESC LIMIT ? OFFSET ?", id, limit, offset)
+	// Comments of users the viewer blocked are hidden
+	rows, err := Db.Query(`
+    SELECT comments.id, users.uname, comments.content
+    FROM comments
+    JOIN users ON comments.user_id = users.id
+    WHERE comments.post_id = ?
+    AND comments.user_id NOT IN (SELECT blocked_id FROM blocks WHERE blocker_id = ?)
+    ORDER BY comments.id DESC LIMIT ? OFFSET ?`, id, userID, limit, offset)
 	if err != nil {
 		return []Data.COMMENT{}, err
 	}
@@ -56,3 +63,8 @@ func getCommentLikeDisLike(comment_id, inter int) int {
 	}
 	return count
 }
+
+func GetCommentAuthor(commentID int) (userID, postID int, err error) {
+	err = Db.QueryRow("SELECT user_id, post_id FROM comments WHERE id = ?", commentID).Scan(&userID, &postID)
+	return userID, postID, err
+}
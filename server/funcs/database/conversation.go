@@ -0,0 +1,301 @@
+package forum
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+
+	RoleOwner  = "owner"
+	RoleMember = "member"
+)
+
+// directKeySQL builds the direct_key of a pair of user id columns, the
+// same way directKey does.
+const directKeySQL = "MIN(%[1]s, %[2]s) || ':' || MAX(%[1]s, %[2]s)"
+
+type ConversationMember struct {
+	UserID   int       `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	IsOnline bool      `json:"is_online"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type ConversationInfo struct {
+	ID        int                  `json:"id"`
+	Type      string               `json:"type"`
+	Name      string               `json:"name"`
+	Avatar    string               `json:"avatar"`
+	CreatedAt time.Time            `json:"created_at"`
+	Members   []ConversationMember `json:"members"`
+}
+
+// directKey identifies the direct conversation of two users.
+func directKey(a, b int) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
+}
+
+func GetDirectConversationID(a, b int) (int, error) {
+	var id int
+	err := Db.QueryRow("SELECT id FROM conversations WHERE direct_key = ?", directKey(a, b)).Scan(&id)
+	return id, err
+}
+
+// GetOrCreateDirectConversation returns the conversation of two users,
+// creating it with both as members the first time. A conversation a
+// starts is a message request until b accepts it, unless b follows a.
+func GetOrCreateDirectConversation(a, b int) (int, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	key := directKey(a, b)
+	_, err = tx.Exec(`
+    INSERT OR IGNORE INTO conversations (type, direct_key, created_by, request_status)
+    VALUES (?, ?, ?, CASE
+        WHEN EXISTS (SELECT 1 FROM follows WHERE follower_id = ? AND followee_id = ?) THEN ?
+        ELSE ?
+    END)`,
+		ConversationDirect, key, a, b, a, RequestAccepted, RequestPending)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	if err := tx.QueryRow("SELECT id FROM conversations WHERE direct_key = ?", key).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	for _, userID := range []int{a, b} {
+		_, err := tx.Exec(`
+        INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role)
+        VALUES (?, ?, ?)`,
+			id, userID, RoleMember)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return id, tx.Commit()
+}
+
+// CreateGroupConversation creates a group owned by ownerID with the given
+// members.
+func CreateGroupConversation(ownerID int, name, avatar string, memberIDs []int) (int, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+    INSERT INTO conversations (type, name, avatar, created_by)
+    VALUES (?, ?, ?, ?)`,
+		ConversationGroup, name, avatar, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+    INSERT INTO conversation_members (conversation_id, user_id, role)
+    VALUES (?, ?, ?)`,
+		id, ownerID, RoleOwner)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, userID := range memberIDs {
+		if userID == ownerID {
+			continue
+		}
+		_, err := tx.Exec(`
+        INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role)
+        VALUES (?, ?, ?)`,
+			id, userID, RoleMember)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return int(id), tx.Commit()
+}
+
+// GetConversation returns a conversation with its members, owners first.
+// Their online status is the raw one, use SeenBy before showing it.
+func GetConversation(conversationID int) (ConversationInfo, error) {
+	var info ConversationInfo
+	err := Db.QueryRow(`
+    SELECT id, type, name, avatar, created_at
+    FROM conversations WHERE id = ?`,
+		conversationID).Scan(&info.ID, &info.Type, &info.Name, &info.Avatar, &info.CreatedAt)
+	if err != nil {
+		return info, err
+	}
+
+	rows, err := Db.Query(`
+    SELECT u.id, u.uname, m.role, COALESCE(us.is_online, false), m.joined_at
+    FROM conversation_members m
+    JOIN users u ON u.id = m.user_id
+    LEFT JOIN user_sessions us ON us.user_id = u.id
+    WHERE m.conversation_id = ?
+    ORDER BY m.role = 'owner' DESC, m.joined_at, u.uname`,
+		conversationID)
+	if err != nil {
+		return info, err
+	}
+	defer rows.Close()
+
+	info.Members = []ConversationMember{}
+	for rows.Next() {
+		var m ConversationMember
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.IsOnline, &m.JoinedAt); err != nil {
+			return info, err
+		}
+		info.Members = append(info.Members, m)
+	}
+	return info, rows.Err()
+}
+
+// SeenBy returns the conversation as viewerID sees it: the members whose
+// presence they can't see look offline, see CanSeePresence.
+func (info ConversationInfo) SeenBy(viewerID int) ConversationInfo {
+	members := make([]ConversationMember, len(info.Members))
+	copy(members, info.Members)
+	for i, m := range members {
+		if m.IsOnline && m.UserID != viewerID && !CanSeePresence(viewerID, m.UserID) {
+			members[i].IsOnline = false
+		}
+	}
+	info.Members = members
+	return info
+}
+
+func UpdateConversation(conversationID int, name, avatar string) error {
+	_, err := Db.Exec(`
+    UPDATE conversations SET name = ?, avatar = ?
+    WHERE id = ? AND type = ?`,
+		name, avatar, conversationID, ConversationGroup)
+	return err
+}
+
+// GetConversationRole returns the role of userID in a conversation, or
+// sql.ErrNoRows if they aren't a member.
+func GetConversationRole(conversationID, userID int) (string, error) {
+	var role string
+	err := Db.QueryRow(`
+    SELECT role FROM conversation_members
+    WHERE conversation_id = ? AND user_id = ?`,
+		conversationID, userID).Scan(&role)
+	return role, err
+}
+
+func GetConversationType(conversationID int) (string, error) {
+	var kind string
+	err := Db.QueryRow("SELECT type FROM conversations WHERE id = ?", conversationID).Scan(&kind)
+	return kind, err
+}
+
+func GetConversationMemberIDs(conversationID int) ([]int, error) {
+	rows, err := Db.Query(`
+    SELECT user_id FROM conversation_members
+    WHERE conversation_id = ?`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func CountConversationMembers(conversationID int) (int, error) {
+	var count int
+	err := Db.QueryRow(`
+    SELECT COUNT(*) FROM conversation_members
+    WHERE conversation_id = ?`, conversationID).Scan(&count)
+	return count, err
+}
+
+// AddConversationMembers adds users to a group and returns the ones that
+// weren't members yet.
+func AddConversationMembers(conversationID int, userIDs []int) ([]int, error) {
+	var added []int
+	for _, userID := range userIDs {
+		result, err := Db.Exec(`
+        INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role)
+        VALUES (?, ?, ?)`,
+			conversationID, userID, RoleMember)
+		if err != nil {
+			return added, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			added = append(added, userID)
+		}
+	}
+	return added, nil
+}
+
+// RemoveConversationMember removes a user from a group. When the owner
+// leaves, the longest standing member becomes the owner, whose id is
+// returned (0 if ownership didn't change).
+func RemoveConversationMember(conversationID, userID int) (int, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var role string
+	err = tx.QueryRow(`
+    DELETE FROM conversation_members
+    WHERE conversation_id = ? AND user_id = ?
+    RETURNING role`,
+		conversationID, userID).Scan(&role)
+	if err != nil {
+		return 0, err
+	}
+
+	newOwner := 0
+	if role == RoleOwner {
+		err := tx.QueryRow(`
+        UPDATE conversation_members SET role = ?
+        WHERE conversation_id = ? AND user_id = (
+            SELECT user_id FROM conversation_members
+            WHERE conversation_id = ?
+            ORDER BY joined_at, user_id
+            LIMIT 1
+        )
+        RETURNING user_id`,
+			RoleOwner, conversationID, conversationID).Scan(&newOwner)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM conversation_reads WHERE conversation_id = ? AND user_id = ?", conversationID, userID); err != nil {
+		return 0, err
+	}
+
+	return newOwner, tx.Commit()
+}
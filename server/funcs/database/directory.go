@@ -0,0 +1,116 @@
+package forum
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Why a user is suggested, most relevant first.
+const (
+	SuggestMutualFollow    = "mutual_follow"
+	SuggestFollowsYou      = "follows_you"
+	SuggestRecentCommenter = "recent_commenter"
+)
+
+type DirectoryUser struct {
+	UserID      int    `json:"user_id"`
+	Username    string `json:"username"`
+	IsOnline    bool   `json:"is_online"`
+	IsFollowing bool   `json:"is_following"`
+	Reason      string `json:"reason,omitempty"` // only set on suggestions
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// directoryColumns selects u as seen by the viewer. A user whose request
+// the viewer sent hasn't been accepted yet looks offline, see
+// CanSeePresence.
+var directoryColumns = `
+    u.id,
+    u.uname,
+    COALESCE(us.is_online, 0) AND NOT EXISTS (
+        SELECT 1 FROM conversations rc
+        WHERE rc.direct_key = ` + fmt.Sprintf(directKeySQL, "u.id", "?1") + `
+        AND rc.created_by = ?1 AND rc.request_status != 'accepted'
+    ) AS online,
+    EXISTS (SELECT 1 FROM follows WHERE follower_id = ?1 AND followee_id = u.id)`
+
+// notBlockedEither keeps the users u with no block between them and the
+// viewer ?1.
+const notBlockedEither = `
+    AND u.id NOT IN (SELECT blocked_id FROM blocks WHERE blocker_id = ?1)
+    AND u.id NOT IN (SELECT blocker_id FROM blocks WHERE blocked_id = ?1)`
+
+// SearchUsers returns a page of the users whose name starts with prefix,
+// as seen by viewerID: online users first, then by name. Users with a
+// block between them and the viewer are left out.
+func SearchUsers(viewerID int, prefix string, limit, offset int) ([]DirectoryUser, error) {
+	return scanDirectoryUsers(false, `
+    SELECT`+directoryColumns+`
+    FROM users u
+    LEFT JOIN user_sessions us ON us.user_id = u.id
+    WHERE u.id != ?1 AND u.uname LIKE ?2 || '%' ESCAPE '\'`+notBlockedEither+`
+    ORDER BY online DESC, u.uname COLLATE NOCASE, u.id
+    LIMIT ?3 OFFSET ?4`,
+		viewerID, likeEscaper.Replace(prefix), limit, offset)
+}
+
+// GetUserSuggestions returns users viewerID may want to talk to and has
+// no conversation with yet: mutual follows, then followers, then the
+// latest commenters on their posts.
+func GetUserSuggestions(viewerID, limit int) ([]DirectoryUser, error) {
+	return scanDirectoryUsers(true, `
+    WITH candidates (user_id, reason, rank) AS (
+        SELECT f.followee_id, ?2, 1 FROM follows f
+        JOIN follows back ON back.follower_id = f.followee_id AND back.followee_id = f.follower_id
+        WHERE f.follower_id = ?1
+        UNION ALL
+        SELECT follower_id, ?3, 2 FROM follows WHERE followee_id = ?1
+        UNION ALL
+        SELECT user_id, ?4, 3 FROM (
+            SELECT c.user_id FROM comments c
+            JOIN posts p ON p.id = c.post_id
+            WHERE p.user_id = ?1
+            ORDER BY c.id DESC
+            LIMIT 100
+        )
+    ),
+    -- SQLite takes reason from the row with the lowest rank
+    best AS (
+        SELECT user_id, reason, MIN(rank) AS rank FROM candidates GROUP BY user_id
+    )
+    SELECT`+directoryColumns+`, best.reason
+    FROM best
+    JOIN users u ON u.id = best.user_id
+    LEFT JOIN user_sessions us ON us.user_id = u.id
+    WHERE u.id != ?1`+notBlockedEither+`
+    AND NOT EXISTS (
+        SELECT 1 FROM conversations dc
+        WHERE dc.direct_key = `+fmt.Sprintf(directKeySQL, "u.id", "?1")+`
+    )
+    ORDER BY best.rank, online DESC, u.uname COLLATE NOCASE
+    LIMIT ?5`,
+		viewerID, SuggestMutualFollow, SuggestFollowsYou, SuggestRecentCommenter, limit)
+}
+
+func scanDirectoryUsers(withReason bool, query string, args ...interface{}) ([]DirectoryUser, error) {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []DirectoryUser{}
+	for rows.Next() {
+		var user DirectoryUser
+		dest := []interface{}{&user.UserID, &user.Username, &user.IsOnline, &user.IsFollowing}
+		if withReason {
+			dest = append(dest, &user.Reason)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
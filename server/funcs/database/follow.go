@@ -0,0 +1,136 @@
+package forum
+
+import (
+	"errors"
+	"time"
+)
+
+type FollowUser struct {
+	UserID     int       `json:"user_id"`
+	Username   string    `json:"username"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+type Profile struct {
+	UserID         int          `json:"user_id"`
+	Username       string       `json:"username"`
+	FirstName      string       `json:"first_name"`
+	LastName       string       `json:"last_name"`
+	CreatedAt      time.Time    `json:"created_at"`
+	IsOnline       bool         `json:"is_online"`
+	Status         string       `json:"status"`
+	StatusText     string       `json:"status_text,omitempty"`
+	LastSeen       *time.Time   `json:"last_seen,omitempty"`
+	IsFollowing    bool         `json:"is_following"`
+	IsBlocked      bool         `json:"is_blocked"` // the viewer blocked them
+	FollowerCount  int          `json:"follower_count"`
+	FollowingCount int          `json:"following_count"`
+	Followers      []FollowUser `json:"followers"`
+	Following      []FollowUser `json:"following"`
+}
+
+// Follow makes followerID follow followeeID. It reports whether the
+// follow is new, so callers only notify once.
+func Follow(followerID, followeeID int) (bool, error) {
+	if followerID == followeeID {
+		return false, errors.New("users can't follow themselves")
+	}
+
+	result, err := Db.Exec(`
+    INSERT OR IGNORE INTO follows (follower_id, followee_id)
+    VALUES (?, ?)`,
+		followerID, followeeID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func Unfollow(followerID, followeeID int) error {
+	_, err := Db.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID)
+	return err
+}
+
+func IsFollowing(followerID, followeeID int) bool {
+	var id int
+	err := Db.QueryRow("SELECT follower_id FROM follows WHERE follower_id = ? AND followee_id = ?", followerID, followeeID).Scan(&id)
+	return err == nil
+}
+
+func GetFollowers(userID, limit, offset int) ([]FollowUser, error) {
+	return scanFollowUsers(`
+    SELECT u.id, u.uname, f.created_at
+    FROM follows f
+    JOIN users u ON u.id = f.follower_id
+    WHERE f.followee_id = ?
+    ORDER BY f.created_at DESC, u.id DESC
+    LIMIT ? OFFSET ?`, userID, limit, offset)
+}
+
+func GetFollowing(userID, limit, offset int) ([]FollowUser, error) {
+	return scanFollowUsers(`
+    SELECT u.id, u.uname, f.created_at
+    FROM follows f
+    JOIN users u ON u.id = f.followee_id
+    WHERE f.follower_id = ?
+    ORDER BY f.created_at DESC, u.id DESC
+    LIMIT ? OFFSET ?`, userID, limit, offset)
+}
+
+func scanFollowUsers(query string, args ...interface{}) ([]FollowUser, error) {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []FollowUser{}
+	for rows.Next() {
+		var user FollowUser
+		if err := rows.Scan(&user.UserID, &user.Username, &user.FollowedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// GetProfile returns userID's public profile as seen by viewerID, with
+// the first page of followers and followed users.
+func GetProfile(userID, viewerID, listLimit int) (*Profile, error) {
+	p := &Profile{}
+	err := Db.QueryRow(`
+    SELECT
+        u.id, u.uname, u.first_name, u.last_name, u.created_at,
+        COALESCE(us.is_online, false),
+        (SELECT COUNT(*) FROM follows WHERE followee_id = u.id),
+        (SELECT COUNT(*) FROM follows WHERE follower_id = u.id)
+    FROM users u
+    LEFT JOIN user_sessions us ON us.user_id = u.id
+    WHERE u.id = ?`, userID).Scan(
+		&p.UserID, &p.Username, &p.FirstName, &p.LastName, &p.CreatedAt,
+		&p.IsOnline, &p.FollowerCount, &p.FollowingCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if viewerID > 0 {
+		p.IsFollowing = IsFollowing(viewerID, userID)
+		p.IsBlocked = HasBlocked(viewerID, userID)
+		if !CanSeePresence(viewerID, userID) {
+			p.IsOnline = false
+		}
+	}
+
+	if p.Followers, err = GetFollowers(userID, listLimit, 0); err != nil {
+		return nil, err
+	}
+	if p.Following, err = GetFollowing(userID, listLimit, 0); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
@@ -1,6 +1,8 @@
 package forum
 
-func AddInteractions(user_id int, postID, action, types string) error {
+// AddInteractions toggles a like or dislike and returns the resulting
+// interaction: 1 for a like, -1 for a dislike, 0 when cleared.
+func AddInteractions(user_id int, postID, action, types string) (int, error) {
 	interaction := 0
 	var err error
 	if types == "post" {
@@ -24,8 +26,9 @@ func AddInteractions(user_id int, postID, action, types string) error {
 			_, err = Db.Exec("UPDATE comment_interactions SET interaction=? where comment_id= ? and user_id= ?", interaction, postID, user_id)
 		}
 		if err != nil {
-			return err
+			return 0, err
 		}
+		return interaction, nil
 	} else {
 		var selector string
 		if types == "post" {
@@ -36,14 +39,23 @@ func AddInteractions(user_id int, postID, action, types string) error {
 		if action == "like" {
 			_, err := Db.Exec(selector, user_id, postID, 1)
 			if err != nil {
-				return err
+				return 0, err
 			}
+			return 1, nil
 		} else {
 			_, err := Db.Exec(selector, user_id, postID, -1)
 			if err != nil {
-				return err
+				return 0, err
 			}
+			return -1, nil
 		}
 	}
-	return nil
+}
+
+// GetReactionCounts returns the likes and dislikes of a post or comment.
+func GetReactionCounts(types string, id int) (int, int) {
+	if types == "post" {
+		return getPostLikeDisLike(id, 1), getPostLikeDisLike(id, -1)
+	}
+	return getCommentLikeDisLike(id, 1), getCommentLikeDisLike(id, -1)
 }
@@ -0,0 +1,208 @@
+package forum
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Databases created before migrations were upgraded in place at every
+// startup. When the first migration baselines one of them, the upgrades
+// it may still lack run in the same transaction: upgradeLegacyTables
+// before the migration, so its indexes find their columns, and
+// backfillLegacyData after, once the tables it fills exist. This code is
+// frozen, schema changes go in new migrations.
+
+// legacyColumns are the columns added to tables after their creation.
+var legacyColumns = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"private_messages", "delivered_at", "DATETIME"},
+	{"private_messages", "read_at", "DATETIME"},
+	{"private_messages", "edited_at", "DATETIME"},
+	{"private_messages", "deleted_at", "DATETIME"},
+	{"users", "dm_privacy", "TEXT NOT NULL DEFAULT 'everyone'"},
+	{"conversations", "request_status", "TEXT NOT NULL DEFAULT 'accepted'"},
+	{"user_sessions", "status", "TEXT NOT NULL DEFAULT 'online'"},
+	{"user_sessions", "status_text", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// legacyPrivateMessagesTable is private_messages as the first migration
+// creates it.
+const legacyPrivateMessagesTable = `
+    CREATE TABLE private_messages_new (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        conversation_id INTEGER,
+        sender_id INTEGER NOT NULL,
+        receiver_id INTEGER,
+        content TEXT NOT NULL,
+        sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+        is_read BOOLEAN DEFAULT false,
+        delivered_at DATETIME,
+        read_at DATETIME,
+        edited_at DATETIME,
+        deleted_at DATETIME,
+        FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+        FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+        FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE
+    )`
+
+// isLegacyDatabase reports whether the database has tables but was never
+// migrated.
+func isLegacyDatabase(ctx context.Context, q queryer) (bool, error) {
+	migrated, err := hasTable(ctx, q, "schema_migrations")
+	if err != nil || migrated {
+		return false, err
+	}
+	return hasTable(ctx, q, "users")
+}
+
+// upgradeLegacyTables adds the missing columns of the existing tables and
+// gives private_messages its conversation_id column.
+func upgradeLegacyTables(ctx context.Context, tx *sql.Tx) error {
+	for _, c := range legacyColumns {
+		exists, err := hasTable(ctx, tx, c.table)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s table: %v", c.table, err)
+		}
+		if !exists {
+			// The migration creates it whole
+			continue
+		}
+		exists, err = hasColumn(ctx, tx, c.table, c.column)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s table: %v", c.table, err)
+		}
+		if exists {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition))
+		if err != nil {
+			return fmt.Errorf("failed to add %s.%s column: %v", c.table, c.column, err)
+		}
+	}
+
+	exists, err := hasTable(ctx, tx, "private_messages")
+	if err != nil || !exists {
+		return err
+	}
+	migrated, err := hasColumn(ctx, tx, "private_messages", "conversation_id")
+	if err != nil || migrated {
+		return err
+	}
+	if err := rebuildPrivateMessages(ctx, tx); err != nil {
+		return fmt.Errorf("failed to rebuild private_messages: %v", err)
+	}
+	return nil
+}
+
+// rebuildPrivateMessages recreates private_messages with its
+// conversation_id column, since SQLite can't add the column's foreign key
+// or drop receiver_id's NOT NULL in place.
+func rebuildPrivateMessages(ctx context.Context, tx *sql.Tx) error {
+	columns := "id, sender_id, receiver_id, content, sent_at, is_read, delivered_at, read_at, edited_at, deleted_at"
+	statements := []string{
+		legacyPrivateMessagesTable,
+		"INSERT INTO private_messages_new (" + columns + ") SELECT " + columns + " FROM private_messages",
+		"DROP TABLE private_messages",
+		"ALTER TABLE private_messages_new RENAME TO private_messages",
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillLegacyData gives each pair of users who exchanged messages a
+// direct conversation and moves the read watermarks to conversation_reads.
+func backfillLegacyData(ctx context.Context, tx *sql.Tx) error {
+	if err := backfillConversations(ctx, tx); err != nil {
+		return fmt.Errorf("failed to migrate conversations: %v", err)
+	}
+	if err := migrateReadState(ctx, tx); err != nil {
+		return fmt.Errorf("failed to migrate message read state: %v", err)
+	}
+	if err := seedReadState(ctx, tx); err != nil {
+		return fmt.Errorf("failed to seed message read state: %v", err)
+	}
+	return nil
+}
+
+func backfillConversations(ctx context.Context, tx *sql.Tx) error {
+	pair := fmt.Sprintf(directKeySQL, "sender_id", "receiver_id")
+	_, err := tx.ExecContext(ctx, `
+    INSERT OR IGNORE INTO conversations (type, direct_key, created_by, created_at)
+    SELECT 'direct', `+pair+`, MIN(sender_id), MIN(sent_at)
+    FROM private_messages
+    WHERE conversation_id IS NULL AND receiver_id IS NOT NULL
+    GROUP BY `+pair)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []string{"sender_id", "receiver_id"} {
+		_, err := tx.ExecContext(ctx, `
+        INSERT OR IGNORE INTO conversation_members (conversation_id, user_id, role, joined_at)
+        SELECT c.id, pm.`+column+`, 'member', c.created_at
+        FROM private_messages pm
+        JOIN conversations c ON c.direct_key = `+fmt.Sprintf(directKeySQL, "pm.sender_id", "pm.receiver_id")+`
+        WHERE pm.conversation_id IS NULL AND pm.receiver_id IS NOT NULL`)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    UPDATE private_messages
+    SET conversation_id = (
+        SELECT id FROM conversations WHERE direct_key = `+pair+`
+    )
+    WHERE conversation_id IS NULL AND receiver_id IS NOT NULL`)
+	return err
+}
+
+// migrateReadState moves the per-peer watermarks of message_read_state,
+// which predates conversations, to conversation_reads.
+func migrateReadState(ctx context.Context, tx *sql.Tx) error {
+	exists, err := hasTable(ctx, tx, "message_read_state")
+	if err != nil || !exists {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+    INSERT OR IGNORE INTO conversation_reads (conversation_id, user_id, last_read_message_id, updated_at)
+    SELECT c.id, rs.user_id, rs.last_read_message_id, rs.updated_at
+    FROM message_read_state rs
+    JOIN conversations c ON c.direct_key = `+fmt.Sprintf(directKeySQL, "rs.user_id", "rs.peer_id"))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DROP TABLE message_read_state")
+	return err
+}
+
+// seedReadState sets the read watermarks of databases created before they
+// existed from the messages already flagged as read.
+func seedReadState(ctx context.Context, tx *sql.Tx) error {
+	var count int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM conversation_reads").Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+    INSERT INTO conversation_reads (conversation_id, user_id, last_read_message_id)
+    SELECT conversation_id, receiver_id, MAX(id)
+    FROM private_messages
+    WHERE is_read = true AND conversation_id IS NOT NULL AND receiver_id IS NOT NULL
+    GROUP BY conversation_id, receiver_id`)
+	return err
+}
@@ -0,0 +1,99 @@
+package forum
+
+import "database/sql"
+
+// A direct conversation started by a user the other one doesn't follow is
+// a message request: it is listed apart from the recipient's
+// conversations, and the sender doesn't see the recipient's read
+// receipts or online status until the recipient accepts it, by accepting
+// explicitly or by replying. A declined request stops the sender from
+// sending more messages.
+const (
+	RequestAccepted = "accepted"
+	RequestPending  = "pending"
+	RequestDeclined = "declined"
+)
+
+// GetRequestStatus returns the request status of a conversation and the
+// user who started it.
+func GetRequestStatus(conversationID int) (string, int, error) {
+	var status string
+	var createdBy int
+	err := Db.QueryRow(`
+    SELECT request_status, COALESCE(created_by, 0) FROM conversations WHERE id = ?`,
+		conversationID).Scan(&status, &createdBy)
+	return status, createdBy, err
+}
+
+// IsRequestPendingFor reports whether the direct conversation is a
+// request userID hasn't accepted yet.
+func IsRequestPendingFor(conversationID, userID int) bool {
+	status, createdBy, err := GetRequestStatus(conversationID)
+	return err == nil && status != RequestAccepted && createdBy != userID
+}
+
+// SetRequestStatus answers a request sent to recipientID. It fails with
+// sql.ErrNoRows when the conversation isn't such a request.
+func SetRequestStatus(conversationID, recipientID int, status string) error {
+	var id int
+	return Db.QueryRow(`
+    UPDATE conversations SET request_status = ?
+    WHERE id = ? AND type = ? AND request_status != ? AND created_by != ?
+    AND id IN (SELECT conversation_id FROM conversation_members WHERE user_id = ?)
+    RETURNING id`,
+		status, conversationID, ConversationDirect, RequestAccepted, recipientID, recipientID).Scan(&id)
+}
+
+// AcceptRequestFrom accepts the request requesterID sent to recipientID,
+// if any, and returns its conversation id, or 0.
+func AcceptRequestFrom(recipientID, requesterID int) (int, error) {
+	var id int
+	err := Db.QueryRow(`
+    UPDATE conversations SET request_status = ?
+    WHERE direct_key = ? AND created_by = ? AND request_status != ?
+    RETURNING id`,
+		RequestAccepted, directKey(recipientID, requesterID), requesterID, RequestAccepted).Scan(&id)
+	if err != nil && err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// hasUnacceptedRequest reports whether fromID sent toID a request toID
+// hasn't accepted.
+func hasUnacceptedRequest(fromID, toID int) bool {
+	var id int
+	err := Db.QueryRow(`
+    SELECT id FROM conversations
+    WHERE direct_key = ? AND created_by = ? AND request_status != ?`,
+		directKey(fromID, toID), fromID, RequestAccepted).Scan(&id)
+	return err == nil
+}
+
+func requestDeclined(fromID, toID int) bool {
+	var id int
+	err := Db.QueryRow(`
+    SELECT id FROM conversations
+    WHERE direct_key = ? AND created_by = ? AND request_status = ?`,
+		directKey(fromID, toID), fromID, RequestDeclined).Scan(&id)
+	return err == nil
+}
+
+// CanSeePresence reports whether viewerID may see userID's online
+// status: userID didn't block them and has no unanswered request from
+// them.
+func CanSeePresence(viewerID, userID int) bool {
+	return !HasBlocked(userID, viewerID) && !hasUnacceptedRequest(viewerID, userID)
+}
+
+// GetPresenceHiddenFrom returns the users who can't see userID's online
+// status, see CanSeePresence.
+func GetPresenceHiddenFrom(userID int) (map[int]bool, error) {
+	return scanIDSet(`
+    SELECT blocked_id FROM blocks WHERE blocker_id = ?
+    UNION
+    SELECT c.created_by FROM conversations c
+    JOIN conversation_members m ON m.conversation_id = c.id AND m.user_id = ?
+    WHERE c.type = ? AND c.request_status != ? AND c.created_by != ?`,
+		userID, userID, ConversationDirect, RequestAccepted, userID)
+}
@@ -8,33 +8,84 @@ import (
 )
 
 type Message struct {
-	ID         int       `json:"id"`
-	SenderID   int       `json:"sender_id"`
+	ID             int `json:"id"`
+	ConversationID int `json:"conversation_id"`
+	SenderID       int `json:"sender_id"`
+	// ReceiverID is 0 in group conversations.
 	ReceiverID int       `json:"receiver_id"`
 	Content    string    `json:"content"`
 	SentAt     time.Time `json:"sent_at"`
 	SenderName string    `json:"sender_name"`
 	IsRead     bool      `json:"is_read"`
+	// DeliveredAt is set once the message reached one of the receiver's
+	// connections, ReadAt once the receiver opened it. Group messages
+	// track reads with the members' watermarks instead.
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+	EditedAt    *time.Time `json:"edited_at"`
+	// Deleted messages stay as tombstones with an empty content.
+	DeletedAt *time.Time `json:"deleted_at"`
+	IsDeleted bool       `json:"is_deleted"`
 }
 
+// MessageEdit is a previous content of an edited message, with the time
+// it was written.
+type MessageEdit struct {
+	Content  string    `json:"content"`
+	EditedAt time.Time `json:"edited_at"`
+}
+
+// MessageReceipt identifies a message whose delivery or read state changed.
+type MessageReceipt struct {
+	MessageID int `json:"message_id"`
+	SenderID  int `json:"sender_id"`
+}
+
+// Conversation is an entry of the chat list. Direct conversations carry
+// the other user in UserID, Username and IsOnline, groups their Name,
+// Avatar and MemberCount.
 type Conversation struct {
+	ConversationID  int       `json:"conversation_id"`
+	Type            string    `json:"type"`
 	UserID          int       `json:"user_id"`
 	Username        string    `json:"username"`
+	Name            string    `json:"name,omitempty"`
+	Avatar          string    `json:"avatar,omitempty"`
+	MemberCount     int       `json:"member_count,omitempty"`
 	LastMessage     string    `json:"last_message"`
 	LastMessageTime time.Time `json:"last_message_time"`
 	UnreadCount     int       `json:"unread_count"`
 	IsOnline        bool      `json:"is_online"`
+	// RequestStatus is pending or declined while the other user hasn't
+	// accepted a first-contact conversation, see message_requests.go.
+	RequestStatus string `json:"request_status,omitempty"`
 }
 
+// InsertMessage stores a direct message, creating the conversation of the
+// two users on their first message.
 func InsertMessage(senderID, receiverID int, content string) (int, error) {
 	if senderID == receiverID {
 		return 0, errors.New("senderID should not equal receiverID")
 	}
 
+	conversationID, err := GetOrCreateDirectConversation(senderID, receiverID)
+	if err != nil {
+		return 0, err
+	}
+
+	return insertMessage(conversationID, senderID, receiverID, content)
+}
+
+// InsertGroupMessage stores a message sent to a group conversation.
+func InsertGroupMessage(conversationID, senderID int, content string) (int, error) {
+	return insertMessage(conversationID, senderID, nil, content)
+}
+
+func insertMessage(conversationID, senderID int, receiverID interface{}, content string) (int, error) {
 	result, err := Db.Exec(`
-    INSERT INTO private_messages (sender_id, receiver_id, content, sent_at) 
-    VALUES (?, ?, ?, CURRENT_TIMESTAMP)`,
-		senderID, receiverID, content)
+    INSERT INTO private_messages (conversation_id, sender_id, receiver_id, content, sent_at) 
+    VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+		conversationID, senderID, receiverID, content)
 	if err != nil {
 		return 0, err
 	}
@@ -48,25 +99,34 @@ func InsertMessage(senderID, receiverID int, content string) (int, error) {
 	return int(messageID), nil
 }
 
-func GetMessages(userID, otherUserID, limit, offset int) ([]Message, error) {
-	rows, err := Db.Query(`
-    WITH messages_ordered AS (
-        SELECT 
+// messageColumns are the columns scanMessage reads, from private_messages
+// pm joined with the sender's users row u.
+const messageColumns = `
             pm.id,
+            COALESCE(pm.conversation_id, 0),
             pm.sender_id,
-            pm.receiver_id,
+            COALESCE(pm.receiver_id, 0),
             pm.content,
             pm.sent_at,
             u.uname as sender_name,
-            pm.is_read
+            pm.is_read,
+            pm.delivered_at,
+            pm.read_at,
+            pm.edited_at,
+            pm.deleted_at`
+
+func GetMessages(userID, otherUserID, limit, offset int) ([]Message, error) {
+	rows, err := Db.Query(`
+    WITH messages_ordered AS (
+        SELECT `+messageColumns+`
         FROM private_messages pm
         JOIN users u ON pm.sender_id = u.id
         WHERE (pm.sender_id = ? AND pm.receiver_id = ?)
            OR (pm.sender_id = ? AND pm.receiver_id = ?)
-        ORDER BY pm.sent_at DESC
+        ORDER BY pm.sent_at DESC, pm.id DESC
         LIMIT ? OFFSET ?
     )
-    SELECT * FROM messages_ordered ORDER BY sent_at ASC
+    SELECT * FROM messages_ordered ORDER BY sent_at ASC, id ASC
     `, userID, otherUserID,
 		otherUserID, userID,
 		limit, offset)
@@ -77,76 +137,146 @@ func GetMessages(userID, otherUserID, limit, offset int) ([]Message, error) {
 
 	var messages []Message
 	for rows.Next() {
-		var msg Message
-		err := rows.Scan(
-			&msg.ID,
-			&msg.SenderID,
-			&msg.ReceiverID,
-			&msg.Content,
-			&msg.SentAt,
-			&msg.SenderName,
-			&msg.IsRead,
-		)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
 		messages = append(messages, msg)
 	}
 
-	// Mark messages as read
-	_, err = Db.Exec(`
-		UPDATE private_messages 
-		SET is_read = true 
-		WHERE receiver_id = ? AND sender_id = ? AND is_read = false`,
-		userID, otherUserID,
-	)
+	return messages, rows.Err()
+}
+
+// GetConversationMessages returns a page of a conversation's messages,
+// newest page first and oldest message first within the page.
+func GetConversationMessages(conversationID, limit, offset int) ([]Message, error) {
+	rows, err := Db.Query(`
+    WITH messages_ordered AS (
+        SELECT `+messageColumns+`
+        FROM private_messages pm
+        JOIN users u ON pm.sender_id = u.id
+        WHERE pm.conversation_id = ?
+        ORDER BY pm.sent_at DESC, pm.id DESC
+        LIMIT ? OFFSET ?
+    )
+    SELECT * FROM messages_ordered ORDER BY sent_at ASC, id ASC
+    `, conversationID, limit, offset)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// GetMessage returns a single message by id.
+func GetMessage(messageID int) (Message, error) {
+	row := Db.QueryRow(`
+    SELECT `+messageColumns+`
+    FROM private_messages pm
+    JOIN users u ON pm.sender_id = u.id
+    WHERE pm.id = ?`, messageID)
+	return scanMessage(row)
+}
+
+func scanMessage(row interface{ Scan(...interface{}) error }) (Message, error) {
+	var msg Message
+	var deliveredAt, readAt, editedAt, deletedAt sql.NullTime
+	err := row.Scan(
+		&msg.ID,
+		&msg.ConversationID,
+		&msg.SenderID,
+		&msg.ReceiverID,
+		&msg.Content,
+		&msg.SentAt,
+		&msg.SenderName,
+		&msg.IsRead,
+		&deliveredAt,
+		&readAt,
+		&editedAt,
+		&deletedAt,
+	)
+	if err != nil {
+		return Message{}, err
+	}
 
-	return messages, nil
+	msg.DeliveredAt = nullTime(deliveredAt)
+	msg.ReadAt = nullTime(readAt)
+	msg.EditedAt = nullTime(editedAt)
+	msg.DeletedAt = nullTime(deletedAt)
+	msg.IsDeleted = deletedAt.Valid
+	return msg, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
 }
 
+// GetConversations returns the direct conversations that have messages
+// and the groups userID belongs to, most recently active first. Message
+// requests sent to userID are left out, see GetMessageRequests.
 func GetConversations(userID int) ([]Conversation, error) {
+	return queryConversations(userID, "(c.request_status = 'accepted' OR c.created_by = me.user_id)")
+}
+
+// GetMessageRequests returns the pending first-contact conversations
+// other users started with userID.
+func GetMessageRequests(userID int) ([]Conversation, error) {
+	return queryConversations(userID, "c.request_status = 'pending' AND c.created_by != me.user_id")
+}
+
+func queryConversations(userID int, filter string) ([]Conversation, error) {
 	rows, err := Db.Query(`
-	WITH LastMessages AS (
-		SELECT 
-			CASE 
-				WHEN sender_id = ? THEN receiver_id
-				ELSE sender_id
-			END as other_user_id,
-			content as last_message,
-			sent_at as last_message_time,
-			ROW_NUMBER() OVER (
-				PARTITION BY 
-					CASE 
-						WHEN sender_id = ? THEN receiver_id
-						ELSE sender_id
-					END 
-				ORDER BY sent_at DESC
-			) as rn
-		FROM private_messages
-		WHERE sender_id = ? OR receiver_id = ?
-	)
 	SELECT 
-		u.id,
-		u.uname,
-		lm.last_message,
-		lm.last_message_time,
-		COALESCE(us.is_online, false) as is_online,
+		c.id,
+		c.type,
+		COALESCE(other.id, 0),
+		COALESCE(other.uname, ''),
+		c.name,
+		c.avatar,
+		(SELECT COUNT(*) FROM conversation_members WHERE conversation_id = c.id) as member_count,
+		COALESCE(lm.content, ''),
+		lm.sent_at,
+		c.created_at,
+		-- Users who blocked me or haven't accepted my request look offline
+		COALESCE(us.is_online, false) AND NOT EXISTS (
+			SELECT 1 FROM blocks WHERE blocker_id = other.id AND blocked_id = me.user_id
+		) AND c.request_status = 'accepted' as is_online,
+		c.request_status,
 		(
 			SELECT COUNT(*)
 			FROM private_messages pm
-			WHERE pm.sender_id = u.id 
-			AND pm.receiver_id = ?
-			AND pm.is_read = false
+			WHERE pm.conversation_id = c.id
+			AND pm.sender_id != me.user_id
+			AND pm.id > COALESCE(cr.last_read_message_id, 0)
+			AND pm.deleted_at IS NULL
 		) as unread_count
-	FROM LastMessages lm
-	JOIN users u ON u.id = lm.other_user_id
-	LEFT JOIN user_sessions us ON us.user_id = u.id
-	WHERE lm.rn = 1
-	ORDER BY lm.last_message_time DESC, u.uname`,
-		userID, userID, userID, userID, userID)
+	FROM conversation_members me
+	JOIN conversations c ON c.id = me.conversation_id
+	LEFT JOIN conversation_members om
+		ON c.type = 'direct' AND om.conversation_id = c.id AND om.user_id != me.user_id
+	LEFT JOIN users other ON other.id = om.user_id
+	LEFT JOIN user_sessions us ON us.user_id = other.id
+	LEFT JOIN conversation_reads cr ON cr.conversation_id = c.id AND cr.user_id = me.user_id
+	LEFT JOIN private_messages lm ON lm.id = (
+		SELECT MAX(id) FROM private_messages WHERE conversation_id = c.id
+	)
+	WHERE me.user_id = ? AND (c.type = 'group' OR lm.id IS NOT NULL)
+	AND `+filter+`
+	ORDER BY COALESCE(lm.sent_at, c.created_at) DESC, c.id DESC`,
+		userID)
 	if err != nil {
 		return nil, err
 	}
@@ -155,59 +285,43 @@ func GetConversations(userID int) ([]Conversation, error) {
 	var conversations []Conversation
 	for rows.Next() {
 		var conv Conversation
+		var sentAt sql.NullTime
+		var createdAt time.Time
 		err := rows.Scan(
+			&conv.ConversationID,
+			&conv.Type,
 			&conv.UserID,
 			&conv.Username,
+			&conv.Name,
+			&conv.Avatar,
+			&conv.MemberCount,
 			&conv.LastMessage,
-			&conv.LastMessageTime,
+			&sentAt,
+			&createdAt,
 			&conv.IsOnline,
+			&conv.RequestStatus,
 			&conv.UnreadCount,
 		)
 		if err != nil {
 			return nil, err
 		}
-		conversations = append(conversations, conv)
-	}
-
-	return conversations, nil
-}
-
-func GetNewUsers(userID int) ([]Conversation, error) {
-	rows, err := Db.Query(`
-	SELECT 
-		u.id,
-		u.uname,
-		COALESCE(us.is_online, false) as is_online
-	FROM users u
-	LEFT JOIN user_sessions us ON us.user_id = u.id
-	WHERE u.id != ? 
-	AND u.id NOT IN (
-		SELECT DISTINCT 
-			CASE 
-				WHEN sender_id = ? THEN receiver_id
-				ELSE sender_id
-			END
-		FROM private_messages
-		WHERE sender_id = ? OR receiver_id = ?
-	)
-	ORDER BY u.uname`,
-		userID, userID, userID, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var users []Conversation
-	for rows.Next() {
-		var user Conversation
-		err := rows.Scan(&user.UserID, &user.Username, &user.IsOnline)
-		if err != nil {
-			return nil, err
+		// Groups without messages yet sort by their creation
+		conv.LastMessageTime = createdAt
+		if sentAt.Valid {
+			conv.LastMessageTime = sentAt.Time
+		}
+		if conv.RequestStatus == RequestAccepted {
+			conv.RequestStatus = ""
 		}
-		users = append(users, user)
+		if conv.Type == ConversationGroup {
+			conv.Username = conv.Name
+		} else {
+			conv.MemberCount = 0
+		}
+		conversations = append(conversations, conv)
 	}
 
-	return users, nil
+	return conversations, rows.Err()
 }
 
 func UpdateUserOnlineStatus(userID int, isOnline bool) error {
@@ -242,18 +356,215 @@ func UpdateUserOnlineStatus(userID int, isOnline bool) error {
 func GetUnreadMessagesCount(userID int) (int, error) {
 	var count int
 	err := Db.QueryRow(`SELECT COUNT(*) 
-		FROM private_messages 
-		WHERE receiver_id = ? AND is_read = false`, userID).Scan(&count)
+		FROM conversation_members me
+		JOIN private_messages pm ON pm.conversation_id = me.conversation_id
+		LEFT JOIN conversation_reads cr
+			ON cr.conversation_id = me.conversation_id AND cr.user_id = me.user_id
+		JOIN conversations c ON c.id = me.conversation_id
+		WHERE me.user_id = ? AND pm.sender_id != me.user_id
+		AND pm.id > COALESCE(cr.last_read_message_id, 0)
+		AND pm.deleted_at IS NULL
+		-- Message requests aren't counted until accepted
+		AND (c.request_status = 'accepted' OR c.created_by = me.user_id)`, userID).Scan(&count)
 
 	return count, err
 }
 
-func MarkMessagesAsRead(receiverID, senderID int) error {
-	_, err := Db.Exec(`
-		UPDATE private_messages 
-		SET is_read = true 
-		WHERE receiver_id = ? AND sender_id = ? AND is_read = false`,
-		receiverID, senderID,
-	)
-	return err
+// MarkMessagesAsRead moves receiverID's read watermark in the direct
+// conversation with senderID, see MarkConversationRead.
+func MarkMessagesAsRead(receiverID, senderID, upToID int) ([]MessageReceipt, error) {
+	conversationID, err := GetDirectConversationID(receiverID, senderID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return MarkConversationRead(receiverID, conversationID, upToID)
+}
+
+// MarkConversationRead moves userID's read watermark in a conversation up
+// to the message upToID, or to the latest message when upToID is 0. It
+// returns the direct messages that became read.
+func MarkConversationRead(userID, conversationID, upToID int) ([]MessageReceipt, error) {
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var lastID int
+	err = tx.QueryRow(`
+    SELECT COALESCE(MAX(id), 0) FROM private_messages
+    WHERE conversation_id = ? AND sender_id != ? AND (? = 0 OR id <= ?)`,
+		conversationID, userID, upToID, upToID).Scan(&lastID)
+	if err != nil {
+		return nil, err
+	}
+	if lastID == 0 {
+		return nil, nil
+	}
+
+	_, err = tx.Exec(`
+    INSERT INTO conversation_reads (conversation_id, user_id, last_read_message_id)
+    VALUES (?, ?, ?)
+    ON CONFLICT (conversation_id, user_id) DO UPDATE SET
+        last_read_message_id = MAX(last_read_message_id, excluded.last_read_message_id),
+        updated_at = CURRENT_TIMESTAMP`,
+		conversationID, userID, lastID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+    UPDATE private_messages
+    SET is_read = true,
+        read_at = CURRENT_TIMESTAMP,
+        delivered_at = COALESCE(delivered_at, CURRENT_TIMESTAMP)
+    WHERE conversation_id = ? AND receiver_id = ? AND id <= ? AND read_at IS NULL
+    RETURNING id, sender_id`,
+		conversationID, userID, lastID)
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := scanReceipts(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return receipts, tx.Commit()
+}
+
+// MarkMessageDelivered sets the delivery time of a message, if it isn't
+// set yet, and reports whether it changed.
+func MarkMessageDelivered(messageID int) (bool, error) {
+	result, err := Db.Exec(`
+    UPDATE private_messages
+    SET delivered_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND delivered_at IS NULL`,
+		messageID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// MarkPendingMessagesDelivered marks every message waiting for
+// receiverID as delivered and returns them. Messages of requests stay
+// undelivered until the request is accepted.
+func MarkPendingMessagesDelivered(receiverID int) ([]MessageReceipt, error) {
+	return updateReceipts(`
+    UPDATE private_messages
+    SET delivered_at = CURRENT_TIMESTAMP
+    WHERE receiver_id = ? AND delivered_at IS NULL
+    AND conversation_id IN (SELECT id FROM conversations WHERE request_status = 'accepted')
+    RETURNING id, sender_id`,
+		receiverID)
+}
+
+func updateReceipts(query string, args ...interface{}) ([]MessageReceipt, error) {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanReceipts(rows)
+}
+
+func scanReceipts(rows *sql.Rows) ([]MessageReceipt, error) {
+	defer rows.Close()
+
+	var receipts []MessageReceipt
+	for rows.Next() {
+		var receipt MessageReceipt
+		if err := rows.Scan(&receipt.MessageID, &receipt.SenderID); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+// EditMessage replaces the content of a message, keeping the previous one
+// in its edit history.
+func EditMessage(messageID int, content string) error {
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+    INSERT INTO message_edits (message_id, content, edited_at)
+    SELECT id, content, COALESCE(edited_at, sent_at) FROM private_messages
+    WHERE id = ? AND deleted_at IS NULL`,
+		messageID)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+    UPDATE private_messages
+    SET content = ?, edited_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND deleted_at IS NULL`,
+		content, messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// DeleteMessage turns a message into a tombstone. Its content and edit
+// history are dropped.
+func DeleteMessage(messageID int) error {
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+    UPDATE private_messages
+    SET content = '', deleted_at = CURRENT_TIMESTAMP
+    WHERE id = ? AND deleted_at IS NULL`,
+		messageID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec("DELETE FROM message_edits WHERE message_id = ?", messageID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetMessageEdits returns the previous contents of a message, oldest first.
+func GetMessageEdits(messageID int) ([]MessageEdit, error) {
+	rows, err := Db.Query(`
+    SELECT content, edited_at FROM message_edits
+    WHERE message_id = ?
+    ORDER BY id`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		if err := rows.Scan(&edit.Content, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
 }
@@ -0,0 +1,308 @@
+package forum
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationFiles holds the schema changes as NNNN_name.up.sql and
+// NNNN_name.down.sql pairs, applied in the order of their version. A
+// schema change is a new pair, the applied ones are never edited.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+const migrationsTable = `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    )`
+
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationState is a migration and when it was applied, AppliedAt is nil
+// while it's pending.
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// loadMigrations parses the embedded migrations, sorted by version.
+func loadMigrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down file", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// MigrateUp applies the pending migrations and returns them.
+func MigrateUp() ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return withMigrationConn(func(ctx context.Context, conn *sql.Conn) ([]Migration, error) {
+		applied, err := appliedMigrations(ctx, conn, migrations)
+		if err != nil {
+			return nil, err
+		}
+		legacy, err := isLegacyDatabase(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		var done []Migration
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := applyMigration(ctx, conn, m, legacy && m.Version == 1); err != nil {
+				return done, fmt.Errorf("failed to apply migration %s: %v", m, err)
+			}
+			done = append(done, m)
+		}
+		return done, nil
+	})
+}
+
+// MigrateDown reverts the last steps applied migrations and returns them.
+func MigrateDown(steps int) ([]Migration, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	return withMigrationConn(func(ctx context.Context, conn *sql.Conn) ([]Migration, error) {
+		applied, err := appliedMigrations(ctx, conn, migrations)
+		if err != nil {
+			return nil, err
+		}
+
+		var done []Migration
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := revertMigration(ctx, conn, m); err != nil {
+				return done, fmt.Errorf("failed to revert migration %s: %v", m, err)
+			}
+			done = append(done, m)
+		}
+		return done, nil
+	})
+}
+
+// MigrationStatus returns every migration with when it was applied.
+func MigrationStatus() ([]MigrationState, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := appliedMigrations(ctx, conn, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i].Migration = m
+		if appliedAt, ok := applied[m.Version]; ok {
+			states[i].AppliedAt = &appliedAt
+		}
+	}
+	return states, nil
+}
+
+// withMigrationConn runs fn on a connection of its own with foreign keys
+// off, so migrations can rebuild tables without their drops cascading.
+// The pragma can't change inside a transaction, hence the connection.
+func withMigrationConn(fn func(context.Context, *sql.Conn) ([]Migration, error)) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := Db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	return fn(ctx, conn)
+}
+
+// appliedMigrations returns when each applied migration was applied. It
+// fails when the database was migrated by a newer build, whose migrations
+// this one doesn't know.
+func appliedMigrations(ctx context.Context, conn *sql.Conn, known []Migration) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	exists, err := hasTable(ctx, conn, "schema_migrations")
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for version := range applied {
+		i := sort.Search(len(known), func(i int) bool { return known[i].Version >= version })
+		if i == len(known) || known[i].Version != version {
+			return nil, fmt.Errorf("database has unknown migration %d applied, it was migrated by a newer version", version)
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration runs m and records it in one transaction. Databases
+// created before migrations get their old upgrades around the first one,
+// see legacy.go.
+func applyMigration(ctx context.Context, conn *sql.Conn, m Migration, legacy bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migrationsTable); err != nil {
+		return err
+	}
+
+	if legacy {
+		if err := upgradeLegacyTables(ctx, tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, m.up); err != nil {
+		return err
+	}
+	if legacy {
+		if err := backfillLegacyData(ctx, tx); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.Version, m.Name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func revertMigration(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.down); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", m.Version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queryer is what the schema inspection needs from a connection or a
+// transaction.
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func hasTable(ctx context.Context, q queryer, table string) (bool, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+func hasColumn(ctx context.Context, q queryer, table, column string) (bool, error) {
+	var count int
+	err := q.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
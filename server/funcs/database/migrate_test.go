@@ -0,0 +1,402 @@
+package forum
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	config "forum/funcs/config"
+)
+
+// openEmptyDB opens a database in a temporary directory without migrating
+// it.
+func openEmptyDB(t *testing.T) {
+	t.Helper()
+
+	c := config.Default()
+	c.DBPath = filepath.Join(t.TempDir(), "test.db")
+	if err := Open(c); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { Db.Close() })
+}
+
+// legacySchema is the schema of a database created before migrations,
+// once read watermarks existed: private_messages without conversation_id
+// and the per-peer message_read_state.
+const legacySchema = `
+CREATE TABLE users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    email TEXT NOT NULL UNIQUE,
+    uname TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL,
+    first_name TEXT NOT NULL,
+    last_name TEXT NOT NULL,
+    age INTEGER NOT NULL,
+    gender TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE tokens (
+    user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    token TEXT UNIQUE,
+    created_at DATETIME,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE posts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    title TEXT NOT NULL,
+    content TEXT,
+    user_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    img TEXT,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE post_categories (
+    post_id INTEGER NOT NULL,
+    category VARCHAR(255) NOT NULL,
+    PRIMARY KEY (post_id,category),
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+CREATE TABLE user_sessions (
+    user_id INTEGER PRIMARY KEY,
+    is_online BOOLEAN DEFAULT false,
+    last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE private_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    sender_id INTEGER NOT NULL,
+    receiver_id INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    is_read BOOLEAN DEFAULT false,
+    FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE TABLE message_read_state (
+    user_id INTEGER NOT NULL,
+    peer_id INTEGER NOT NULL,
+    last_read_message_id INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, peer_id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (peer_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+INSERT INTO users (id, email, uname, password, first_name, last_name, age, gender) VALUES
+    (1, 'a@x', 'alice', 'p', 'A', 'A', 20, 'f'),
+    (2, 'b@x', 'bob', 'p', 'B', 'B', 20, 'm'),
+    (3, 'c@x', 'carol', 'p', 'C', 'C', 20, 'f');
+INSERT INTO tokens (user_id, token, created_at) VALUES
+    (1, 'token-1', '2024-01-01 10:00:00'),
+    (2, NULL, NULL);
+INSERT INTO posts (id, title, content, user_id, img) VALUES (1, 'hi', '', 1, '');
+INSERT INTO post_categories (post_id, category) VALUES (1, 'News'), (1, 'nowhere');
+
+-- alice and bob talk, alice wrote to carol who read it
+INSERT INTO private_messages (id, sender_id, receiver_id, content, sent_at, is_read) VALUES
+    (1, 1, 2, 'hi bob', '2024-01-01 10:00:00', true),
+    (2, 2, 1, 'hi alice', '2024-01-01 10:01:00', true),
+    (3, 1, 2, 'how are you', '2024-01-01 10:02:00', false),
+    (4, 1, 3, 'hi carol', '2024-01-02 09:00:00', true);
+`
+
+// legacyReadState is the message_read_state of the fixture: bob read up
+// to message 3, which is_read doesn't show, alice up to message 2.
+const legacyReadState = `
+INSERT INTO message_read_state (user_id, peer_id, last_read_message_id) VALUES
+    (2, 1, 3),
+    (1, 2, 2);
+`
+
+// schemaOf returns the definitions of the tables and indexes, sorted by
+// name.
+func schemaOf(t *testing.T) string {
+	t.Helper()
+
+	rows, err := Db.Query("SELECT name, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var schema strings.Builder
+	for rows.Next() {
+		var name, sql string
+		if err := rows.Scan(&name, &sql); err != nil {
+			t.Fatal(err)
+		}
+		schema.WriteString(name + ": " + sql + "\n")
+	}
+	return schema.String()
+}
+
+// appliedVersions returns the versions recorded in schema_migrations.
+func appliedVersions(t *testing.T) []int {
+	t.Helper()
+
+	rows, err := Db.Query("SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+func allVersions(t *testing.T) []int {
+	t.Helper()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := make([]int, len(migrations))
+	for i, m := range migrations {
+		versions[i] = m.Version
+	}
+	return versions
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	openEmptyDB(t)
+	want := allVersions(t)
+
+	applied, err := MigrateUp()
+	if err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if len(applied) != len(want) {
+		t.Errorf("applied %d migrations, want %d", len(applied), len(want))
+	}
+	if got := appliedVersions(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("schema_migrations has %v, want %v", got, want)
+	}
+
+	var categories int
+	if err := Db.QueryRow("SELECT COUNT(*) FROM categories").Scan(&categories); err != nil || categories != 6 {
+		t.Errorf("got %d default categories, want 6 (%v)", categories, err)
+	}
+
+	// Migrating again is a no-op
+	applied, err = MigrateUp()
+	if err != nil || len(applied) != 0 {
+		t.Errorf("second MigrateUp applied %v, %v", applied, err)
+	}
+}
+
+func TestMigrateRoundTrip(t *testing.T) {
+	openEmptyDB(t)
+	if _, err := MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	migrated := schemaOf(t)
+	versions := allVersions(t)
+
+	// One step back and forth
+	reverted, err := MigrateDown(1)
+	if err != nil || len(reverted) != 1 || reverted[0].Version != versions[len(versions)-1] {
+		t.Fatalf("MigrateDown(1) reverted %v, %v", reverted, err)
+	}
+	if got := appliedVersions(t); !reflect.DeepEqual(got, versions[:len(versions)-1]) {
+		t.Errorf("schema_migrations has %v after reverting the last migration", got)
+	}
+	if _, err := MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if got := schemaOf(t); got != migrated {
+		t.Errorf("the schema changed after reverting and reapplying the last migration:\n got %s\nwant %s", got, migrated)
+	}
+
+	// All the way down and up again
+	reverted, err = MigrateDown(len(versions))
+	if err != nil || len(reverted) != len(versions) {
+		t.Fatalf("MigrateDown reverted %d migrations, %v", len(reverted), err)
+	}
+	var left int
+	if err := Db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' AND name != 'schema_migrations'").Scan(&left); err != nil || left != 0 {
+		t.Errorf("reverting every migration left more than schema_migrations:\n%s", schemaOf(t))
+	}
+	if _, err := MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	if got := schemaOf(t); got != migrated {
+		t.Errorf("the schema changed after a round trip:\n got %s\nwant %s", got, migrated)
+	}
+	if got := appliedVersions(t); !reflect.DeepEqual(got, versions) {
+		t.Errorf("schema_migrations has %v after a round trip, want %v", got, versions)
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	openTestDB(t)
+	if _, err := Db.Exec("INSERT INTO schema_migrations (version, name) VALUES (9999, 'from_the_future')"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateUp(); err == nil || !strings.Contains(err.Error(), "newer version") {
+		t.Errorf("MigrateUp on a newer database: %v", err)
+	}
+	if _, err := MigrateDown(1); err == nil {
+		t.Error("MigrateDown on a newer database succeeded")
+	}
+}
+
+type conversationRead struct {
+	directKey  string
+	userID     int
+	lastReadID int
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	tests := []struct {
+		name      string
+		readState string
+		wantReads []conversationRead
+	}{
+		{
+			name:      "with message_read_state",
+			readState: legacyReadState,
+			// The watermarks move to the conversations as they were
+			wantReads: []conversationRead{{"1:2", 1, 2}, {"1:2", 2, 3}},
+		},
+		{
+			name: "before read watermarks",
+			// They are seeded from is_read
+			wantReads: []conversationRead{{"1:2", 1, 2}, {"1:2", 2, 1}, {"1:3", 3, 4}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openEmptyDB(t)
+			if _, err := Db.Exec(legacySchema + tt.readState); err != nil {
+				t.Fatalf("creating the legacy database: %v", err)
+			}
+
+			if _, err := MigrateUp(); err != nil {
+				t.Fatalf("MigrateUp: %v", err)
+			}
+			if got, want := appliedVersions(t), allVersions(t); !reflect.DeepEqual(got, want) {
+				t.Errorf("schema_migrations has %v, want %v", got, want)
+			}
+
+			checkLegacyConversations(t)
+			checkLegacyReads(t, tt.wantReads)
+			checkLegacyUpgrades(t)
+
+			// The data survives reverting and reapplying the last migration
+			if _, err := MigrateDown(1); err != nil {
+				t.Fatalf("MigrateDown: %v", err)
+			}
+			if _, err := MigrateUp(); err != nil {
+				t.Fatalf("MigrateUp: %v", err)
+			}
+			checkLegacyConversations(t)
+			checkLegacyReads(t, tt.wantReads)
+		})
+	}
+}
+
+// checkLegacyConversations checks that each pair of users who exchanged
+// messages got a direct conversation holding their messages.
+func checkLegacyConversations(t *testing.T) {
+	t.Helper()
+
+	rows, err := Db.Query(`
+        SELECT c.direct_key, c.type, c.created_by,
+            (SELECT GROUP_CONCAT(user_id) FROM (SELECT user_id FROM conversation_members WHERE conversation_id = c.id ORDER BY user_id)),
+            (SELECT GROUP_CONCAT(id) FROM (SELECT id FROM private_messages WHERE conversation_id = c.id ORDER BY id))
+        FROM conversations c ORDER BY c.direct_key`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	type conversation struct {
+		directKey, kind string
+		createdBy       int
+		members         string
+		messages        string
+	}
+	var got []conversation
+	for rows.Next() {
+		var c conversation
+		if err := rows.Scan(&c.directKey, &c.kind, &c.createdBy, &c.members, &c.messages); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, c)
+	}
+	want := []conversation{
+		{"1:2", "direct", 1, "1,2", "1,2,3"},
+		{"1:3", "direct", 1, "1,3", "4"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("conversations:\n got %+v\nwant %+v", got, want)
+	}
+
+	var orphans int
+	if err := Db.QueryRow("SELECT COUNT(*) FROM private_messages WHERE conversation_id IS NULL").Scan(&orphans); err != nil || orphans != 0 {
+		t.Errorf("%d messages have no conversation (%v)", orphans, err)
+	}
+}
+
+func checkLegacyReads(t *testing.T, want []conversationRead) {
+	t.Helper()
+
+	rows, err := Db.Query(`
+        SELECT c.direct_key, r.user_id, r.last_read_message_id
+        FROM conversation_reads r JOIN conversations c ON c.id = r.conversation_id
+        ORDER BY c.direct_key, r.user_id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []conversationRead
+	for rows.Next() {
+		var r conversationRead
+		if err := rows.Scan(&r.directKey, &r.userID, &r.lastReadID); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("conversation_reads:\n got %+v\nwant %+v", got, want)
+	}
+
+	if exists, err := hasTable(context.Background(), Db, "message_read_state"); err != nil || exists {
+		t.Errorf("message_read_state is still there (%v)", err)
+	}
+}
+
+// checkLegacyUpgrades checks the columns and rows the later migrations
+// change.
+func checkLegacyUpgrades(t *testing.T) {
+	t.Helper()
+
+	var privacy string
+	if err := Db.QueryRow("SELECT dm_privacy FROM users WHERE id = 1").Scan(&privacy); err != nil || privacy != "everyone" {
+		t.Errorf("dm_privacy is %q (%v), want everyone", privacy, err)
+	}
+
+	var categories string
+	if err := Db.QueryRow("SELECT GROUP_CONCAT(category) FROM post_categories WHERE post_id = 1").Scan(&categories); err != nil || categories != "news" {
+		t.Errorf("post 1 is filed under %q (%v), want only news", categories, err)
+	}
+
+	var expires string
+	if err := Db.QueryRow("SELECT expires_at FROM tokens WHERE user_id = 1").Scan(&expires); err != nil || !strings.HasPrefix(expires, "2024-01-01T11:00:00") {
+		t.Errorf("the open session expires at %q (%v), want an hour after its creation", expires, err)
+	}
+}
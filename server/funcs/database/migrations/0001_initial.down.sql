@@ -0,0 +1,24 @@
+-- Drops the whole schema, and with it every row.
+DROP TABLE IF EXISTS notification_actors;
+DROP TABLE IF EXISTS notifications;
+DROP TABLE IF EXISTS channel_messages;
+DROP TABLE IF EXISTS category_subscriptions;
+DROP TABLE IF EXISTS blocks;
+DROP TABLE IF EXISTS follows;
+DROP TABLE IF EXISTS post_tags;
+DROP TABLE IF EXISTS tags;
+DROP TABLE IF EXISTS admins;
+DROP TABLE IF EXISTS conversation_reads;
+DROP TABLE IF EXISTS message_edits;
+DROP TABLE IF EXISTS private_messages;
+DROP TABLE IF EXISTS conversation_members;
+DROP TABLE IF EXISTS conversations;
+DROP TABLE IF EXISTS user_sessions;
+DROP TABLE IF EXISTS comment_interactions;
+DROP TABLE IF EXISTS post_interactions;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS post_categories;
+DROP TABLE IF EXISTS categories;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,4 @@
+-- Removes the default categories no post uses.
+DELETE FROM categories
+WHERE slug IN ('general', 'news', 'entertainment', 'hobbies', 'lifestyle', 'technology')
+    AND slug NOT IN (SELECT category FROM post_categories);
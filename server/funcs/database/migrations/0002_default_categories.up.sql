@@ -0,0 +1,18 @@
+-- Seeds the default categories on a fresh database and rewrites the
+-- post_categories rows created before categories had slugs.
+WITH defaults (slug, name, position) AS (
+    VALUES
+        ('general', 'General', 1),
+        ('news', 'News', 2),
+        ('entertainment', 'Entertainment', 3),
+        ('hobbies', 'Hobbies', 4),
+        ('lifestyle', 'Lifestyle', 5),
+        ('technology', 'Technology', 6)
+)
+INSERT INTO categories (slug, name, position)
+SELECT slug, name, position FROM defaults
+WHERE NOT EXISTS (SELECT 1 FROM categories);
+
+UPDATE post_categories
+SET category = LOWER(category)
+WHERE category != LOWER(category);
@@ -0,0 +1,13 @@
+-- Drops the foreign key of post_categories.category.
+CREATE TABLE post_categories_old (
+    post_id INTEGER NOT NULL,
+    category VARCHAR(255) NOT NULL,
+    PRIMARY KEY (post_id,category),
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE
+);
+
+INSERT INTO post_categories_old (post_id, category)
+SELECT post_id, category FROM post_categories;
+
+DROP TABLE post_categories;
+ALTER TABLE post_categories_old RENAME TO post_categories;
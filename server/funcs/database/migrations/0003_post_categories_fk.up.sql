@@ -0,0 +1,17 @@
+-- Gives post_categories.category a foreign key to categories(slug), so a
+-- post can't be filed under a category that doesn't exist. The rows
+-- already pointing nowhere are dropped, they showed no category anyway.
+CREATE TABLE post_categories_new (
+    post_id INTEGER NOT NULL,
+    category VARCHAR(255) NOT NULL,
+    PRIMARY KEY (post_id,category),
+    FOREIGN KEY (post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY (category) REFERENCES categories(slug)
+);
+
+INSERT INTO post_categories_new (post_id, category)
+SELECT post_id, category FROM post_categories
+WHERE category IN (SELECT slug FROM categories);
+
+DROP TABLE post_categories;
+ALTER TABLE post_categories_new RENAME TO post_categories;
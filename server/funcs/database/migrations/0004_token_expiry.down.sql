@@ -0,0 +1,2 @@
+-- Drops the session expiry, the TTL applies to created_at again.
+ALTER TABLE tokens DROP COLUMN expires_at;
@@ -0,0 +1,7 @@
+-- Stores when each session expires, set at login from session-ttl, so
+-- checking a token doesn't need the config. The sessions already open
+-- keep the default hour.
+ALTER TABLE tokens ADD COLUMN expires_at DATETIME;
+
+UPDATE tokens SET expires_at = datetime(created_at, '+1 hour')
+WHERE created_at IS NOT NULL;
@@ -0,0 +1,209 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+type Notification struct {
+	ID         int             `json:"id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload"`
+	ActorCount int             `json:"actor_count"`
+	Actors     []string        `json:"actors"`
+	IsRead     bool            `json:"is_read"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+// AddNotification stores a notification for userID. When groupKey is set
+// and the user has an unread notification with the same key, that one is
+// updated instead, so "5 people liked your post" stays a single entry.
+// actorID is the user who caused it, or 0 for system notifications.
+func AddNotification(userID, actorID int, kind, groupKey string, payload interface{}) (*Notification, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	if groupKey != "" {
+		err = tx.QueryRow(`
+        SELECT id FROM notifications
+        WHERE user_id = ? AND group_key = ? AND is_read = false
+        ORDER BY id DESC LIMIT 1`,
+			userID, groupKey).Scan(&id)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	if id > 0 {
+		_, err = tx.Exec(`
+        UPDATE notifications
+        SET payload = ?, updated_at = CURRENT_TIMESTAMP
+        WHERE id = ?`,
+			string(payloadBytes), id)
+	} else {
+		var result sql.Result
+		result, err = tx.Exec(`
+        INSERT INTO notifications (user_id, type, group_key, payload)
+        VALUES (?, ?, ?, ?)`,
+			userID, kind, groupKey, string(payloadBytes))
+		if err == nil {
+			id, err = result.LastInsertId()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if actorID > 0 {
+		_, err = tx.Exec(`
+        INSERT OR IGNORE INTO notification_actors (notification_id, actor_id)
+        VALUES (?, ?)`,
+			id, actorID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return getNotification(int(id))
+}
+
+func getNotification(id int) (*Notification, error) {
+	n := &Notification{}
+	var payload string
+	err := Db.QueryRow(`
+    SELECT id, type, payload, is_read, created_at, updated_at
+    FROM notifications WHERE id = ?`, id).Scan(
+		&n.ID, &n.Type, &payload, &n.IsRead, &n.CreatedAt, &n.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	n.Payload = json.RawMessage(payload)
+
+	if err := loadNotificationActors(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// loadNotificationActors fills in how many users caused the notification
+// and the names of the latest three.
+func loadNotificationActors(n *Notification) error {
+	err := Db.QueryRow("SELECT COUNT(*) FROM notification_actors WHERE notification_id = ?", n.ID).Scan(&n.ActorCount)
+	if err != nil {
+		return err
+	}
+
+	rows, err := Db.Query(`
+    SELECT u.uname
+    FROM notification_actors na
+    JOIN users u ON u.id = na.actor_id
+    WHERE na.notification_id = ?
+    ORDER BY na.rowid DESC
+    LIMIT 3`, n.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n.Actors = []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		n.Actors = append(n.Actors, name)
+	}
+	return rows.Err()
+}
+
+func GetNotifications(userID int, unreadOnly bool, limit, offset int) ([]Notification, error) {
+	query := `
+    SELECT id, type, payload, is_read, created_at, updated_at
+    FROM notifications
+    WHERE user_id = ?`
+	if unreadOnly {
+		query += " AND is_read = false"
+	}
+	query += " ORDER BY updated_at DESC, id DESC LIMIT ? OFFSET ?"
+
+	rows, err := Db.Query(query, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var payload string
+		if err := rows.Scan(&n.ID, &n.Type, &payload, &n.IsRead, &n.CreatedAt, &n.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		n.Payload = json.RawMessage(payload)
+		notifications = append(notifications, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range notifications {
+		if err := loadNotificationActors(&notifications[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return notifications, nil
+}
+
+func GetUnreadNotificationsCount(userID int) (int, error) {
+	var count int
+	err := Db.QueryRow(`SELECT COUNT(*)
+		FROM notifications
+		WHERE user_id = ? AND is_read = false`, userID).Scan(&count)
+
+	return count, err
+}
+
+// MarkNotificationsAsRead marks the given notifications of userID as read;
+// ids belonging to other users are ignored.
+func MarkNotificationsAsRead(userID int, ids []int) error {
+	for _, id := range ids {
+		_, err := Db.Exec(`
+		UPDATE notifications
+		SET is_read = true
+		WHERE id = ? AND user_id = ?`,
+			id, userID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func MarkAllNotificationsAsRead(userID int) error {
+	_, err := Db.Exec(`
+		UPDATE notifications
+		SET is_read = true
+		WHERE user_id = ? AND is_read = false`,
+		userID,
+	)
+	return err
+}
@@ -7,11 +7,14 @@ import (
 	Data "forum/funcs/types"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
-func GetPosts(userID int, query string, args ...interface{}) ([]Data.POST, error) {
+// GetPosts runs a query from BuildPostQuery, reading the post images
+// from imagesDir.
+func GetPosts(userID int, imagesDir string, query string, args ...interface{}) ([]Data.POST, error) {
 	rows, err := Db.Query(query, args...)
 	if err != nil {
 		return nil, err
@@ -43,46 +46,174 @@ func GetPosts(userID int, query string, args ...interface{}) ([]Data.POST, error
 
 		categories := getPostCategories(p.ID)
 		p.Category = categories
-		p.ImgBase64, _ = EncodeImg("./images/" + p.ImgBase64)
+		p.Tags = getPostTags(p.ID)
+		p.ImgBase64, _ = EncodeImg(filepath.Join(imagesDir, p.ImgBase64))
 		posts = append(posts, p)
 
 	}
 	return posts, nil
 }
 
+const (
+	netLikesSQL = `(SELECT COALESCE(SUM(interaction), 0) FROM post_interactions WHERE post_interactions.post_id = posts.id)`
+	commentsSQL = `(SELECT COUNT(*) FROM comments WHERE comments.post_id = posts.id)`
+	// ageHoursSQL takes the moment the age is computed at, see QueryOptions.AsOf.
+	ageHoursSQL = `((julianday(?) - julianday(posts.created_at)) * 24)`
+)
+
+var (
+	// feedOrders maps the sort modes to their ORDER BY clause.
+	feedOrders = map[string]string{
+		"new":      "posts.id DESC",
+		"old":      "posts.id ASC",
+		"top":      netLikesSQL + " DESC, posts.id DESC",
+		"comments": commentsSQL + " DESC, posts.id DESC",
+		// hot: net likes plus comments, decaying with the square of the age.
+		"hot": "(" + netLikesSQL + " + " + commentsSQL + " + 1.0) / ((" + ageHoursSQL + " + 2) * (" + ageHoursSQL + " + 2)) DESC, posts.id DESC",
+	}
+
+	// feedWindows maps the time windows to a datetime() modifier.
+	feedWindows = map[string]string{
+		"day":   "-1 day",
+		"week":  "-7 days",
+		"month": "-1 month",
+		"all":   "",
+	}
+)
+
+func IsFeedSort(sort string) bool {
+	_, ok := feedOrders[sort]
+	return ok
+}
+
+func IsFeedWindow(window string) bool {
+	_, ok := feedWindows[window]
+	return ok
+}
+
+// BuildPostQuery turns the options into a parameterised feed query. Every
+// set option narrows the feed (AND); several categories match any of them (OR).
 func BuildPostQuery(opts Data.QueryOptions) (string, []interface{}) {
 	baseQuery := `
         SELECT posts.id, posts.user_id, posts.title, posts.created_at, posts.content,posts.img, users.uname 
         FROM posts
         JOIN users ON posts.user_id = users.id`
 
+	var conditions []string
 	var args []interface{}
 
+	// The single-valued Filter is kept for the older endpoints.
 	switch opts.Filter {
 	case "":
-		if opts.PostID != "" {
-			baseQuery += " WHERE posts.id = ?"
-			args = append(args, opts.PostID)
-		}
-
 	case "created":
-		baseQuery += " WHERE posts.user_id = ?"
+		opts.CreatedByMe = true
+	case "liked":
+		opts.LikedByMe = true
+	case "following":
+		opts.Following = true
+	case "tag":
+		// opts.Tag is already set
+	default:
+		opts.Categories = append(opts.Categories, opts.Filter)
+	}
+
+	if opts.PostID != "" {
+		conditions = append(conditions, "posts.id = ?")
+		args = append(args, opts.PostID)
+	}
+
+	if opts.CreatedByMe {
+		conditions = append(conditions, "posts.user_id = ?")
 		args = append(args, opts.UserID)
+	}
 
-	case "liked":
-		baseQuery += `
-            JOIN post_interactions ON post_interactions.post_id = posts.id
-            WHERE post_interactions.user_id = ? AND post_interactions.interaction = 1`
+	if opts.LikedByMe {
+		conditions = append(conditions, `EXISTS (
+            SELECT 1 FROM post_interactions
+            WHERE post_interactions.post_id = posts.id
+            AND post_interactions.user_id = ? AND post_interactions.interaction = 1)`)
+		args = append(args, opts.UserID)
+	}
+
+	if opts.Following {
+		conditions = append(conditions, "posts.user_id IN (SELECT followee_id FROM follows WHERE follower_id = ?)")
+		args = append(args, opts.UserID)
+	}
+
+	// Posts of users the viewer blocked are hidden.
+	if opts.UserID > 0 {
+		conditions = append(conditions, "posts.user_id NOT IN (SELECT blocked_id FROM blocks WHERE blocker_id = ?)")
 		args = append(args, opts.UserID)
-	default:
-		formattedCategory := strings.ToUpper(string(opts.Filter[0])) + strings.ToLower(opts.Filter[1:])
-		baseQuery += `
-            JOIN post_categories ON post_categories.post_id = posts.id
-            WHERE post_categories.category = ?`
-		args = append(args, formattedCategory)
 	}
 
-	baseQuery += " ORDER BY posts.id DESC"
+	if opts.Tag != "" {
+		conditions = append(conditions, `EXISTS (
+            SELECT 1 FROM post_tags
+            JOIN tags ON tags.id = post_tags.tag_id
+            WHERE post_tags.post_id = posts.id AND tags.name = ?)`)
+		args = append(args, strings.ToLower(opts.Tag))
+	}
+
+	if len(opts.Categories) > 0 {
+		// Categories match by slug or display name; unknown ones match no rows.
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(opts.Categories)), ",")
+		conditions = append(conditions, `EXISTS (
+            SELECT 1 FROM post_categories
+            JOIN categories ON categories.slug = post_categories.category
+            WHERE post_categories.post_id = posts.id
+            AND (categories.slug IN (`+placeholders+`) OR LOWER(categories.name) IN (`+placeholders+`)))`)
+		for i := 0; i < 2; i++ {
+			for _, category := range opts.Categories {
+				args = append(args, strings.ToLower(category))
+			}
+		}
+	}
+
+	if opts.Author != "" {
+		conditions = append(conditions, "users.uname = ?")
+		args = append(args, strings.ToLower(opts.Author))
+	}
+
+	if opts.From != "" {
+		conditions = append(conditions, "posts.created_at >= date(?)")
+		args = append(args, opts.From)
+	}
+
+	if opts.To != "" {
+		conditions = append(conditions, "posts.created_at < date(?, '+1 day')")
+		args = append(args, opts.To)
+	}
+
+	if opts.HasImage {
+		conditions = append(conditions, "posts.img IS NOT NULL AND posts.img != ''")
+	}
+
+	// SQLite reads "now" as the current time
+	asOf := "now"
+	if !opts.AsOf.IsZero() {
+		asOf = opts.AsOf.UTC().Format(sqliteTimeLayout)
+		conditions = append(conditions, "posts.created_at <= datetime(?)")
+		args = append(args, asOf)
+	}
+
+	if since, ok := feedWindows[opts.Window]; ok && since != "" {
+		conditions = append(conditions, "posts.created_at >= datetime(?, ?)")
+		args = append(args, asOf, since)
+	}
+
+	if len(conditions) > 0 {
+		baseQuery += "\n        WHERE " + strings.Join(conditions, "\n        AND ")
+	}
+
+	order, ok := feedOrders[opts.Sort]
+	if !ok {
+		order = feedOrders["new"]
+	}
+	// posts.id breaks ties so pages never overlap or skip posts.
+	baseQuery += " ORDER BY " + order
+	for i := strings.Count(order, "?"); i > 0; i-- {
+		args = append(args, asOf)
+	}
 
 	if opts.Limit > 0 {
 		baseQuery += " LIMIT ? OFFSET ?"
@@ -102,7 +233,15 @@ func getPostLikeDisLike(post_id, inter int) int {
 }
 
 func getPostCategories(postID int) []string {
-	rows, _ := Db.Query("SELECT category FROM post_categories WHERE post_categories.post_id=?", postID)
+	rows, err := Db.Query(`
+        SELECT categories.name FROM post_categories
+        JOIN categories ON categories.slug = post_categories.category
+        WHERE post_categories.post_id = ?
+        ORDER BY categories.position`, postID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
 
 	var categories []string
 	for rows.Next() {
@@ -114,21 +253,41 @@ func getPostCategories(postID int) []string {
 	return categories
 }
 
-func InsertPost(id int, title, content string, categories []string, imgName string) error {
-	selector := `INSERT INTO posts(title,content,user_id,img) VALUES (?,?,?,?)`
-	a, err := Db.Exec(selector, title, content, id, imgName)
+// InsertPost stores a post with its categories and tags and returns its
+// ID; categories must be slugs of existing categories.
+func InsertPost(id int, title, content string, categories []string, imgName string) (int, error) {
+	tx, err := Db.Begin()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	idPost, _ := a.LastInsertId()
+	defer tx.Rollback()
 
-	for _, category := range categories {
+	a, err := tx.Exec(`INSERT INTO posts(title,content,user_id,img) VALUES (?,?,?,?)`, title, content, id, imgName)
+	if err != nil {
+		return 0, err
+	}
+	idPost, err := a.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
 
-		formattedCategory := strings.ToUpper(string(category[0])) + strings.ToLower(string(category[1:]))
-		selector = `INSERT INTO post_categories(post_id,category) VALUES (?,?)`
-		_, _ = Db.Exec(selector, idPost, formattedCategory)
+	for _, category := range categories {
+		_, err := tx.Exec(`INSERT INTO post_categories(post_id,category) VALUES (?,?)`, idPost, category)
+		if err != nil {
+			return 0, fmt.Errorf("failed to file post under %q: %w", category, err)
+		}
 	}
-	return nil
+	if err := insertPostTags(tx, idPost, ExtractTags(content)); err != nil {
+		return 0, fmt.Errorf("failed to save tags: %w", err)
+	}
+	return int(idPost), tx.Commit()
+}
+
+func GetPostAuthor(postID int) (int, string, error) {
+	var userID int
+	var title string
+	err := Db.QueryRow("SELECT user_id, title FROM posts WHERE id = ?", postID).Scan(&userID, &title)
+	return userID, title, err
 }
 
 func EncodeImg(imagePath string) (string, error) {
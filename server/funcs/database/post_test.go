@@ -0,0 +1,301 @@
+package forum
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	types "forum/funcs/types"
+)
+
+// openTestDB opens a database migrated to head in a temporary directory.
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	openEmptyDB(t)
+	if _, err := MigrateUp(); err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+}
+
+// squash collapses the whitespace of a query so the layout of the SQL
+// doesn't matter to the comparisons.
+func squash(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+const (
+	selectPosts = `SELECT posts.id, posts.user_id, posts.title, posts.created_at, posts.content,posts.img, users.uname
+        FROM posts
+        JOIN users ON posts.user_id = users.id`
+	byNewest = " ORDER BY posts.id DESC"
+
+	createdCond = "posts.user_id = ?"
+	likedCond   = `EXISTS ( SELECT 1 FROM post_interactions
+        WHERE post_interactions.post_id = posts.id
+        AND post_interactions.user_id = ? AND post_interactions.interaction = 1)`
+	notBlockedCond = "posts.user_id NOT IN (SELECT blocked_id FROM blocks WHERE blocker_id = ?)"
+	authorCond     = "users.uname = ?"
+	fromCond       = "posts.created_at >= date(?)"
+	toCond         = "posts.created_at < date(?, '+1 day')"
+	hasImageCond   = "posts.img IS NOT NULL AND posts.img != ''"
+)
+
+// categoriesCond is the condition matching any of n categories.
+func categoriesCond(n int) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", n), ",")
+	return `EXISTS ( SELECT 1 FROM post_categories
+        JOIN categories ON categories.slug = post_categories.category
+        WHERE post_categories.post_id = posts.id
+        AND (categories.slug IN (` + placeholders + `) OR LOWER(categories.name) IN (` + placeholders + `)))`
+}
+
+func where(conditions ...string) string {
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+func TestBuildPostQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      types.QueryOptions
+		wantQuery string
+		wantArgs  []interface{}
+	}{
+		{
+			name:      "no filters",
+			opts:      types.QueryOptions{},
+			wantQuery: selectPosts + byNewest,
+		},
+		{
+			name:      "one category",
+			opts:      types.QueryOptions{Categories: []string{"News"}},
+			wantQuery: selectPosts + where(categoriesCond(1)) + byNewest,
+			wantArgs:  []interface{}{"news", "news"},
+		},
+		{
+			name:      "categories are OR-ed",
+			opts:      types.QueryOptions{Categories: []string{"News", "technology"}},
+			wantQuery: selectPosts + where(categoriesCond(2)) + byNewest,
+			wantArgs:  []interface{}{"news", "technology", "news", "technology"},
+		},
+		{
+			name:      "categories AND author",
+			opts:      types.QueryOptions{Categories: []string{"news", "hobbies"}, Author: "Alice"},
+			wantQuery: selectPosts + where(categoriesCond(2), authorCond) + byNewest,
+			wantArgs:  []interface{}{"news", "hobbies", "news", "hobbies", "alice"},
+		},
+		{
+			name:      "liked",
+			opts:      types.QueryOptions{UserID: 7, LikedByMe: true},
+			wantQuery: selectPosts + where(likedCond, notBlockedCond) + byNewest,
+			wantArgs:  []interface{}{7, 7},
+		},
+		{
+			name:      "liked through the single filter",
+			opts:      types.QueryOptions{UserID: 7, Filter: "liked"},
+			wantQuery: selectPosts + where(likedCond, notBlockedCond) + byNewest,
+			wantArgs:  []interface{}{7, 7},
+		},
+		{
+			name:      "created",
+			opts:      types.QueryOptions{UserID: 7, CreatedByMe: true},
+			wantQuery: selectPosts + where(createdCond, notBlockedCond) + byNewest,
+			wantArgs:  []interface{}{7, 7},
+		},
+		{
+			name:      "created AND liked AND category",
+			opts:      types.QueryOptions{UserID: 3, CreatedByMe: true, LikedByMe: true, Categories: []string{"news"}},
+			wantQuery: selectPosts + where(createdCond, likedCond, notBlockedCond, categoriesCond(1)) + byNewest,
+			wantArgs:  []interface{}{3, 3, 3, "news", "news"},
+		},
+		{
+			name:      "date range",
+			opts:      types.QueryOptions{From: "2024-01-01", To: "2024-01-31"},
+			wantQuery: selectPosts + where(fromCond, toCond) + byNewest,
+			wantArgs:  []interface{}{"2024-01-01", "2024-01-31"},
+		},
+		{
+			name:      "has image",
+			opts:      types.QueryOptions{HasImage: true},
+			wantQuery: selectPosts + where(hasImageCond) + byNewest,
+		},
+		{
+			name: "every filter",
+			opts: types.QueryOptions{
+				UserID:      2,
+				Categories:  []string{"news"},
+				Author:      "bob",
+				LikedByMe:   true,
+				CreatedByMe: true,
+				From:        "2024-01-01",
+				To:          "2024-02-01",
+				HasImage:    true,
+				Limit:       10,
+				Offset:      20,
+			},
+			wantQuery: selectPosts +
+				where(createdCond, likedCond, notBlockedCond, categoriesCond(1), authorCond, fromCond, toCond, hasImageCond) +
+				byNewest + " LIMIT ? OFFSET ?",
+			wantArgs: []interface{}{2, 2, 2, "news", "news", "bob", "2024-01-01", "2024-02-01", 10, 20},
+		},
+	}
+
+	openTestDB(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := BuildPostQuery(tt.opts)
+			if got, want := squash(query), squash(tt.wantQuery); got != want {
+				t.Errorf("query:\n got %s\nwant %s", got, want)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args: got %v, want %v", args, tt.wantArgs)
+			}
+
+			// The query must be valid SQL with a placeholder for each arg
+			stmt, err := Db.Prepare(query)
+			if err != nil {
+				t.Fatalf("query doesn't prepare: %v", err)
+			}
+			defer stmt.Close()
+			rows, err := stmt.Query(args...)
+			if err != nil {
+				t.Fatalf("query doesn't run: %v", err)
+			}
+			rows.Close()
+		})
+	}
+}
+
+func TestBuildPostQueryDoesntSpliceInput(t *testing.T) {
+	const attack = "x') OR 1=1; DROP TABLE posts; --"
+	opts := types.QueryOptions{
+		UserID:     1,
+		PostID:     attack,
+		Filter:     attack,
+		Tag:        attack,
+		Categories: []string{attack, "news"},
+		Author:     attack,
+		From:       attack,
+		To:         attack,
+		Sort:       attack,
+		Window:     attack,
+	}
+
+	query, args := BuildPostQuery(opts)
+	for _, fragment := range []string{"1=1", "DROP", "--", "x')"} {
+		if strings.Contains(query, fragment) {
+			t.Errorf("input fragment %q was spliced into the query:\n%s", fragment, query)
+		}
+	}
+
+	// Every value reached the query as an argument instead
+	seen := 0
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && strings.EqualFold(s, attack) {
+			seen++
+		}
+	}
+	// PostID, Tag, Author, From and To once; the category and the
+	// Filter, which is another category, twice each
+	if want := 9; seen != want {
+		t.Errorf("the input was passed %d times as an argument, want %d: %v", seen, want, args)
+	}
+
+	// Unknown sort modes and windows fall back to the defaults
+	if !strings.HasSuffix(query, byNewest) {
+		t.Errorf("unknown sort didn't fall back to new: %s", query)
+	}
+
+	openTestDB(t)
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		t.Fatalf("query doesn't run: %v", err)
+	}
+	rows.Close()
+
+	var count int
+	if err := Db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'posts'").Scan(&count); err != nil || count != 1 {
+		t.Fatalf("posts table is gone: count %d, err %v", count, err)
+	}
+}
+
+func TestBuildPostQueryWindow(t *testing.T) {
+	query, args := BuildPostQuery(types.QueryOptions{Window: "week"})
+	if !strings.Contains(query, "posts.created_at >= datetime(?, ?)") {
+		t.Errorf("window condition missing: %s", query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"now", "-7 days"}) {
+		t.Errorf("args: got %v", args)
+	}
+
+	query, args = BuildPostQuery(types.QueryOptions{Window: "all"})
+	if strings.Contains(query, "WHERE") || len(args) != 0 {
+		t.Errorf("the all window shouldn't filter: %s %v", query, args)
+	}
+}
+
+func TestBuildPostQueryAsOf(t *testing.T) {
+	asOf := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	query, args := BuildPostQuery(types.QueryOptions{Sort: "hot", Window: "day", AsOf: asOf, Limit: 5})
+
+	at := "2024-03-01 12:00:00"
+	want := []interface{}{at, at, "-1 day", at, at, 5, 0}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("args: got %v, want %v", args, want)
+	}
+	if strings.Contains(query, "'now'") {
+		t.Errorf("a pinned feed must not read the clock: %s", query)
+	}
+	if !strings.Contains(query, "posts.created_at <= datetime(?)") {
+		t.Errorf("posts after as_of aren't left out: %s", query)
+	}
+}
+
+// TestHotFeedPages checks that the pages of a hot feed pinned to a moment
+// neither overlap nor skip posts, even as new posts come in.
+func TestHotFeedPages(t *testing.T) {
+	openTestDB(t)
+
+	if _, err := Db.Exec(`INSERT INTO users (email, uname, password, first_name, last_name, age, gender)
+        VALUES ('a@x', 'a', 'p', 'A', 'A', 20, 'm')`); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UTC().Add(-48 * time.Hour)
+	for i := 0; i < 12; i++ {
+		created := start.Add(time.Duration(i) * 3 * time.Hour).Format(sqliteTimeLayout)
+		if _, err := Db.Exec("INSERT INTO posts (title, content, user_id, img, created_at) VALUES (?, '', 1, '', ?)", fmt.Sprint("post ", i), created); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	images := t.TempDir()
+	opts := types.QueryOptions{Sort: "hot", AsOf: time.Now().UTC().Truncate(time.Second), Limit: 5}
+	seen := make(map[int]bool)
+	for page := 0; ; page++ {
+		opts.Offset = page * opts.Limit
+		query, args := BuildPostQuery(opts)
+		posts, err := GetPosts(0, images, query, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range posts {
+			if seen[p.ID] {
+				t.Fatalf("post %d is on two pages", p.ID)
+			}
+			seen[p.ID] = true
+		}
+		if len(posts) < opts.Limit {
+			break
+		}
+
+		// A post arriving between pages must not shift the next ones
+		if _, err := Db.Exec("INSERT INTO posts (title, content, user_id, img, created_at) VALUES ('late', '', 1, '', datetime('now', '+1 second'))"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(seen) != 12 {
+		t.Errorf("got %d posts across the pages, want 12", len(seen))
+	}
+}
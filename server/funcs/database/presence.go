@@ -0,0 +1,116 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// The statuses users pick. Others see invisible users as offline.
+const (
+	PresenceOnline    = "online"
+	PresenceAway      = "away"
+	PresenceDND       = "dnd"
+	PresenceInvisible = "invisible"
+	PresenceOffline   = "offline"
+)
+
+// UserPresence is the presence a user picked, with when they were last
+// seen online.
+type UserPresence struct {
+	Status     string
+	StatusText string
+	LastSeen   time.Time
+}
+
+func IsPresenceStatus(status string) bool {
+	switch status {
+	case PresenceOnline, PresenceAway, PresenceDND, PresenceInvisible:
+		return true
+	}
+	return false
+}
+
+// GetPresence returns the presence of userID, online with no text for
+// users who never connected.
+func GetPresence(userID int) (UserPresence, error) {
+	p := UserPresence{Status: PresenceOnline}
+	err := Db.QueryRow(`
+    SELECT status, status_text, last_seen FROM user_sessions WHERE user_id = ?`,
+		userID).Scan(&p.Status, &p.StatusText, &p.LastSeen)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	return p, err
+}
+
+// SetPresenceStatus stores the status userID picked. isOnline is whether
+// others see them online, which invisible users aren't.
+func SetPresenceStatus(userID int, status, statusText string, isOnline bool) error {
+	_, err := Db.Exec(`
+    INSERT INTO user_sessions (user_id, is_online, status, status_text, last_seen)
+    VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+    ON CONFLICT (user_id) DO UPDATE SET
+        is_online = excluded.is_online,
+        status = excluded.status,
+        status_text = excluded.status_text,
+        last_seen = CASE WHEN user_sessions.is_online THEN CURRENT_TIMESTAMP ELSE user_sessions.last_seen END`,
+		userID, isOnline, status, statusText)
+	return err
+}
+
+// ResetOnlineStatus marks everyone offline, for startup: nobody is
+// connected yet, whatever a crash left behind. last_seen is kept, as
+// SyncOnlineUsers kept it recent. It returns how many users were reset.
+func ResetOnlineStatus() (int64, error) {
+	result, err := Db.Exec("UPDATE user_sessions SET is_online = false WHERE is_online")
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// MarkAllOffline marks everyone online offline and seen now, for
+// shutdown. It returns how many users were online.
+func MarkAllOffline() (int64, error) {
+	result, err := Db.Exec(`
+    UPDATE user_sessions SET is_online = false, last_seen = CURRENT_TIMESTAMP WHERE is_online`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SyncOnlineUsers makes user_sessions match who is online: the users in
+// onlineIDs are marked online and seen now, everyone else offline.
+func SyncOnlineUsers(onlineIDs []int) error {
+	if onlineIDs == nil {
+		onlineIDs = []int{}
+	}
+	ids, err := json.Marshal(onlineIDs)
+	if err != nil {
+		return err
+	}
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+    INSERT INTO user_sessions (user_id, is_online, last_seen)
+    SELECT value, true, CURRENT_TIMESTAMP FROM json_each(?) WHERE true
+    ON CONFLICT (user_id) DO UPDATE SET is_online = true, last_seen = CURRENT_TIMESTAMP`,
+		string(ids)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+    UPDATE user_sessions SET is_online = false
+    WHERE is_online AND user_id NOT IN (SELECT value FROM json_each(?))`,
+		string(ids)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,148 @@
+package forum
+
+import (
+	"strings"
+	"time"
+)
+
+var SubscriptionModes = map[string]bool{
+	"instant": true,
+	"digest":  true,
+	"muted":   true,
+}
+
+type CategorySubscription struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`
+	Mode     string `json:"mode"`
+}
+
+type CategoryDigest struct {
+	UserID   int
+	Category string
+	Name     string
+	Posts    int
+}
+
+// GetSubscriptions lists every active category with the user's
+// subscription mode, or "none" when not subscribed.
+func GetSubscriptions(userID int) ([]CategorySubscription, error) {
+	rows, err := Db.Query(`
+    SELECT c.slug, c.name, COALESCE(cs.mode, 'none')
+    FROM categories c
+    LEFT JOIN category_subscriptions cs ON cs.category = c.slug AND cs.user_id = ?
+    WHERE c.archived = false
+    ORDER BY c.position, c.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []CategorySubscription{}
+	for rows.Next() {
+		var s CategorySubscription
+		if err := rows.Scan(&s.Category, &s.Name, &s.Mode); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+func Subscribe(userID int, category, mode string) error {
+	_, err := Db.Exec(`
+    INSERT INTO category_subscriptions (user_id, category, mode)
+    VALUES (?, ?, ?)
+    ON CONFLICT (user_id, category) DO UPDATE SET
+        last_digest_at = CASE WHEN mode != excluded.mode THEN CURRENT_TIMESTAMP ELSE last_digest_at END,
+        mode = excluded.mode`,
+		userID, category, mode)
+	return err
+}
+
+func Unsubscribe(userID int, category string) error {
+	_, err := Db.Exec("DELETE FROM category_subscriptions WHERE user_id = ? AND category = ?", userID, category)
+	return err
+}
+
+// GetInstantSubscribers returns the users subscribed in instant mode to
+// any of the categories, without the post author.
+func GetInstantSubscribers(categories []string, authorID int) ([]int, error) {
+	if len(categories) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{authorID}
+	for _, category := range categories {
+		args = append(args, category)
+	}
+
+	rows, err := Db.Query(`
+    SELECT DISTINCT user_id
+    FROM category_subscriptions
+    WHERE mode = 'instant' AND user_id != ?
+    AND category IN (`+strings.TrimSuffix(strings.Repeat("?,", len(categories)), ",")+`)`,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		users = append(users, id)
+	}
+	return users, rows.Err()
+}
+
+// CollectCategoryDigests counts, for every digest subscription, the posts
+// created since the last digest, and moves the digest mark forward.
+func CollectCategoryDigests() ([]CategoryDigest, error) {
+	cutoff := time.Now().UTC().Format(sqliteTimeLayout)
+
+	tx, err := Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+    SELECT cs.user_id, c.slug, c.name, COUNT(p.id)
+    FROM category_subscriptions cs
+    JOIN categories c ON c.slug = cs.category
+    JOIN post_categories pc ON pc.category = cs.category
+    JOIN posts p ON p.id = pc.post_id
+    WHERE cs.mode = 'digest'
+    AND p.user_id != cs.user_id
+    AND p.created_at > cs.last_digest_at AND p.created_at <= ?
+    GROUP BY cs.user_id, c.slug
+    ORDER BY cs.user_id, c.position`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	var digests []CategoryDigest
+	for rows.Next() {
+		var d CategoryDigest
+		if err := rows.Scan(&d.UserID, &d.Category, &d.Name, &d.Posts); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		digests = append(digests, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec("UPDATE category_subscriptions SET last_digest_at = ? WHERE mode = 'digest'", cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	return digests, tx.Commit()
+}
@@ -0,0 +1,117 @@
+package forum
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	types "forum/funcs/types"
+)
+
+const maxTagsPerPost = 10
+
+var (
+	// A hashtag starts at the beginning of the text or after a character
+	// that can't be part of a word, so "a#b" and "##b" aren't tags.
+	hashtagRegex = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_#&])#([\p{L}\p{N}_]{2,30})`)
+	TagRegex     = regexp.MustCompile(`^[\p{L}\p{N}_]{1,30}$`)
+)
+
+// ExtractTags returns the distinct, lower-cased hashtags found in text.
+func ExtractTags(text string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, match := range hashtagRegex.FindAllStringSubmatch(text, -1) {
+		tag := strings.ToLower(match[1])
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == maxTagsPerPost {
+			break
+		}
+	}
+	return tags
+}
+
+func insertPostTags(tx *sql.Tx, postID int64, tags []string) error {
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+        INSERT OR IGNORE INTO post_tags (post_id, tag_id)
+        SELECT ?, id FROM tags WHERE name = ?`,
+			postID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getPostTags(postID int) []string {
+	rows, err := Db.Query(`
+        SELECT tags.name FROM post_tags
+        JOIN tags ON tags.id = post_tags.tag_id
+        WHERE post_tags.post_id = ?
+        ORDER BY tags.name`, postID)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// SearchTags returns the most used tags starting with prefix.
+func SearchTags(prefix string, limit int) ([]types.Tag, error) {
+	return scanTags(`
+    SELECT tags.name, COUNT(post_tags.post_id) AS uses
+    FROM tags
+    LEFT JOIN post_tags ON post_tags.tag_id = tags.id
+    WHERE tags.name LIKE ? || '%' ESCAPE '\'
+    GROUP BY tags.id
+    ORDER BY uses DESC, tags.name
+    LIMIT ?`, strings.ReplaceAll(strings.ToLower(prefix), "_", `\_`), limit)
+}
+
+// GetTrendingTags counts tag usage on posts created within the last window.
+func GetTrendingTags(window time.Duration, limit int) ([]types.Tag, error) {
+	return scanTags(`
+    SELECT tags.name, COUNT(*) AS uses
+    FROM post_tags
+    JOIN tags ON tags.id = post_tags.tag_id
+    JOIN posts ON posts.id = post_tags.post_id
+    WHERE posts.created_at >= datetime('now', ?)
+    GROUP BY tags.id
+    ORDER BY uses DESC, tags.name
+    LIMIT ?`, fmt.Sprintf("-%d seconds", int(window.Seconds())), limit)
+}
+
+func scanTags(query string, args ...interface{}) ([]types.Tag, error) {
+	rows, err := Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []types.Tag{}
+	for rows.Next() {
+		var tag types.Tag
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
@@ -21,17 +21,12 @@ func GenereteTocken() (string, error) {
 
 func GetUserIDFromToken(uuid string) (int, error) {
 	var id int
-	var created_time string
-	err := Db.QueryRow("SELECT user_id,created_at FROM tokens WHERE token=?", uuid).Scan(&id, &created_time)
+	var expires time.Time
+	err := Db.QueryRow("SELECT user_id,expires_at FROM tokens WHERE token=?", uuid).Scan(&id, &expires)
 	if err != nil {
 		return 0, err
 	}
-	t, err := time.Parse(time.RFC3339, created_time)
-	if err != nil {
-		return 0, err
-	}
-	t = t.Add(1 * time.Hour)
-	if time.Now().After(t) {
+	if time.Now().After(expires) {
 		err = fmt.Errorf("expired token")
 		return 0, err
 	}
@@ -48,9 +43,10 @@ func GetUserInfoByLoginInfo(identifier string) (*types.User, error) {
 	return user, nil
 }
 
-func SetToken(token string, id int) error {
-	query := "UPDATE tokens SET token=?,created_at=CURRENT_TIMESTAMP WHERE user_id=?"
-	_, err := Db.Exec(query, token, id)
+// SetToken starts a session of the user that lasts until expires.
+func SetToken(token string, id int, expires time.Time) error {
+	query := "UPDATE tokens SET token=?,created_at=CURRENT_TIMESTAMP,expires_at=? WHERE user_id=?"
+	_, err := Db.Exec(query, token, expires.UTC().Format(sqliteTimeLayout), id)
 	if err != nil {
 		return err
 	}
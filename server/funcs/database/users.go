@@ -3,6 +3,7 @@ package forum
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 func InsertUserInfo(email, password, uname, firstName, lastName, age, gender string) (int, error) {
@@ -49,3 +50,27 @@ func InsertUserInfo(email, password, uname, firstName, lastName, age, gender str
 
 	return int(id), nil
 }
+
+func UserExists(userID int) bool {
+	var id int
+	err := Db.QueryRow("SELECT id FROM users WHERE id = ?", userID).Scan(&id)
+	return err == nil
+}
+
+func IsAdmin(userID int) bool {
+	var id int
+	err := Db.QueryRow("SELECT user_id FROM admins WHERE user_id = ?", userID).Scan(&id)
+	return err == nil
+}
+
+// GrantAdmin gives admin rights to the user with the given username.
+func GrantAdmin(uname string) error {
+	var id int
+	err := Db.QueryRow("SELECT id FROM users WHERE uname = ?", strings.ToLower(uname)).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	_, err = Db.Exec("INSERT OR IGNORE INTO admins (user_id) VALUES (?)", id)
+	return err
+}
@@ -3,6 +3,7 @@ package forum
 import (
 	"database/sql"
 	"encoding/json"
+	config "forum/funcs/config"
 	data "forum/funcs/database"
 	types "forum/funcs/types"
 	"net/http"
@@ -10,124 +11,134 @@ import (
 	"strings"
 )
 
-func Commenting(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	switch r.Method {
-	case http.MethodGet:
-		post_id, err := strconv.Atoi(r.URL.Query().Get("post_id"))
-		if err != nil || post_id <= 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid post ID"})
-			return
-		}
-
-		user_id := 0
-		if Cookie, err := r.Cookie("Token"); err == nil {
-			user_id, _ = data.GetUserIDFromToken(Cookie.Value)
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Token"})
-			return
-		}
-
-		opts := types.QueryOptions{
-			UserID: user_id,
-			PostID: strconv.Itoa(post_id),
-		}
-
-		query, args := data.BuildPostQuery(opts)
-
-		posts, err := data.GetPosts(user_id, query, args...)
-		if err == sql.ErrNoRows || len(posts) == 0 {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
-			return
-		}
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
-			return
-		}
-
-		comments, err := data.GetComment(post_id, user_id, 3, 0)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch comments"})
-			return
-		}
-
-		response := struct {
-			Post     types.POST      `json:"post"`
-			Comments []types.COMMENT `json:"comments"`
-		}{
-			Post:     posts[0],
-			Comments: comments,
-		}
-
-		json.NewEncoder(w).Encode(response)
-	case http.MethodPost:
-		c, err := r.Cookie("Token")
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
-			return
-		}
-
-		user_id, err := data.GetUserIDFromToken(c.Value)
-		if err != nil {
-			ClearSession(w)
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid session"})
-			return
-		}
-
-		content := strings.TrimSpace(r.FormValue("Content"))
-		if content == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Please enter a comment"})
-			return
-		}
-
-		post_id, err := strconv.Atoi(r.FormValue("post_id"))
-		if err != nil || post_id <= 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid post ID"})
-			return
+func Commenting(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			post_id, err := strconv.Atoi(r.URL.Query().Get("post_id"))
+			if err != nil || post_id <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Invalid post ID"})
+				return
+			}
+
+			user_id := 0
+			if Cookie, err := r.Cookie("Token"); err == nil {
+				user_id, _ = data.GetUserIDFromToken(Cookie.Value)
+			} else {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Token"})
+				return
+			}
+
+			opts := types.QueryOptions{
+				UserID: user_id,
+				PostID: strconv.Itoa(post_id),
+			}
+
+			query, args := data.BuildPostQuery(opts)
+
+			posts, err := data.GetPosts(user_id, cfg.ImagesDir, query, args...)
+			if err == sql.ErrNoRows || len(posts) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Post not found"})
+				return
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
+				return
+			}
+
+			comments, err := data.GetComment(post_id, user_id, cfg.CommentsPageSize, 0)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch comments"})
+				return
+			}
+
+			response := struct {
+				Post     types.POST      `json:"post"`
+				Comments []types.COMMENT `json:"comments"`
+			}{
+				Post:     posts[0],
+				Comments: comments,
+			}
+
+			json.NewEncoder(w).Encode(response)
+		case http.MethodPost:
+			c, err := r.Cookie("Token")
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Not authenticated"})
+				return
+			}
+
+			user_id, err := data.GetUserIDFromToken(c.Value)
+			if err != nil {
+				ClearSession(w)
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Invalid session"})
+				return
+			}
+
+			content := strings.TrimSpace(r.FormValue("Content"))
+			if content == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Please enter a comment"})
+				return
+			}
+
+			post_id, err := strconv.Atoi(r.FormValue("post_id"))
+			if err != nil || post_id <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Invalid post ID"})
+				return
+			}
+
+			comment_id, err := data.InsertComment(post_id, user_id, content)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save comment"})
+				return
+			}
+
+			var username string
+			err = data.Db.QueryRow(`SELECT uname FROM users WHERE id = ?`, user_id).Scan(&username)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch user info"})
+				return
+			}
+
+			response := struct {
+				Id       int
+				Uname    string
+				Content  string
+				Likes    int
+				Dislikes int
+			}{
+				Id:       comment_id,
+				Uname:    username,
+				Content:  content,
+				Likes:    0,
+				Dislikes: 0,
+			}
+
+			go notifyComment(user_id, post_id, comment_id)
+			go publishCommentCreated(post_id, types.COMMENT{
+				Id:      comment_id,
+				USER_ID: user_id,
+				Uname:   username,
+				Content: content,
+			})
+
+			json.NewEncoder(w).Encode(response)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
 		}
-
-		comment_id, err := data.InsertComment(post_id, user_id, content)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save comment"})
-			return
-		}
-
-		var username string
-		err = data.Db.QueryRow(`SELECT uname FROM users WHERE id = ?`, user_id).Scan(&username)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch user info"})
-			return
-		}
-
-		response := struct {
-			Id       int
-			Uname    string
-			Content  string
-			Likes    int
-			Dislikes int
-		}{
-			Id:       comment_id,
-			Uname:    username,
-			Content:  content,
-			Likes:    0,
-			Dislikes: 0,
-		}
-
-		json.NewEncoder(w).Encode(response)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
 	}
 }
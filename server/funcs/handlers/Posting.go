@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	config "forum/funcs/config"
 	data "forum/funcs/database"
 )
 
@@ -17,100 +18,112 @@ type PostingData struct {
 	Error      string
 }
 
-var DefaultCategories = []string{"General", "News", "Entertainment", "Hobbies", "Lifestyle", "Technology"}
-
-func Posting(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	switch r.Method {
-	case http.MethodGet:
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"categories": DefaultCategories,
-		})
-	case http.MethodPost:
-		var err error
-		c, _ := r.Cookie("Token")
-		id, _ := data.GetUserIDFromToken(c.Value)
-
-		title := strings.TrimSpace(r.FormValue("title"))
-		content := strings.TrimSpace(r.FormValue("content"))
-		category := r.Form["categories"]
-
-		// Get image file
-		var name string
-		imageExists := false
-
-		file, header, err := r.FormFile("file")
-		if err == nil {
-			imageExists = true
-			defer file.Close()
-
-			// Check file extension
-			ext := strings.ToLower(filepath.Ext(header.Filename))
-			validExtensions := map[string]bool{
-				".jpg":  true,
-				".jpeg": true,
-				".png":  true,
-				".gif":  true,
+func Posting(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.Method {
+		case http.MethodGet:
+			categories, err := data.GetCategoryNames()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch categories"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"categories": categories,
+			})
+		case http.MethodPost:
+			var err error
+			c, _ := r.Cookie("Token")
+			id, _ := data.GetUserIDFromToken(c.Value)
+
+			title := strings.TrimSpace(r.FormValue("title"))
+			content := strings.TrimSpace(r.FormValue("content"))
+			category := r.Form["categories"]
+
+			// Get image file
+			var name string
+			imageExists := false
+
+			file, header, err := r.FormFile("file")
+			if err == nil {
+				imageExists = true
+				defer file.Close()
+
+				// Check file extension
+				ext := strings.ToLower(filepath.Ext(header.Filename))
+				validExtensions := map[string]bool{
+					".jpg":  true,
+					".jpeg": true,
+					".png":  true,
+					".gif":  true,
+				}
+
+				if !validExtensions[ext] {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]string{
+						"error": "Invalid file type. Only .jpg, .jpeg, .png, and .gif files are allowed",
+					})
+					return
+				}
+
+				name, err = data.GenereteTocken()
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]string{"error": "Failed to process image"})
+					return
+				}
+
+				extensions := strings.Split(header.Filename, ".")[1]
+				name = name + "." + extensions
+
+				if err = saveImg(file, filepath.Join(cfg.ImagesDir, name)); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save image"})
+					return
+				}
 			}
 
-			if !validExtensions[ext] {
+			if title == "" || (content == "" && !imageExists) || len(category) == 0 {
 				w.WriteHeader(http.StatusBadRequest)
 				json.NewEncoder(w).Encode(map[string]string{
-					"error": "Invalid file type. Only .jpg, .jpeg, .png, and .gif files are allowed",
+					"error": "All fields are required. Please fill them",
 				})
 				return
 			}
 
-			name, err = data.GenereteTocken()
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to process image"})
+			slugs, ok := CategoryFilter(category)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "Invalid category selected",
+				})
 				return
 			}
 
-			extensions := strings.Split(header.Filename, ".")[1]
-			name = name + "." + extensions
-
-			if err = saveImg(file, "./images/"+name); err != nil {
+			postID, err := data.InsertPost(id, title, content, slugs, name)
+			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save image"})
+				json.NewEncoder(w).Encode(map[string]string{
+					"error": "Failed to create post",
+				})
 				return
 			}
-		}
-
-		if title == "" || (content == "" && !imageExists) || len(category) == 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "All fields are required. Please fill them",
-			})
-			return
-		}
 
-		if !CategoryFilter(category) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "Invalid category selected",
-			})
-			return
-		}
+			var username string
+			data.Db.QueryRow(`SELECT uname FROM users WHERE id = ?`, id).Scan(&username)
+			go notifyCategorySubscribers(id, username, postID, title, slugs)
+			go wsManager.publishPostCreated(postID, slugs)
 
-		err = data.InsertPost(id, title, content, category, name)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
 			json.NewEncoder(w).Encode(map[string]string{
-				"error": "Failed to create post",
+				"status":  "success",
+				"message": "Post created successfully",
 			})
-			return
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
 		}
-
-		json.NewEncoder(w).Encode(map[string]string{
-			"status":  "success",
-			"message": "Post created successfully",
-		})
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
 	}
 }
 
@@ -134,11 +147,16 @@ func saveImg(file multipart.File, path string) error {
 	return nil
 }
 
-func CategoryFilter(categories []string) bool {
+// CategoryFilter checks the submitted categories against the categories
+// table and returns their slugs. Archived categories are rejected.
+func CategoryFilter(categories []string) ([]string, bool) {
+	var slugs []string
 	for _, v := range categories {
-		if !data.AllCategories[strings.ToLower(v)] {
-			return false
+		c, err := data.ResolveCategory(v)
+		if err != nil || c.Archived {
+			return nil, false
 		}
+		slugs = append(slugs, c.Slug)
 	}
-	return true
+	return slugs, true
 }
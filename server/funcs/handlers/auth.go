@@ -62,3 +62,29 @@ func CheckIfCookieValid(w http.ResponseWriter, r *http.Request) (int, bool) {
 	}
 	return userId, false
 }
+
+func AuthAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, isAuth := CheckIfCookieValid(w, r)
+		if !isAuth {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":    "Authentication required",
+				"redirect": "/login",
+			})
+			return
+		}
+
+		if !Data.IsAdmin(userID) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Admin access required",
+			})
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,187 @@
+package forum
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	data "forum/funcs/database"
+)
+
+var errCannotMessage = errors.New("you can't message this user")
+
+// checkCanMessage returns errCannotMessage when a block or the receiver's
+// DM privacy stops senderID from messaging receiverID.
+func checkCanMessage(senderID, receiverID int) error {
+	allowed, err := data.CanMessage(senderID, receiverID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return errCannotMessage
+	}
+	return nil
+}
+
+// BlocksHandler lists the users the current user blocked (GET), blocks
+// one (POST {"user_id": n}) or unblocks one (DELETE ?user_id=n).
+func BlocksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		users, err := data.GetBlockedUsers(userID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch blocked users"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(users)
+	case http.MethodPost:
+		var request struct {
+			UserID int `json:"user_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID"})
+			return
+		}
+
+		if request.UserID == userID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "You can't block yourself"})
+			return
+		}
+
+		if !data.UserExists(request.UserID) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+			return
+		}
+
+		if err := data.Block(userID, request.UserID); err != nil {
+			log.Printf("Error blocking user %d for %d: %v", request.UserID, userID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to block user"})
+			return
+		}
+
+		// From now on the blocked user sees us offline
+		wsManager.sendPresenceTo(request.UserID, userID)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	case http.MethodDelete:
+		blockedID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil || blockedID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID"})
+			return
+		}
+
+		if err := data.Unblock(userID, blockedID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to unblock user"})
+			return
+		}
+
+		wsManager.sendPresenceTo(blockedID, userID)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// PrivacyHandler reads (GET) or changes (PUT {"dm_privacy": "..."}) who
+// may send the current user direct messages: everyone, following (users
+// they follow) or nobody.
+func PrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request struct {
+			DMPrivacy string `json:"dm_privacy"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !data.IsDMPrivacy(request.DMPrivacy) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "dm_privacy must be everyone, following or nobody",
+			})
+			return
+		}
+
+		if err := data.SetDMPrivacy(userID, request.DMPrivacy); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update privacy settings"})
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	privacy, err := data.GetDMPrivacy(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch privacy settings"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"dm_privacy": privacy,
+	})
+}
+
+// sendPresenceTo sends viewerID the presence of userID as they may see
+// it, when they follow it.
+func (wm *WebSocketManager) sendPresenceTo(viewerID, userID int) {
+	frame, err := json.Marshal(WebSocketMessage{
+		Type:    "online_status",
+		Payload: wm.presenceFor(viewerID, userID),
+	})
+	if err != nil {
+		return
+	}
+
+	var clients []*client
+	wm.mu.RLock()
+	for c := range wm.topics[presenceTopic(userID)] {
+		if c.userID == viewerID {
+			clients = append(clients, c)
+		}
+	}
+	wm.mu.RUnlock()
+
+	for _, c := range clients {
+		c.enqueue(frame)
+	}
+}
@@ -0,0 +1,190 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	data "forum/funcs/database"
+	types "forum/funcs/types"
+)
+
+var (
+	slugRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+	// reservedFilters are filter keywords that a category slug would shadow.
+	reservedFilters = map[string]bool{
+		"created":   true,
+		"liked":     true,
+		"following": true,
+		"tag":       true,
+	}
+)
+
+// CategoriesHandler lists the active categories.
+func CategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	categories, err := data.GetCategories(false)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch categories"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"categories": categories,
+	})
+}
+
+// AdminCategoriesHandler lets admins list, create, update and delete
+// categories. Update and delete take the category slug as ?slug=.
+func AdminCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case http.MethodGet:
+		categories, err := data.GetCategories(true)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch categories"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"categories": categories,
+		})
+	case http.MethodPost:
+		createCategory(w, r)
+	case http.MethodPut:
+		updateCategory(w, r)
+	case http.MethodDelete:
+		deleteCategory(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
+
+func createCategory(w http.ResponseWriter, r *http.Request) {
+	var category types.Category
+	if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+
+	category.Slug = strings.ToLower(strings.TrimSpace(category.Slug))
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Slug == "" {
+		category.Slug = strings.Join(strings.Fields(strings.ToLower(category.Name)), "-")
+	}
+
+	if errMsg := CategoryValidation(category); errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+		return
+	}
+
+	id, err := data.InsertCategory(category)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "A category with this slug already exists"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create category"})
+		return
+	}
+	category.ID = id
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+func updateCategory(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(r.URL.Query().Get("slug"))
+
+	var category types.Category
+	if err := json.NewDecoder(r.Body).Decode(&category); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+		return
+	}
+
+	// The slug is referenced by posts, so it can't be renamed.
+	category.Slug = slug
+	category.Name = strings.TrimSpace(category.Name)
+
+	if errMsg := CategoryValidation(category); errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+		return
+	}
+
+	err := data.UpdateCategory(slug, category)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Category not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update category"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+	})
+}
+
+func deleteCategory(w http.ResponseWriter, r *http.Request) {
+	slug := strings.ToLower(r.URL.Query().Get("slug"))
+
+	err := data.DeleteCategory(slug)
+	switch {
+	case err == sql.ErrNoRows:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Category not found"})
+	case errors.Is(err, data.ErrCategoryInUse):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Category has posts, archive it instead"})
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete category"})
+	default:
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	}
+}
+
+func CategoryValidation(category types.Category) string {
+	if !slugRegex.MatchString(category.Slug) || len(category.Slug) > 30 {
+		return "Slug must be up to 30 lowercase letters, digits and hyphens"
+	}
+
+	if reservedFilters[category.Slug] {
+		return "This slug is reserved"
+	}
+
+	if len(category.Name) < 2 || len(category.Name) > 30 {
+		return "Name must be between 2 and 30 characters"
+	}
+
+	if len(category.Description) > 200 {
+		return "Description must be at most 200 characters"
+	}
+
+	return ""
+}
@@ -0,0 +1,426 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	data "forum/funcs/database"
+)
+
+// Every active category has a public chat channel, named by its slug.
+// Connections join one with a join_channel frame and then receive its
+// channel_message events and the channel_presence events sent when a user
+// joins or leaves. Users count once however many connections they join
+// with. History is fetched over REST from /api/channels/{slug}/messages.
+const (
+	channelPageSize    = 20
+	maxChannelPageSize = 50
+
+	// Users can send channelRateLimit messages per channelRateWindow
+	// across all channels.
+	channelRateLimit  = 5
+	channelRateWindow = 10 * time.Second
+)
+
+var (
+	errChannelNotFound = errors.New("channel not found")
+	errNotInChannel    = errors.New("join the channel first")
+	errRateLimited     = errors.New("you are sending messages too fast")
+
+	channelLimiter = newRateLimiter(channelRateLimit, channelRateWindow)
+)
+
+type channelInfo struct {
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	MemberCount int    `json:"member_count"`
+}
+
+func channelTopic(slug string) string {
+	return "channel:" + slug
+}
+
+// resolveChannel returns the slug of the channel of an active category.
+func resolveChannel(value string) (string, error) {
+	category, err := data.ResolveCategory(value)
+	if err == sql.ErrNoRows || (err == nil && category.Archived) {
+		return "", errChannelNotFound
+	}
+	return category.Slug, err
+}
+
+// rateLimiter allows each user limit events per sliding window.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	events map[int][]time.Time
+	// lastSweep is when the users without recent events were last
+	// dropped from events.
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:     limit,
+		window:    window,
+		events:    make(map[int][]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow records an event of userID and reports whether it is within the
+// limit.
+func (l *rateLimiter) allow(userID int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= l.window {
+		l.sweep(now)
+	}
+
+	recent := l.recent(userID, now)
+	if len(recent) >= l.limit {
+		l.events[userID] = recent
+		return false
+	}
+	l.events[userID] = append(recent, now)
+	return true
+}
+
+// recent returns the events of userID still in the window. It must be
+// called with l.mu held.
+func (l *rateLimiter) recent(userID int, now time.Time) []time.Time {
+	recent := l.events[userID][:0]
+	for _, t := range l.events[userID] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// sweep drops the users whose events all left the window, so the map
+// only holds the recent senders. It must be called with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for userID := range l.events {
+		if recent := l.recent(userID, now); len(recent) > 0 {
+			l.events[userID] = recent
+		} else {
+			delete(l.events, userID)
+		}
+	}
+	l.lastSweep = now
+}
+
+// channelMemberIDs returns the users with a connection in the channel,
+// leaving out the invisible ones. It must be called with wm.mu held.
+func (wm *WebSocketManager) channelMemberIDs(slug string) []int {
+	seen := make(map[int]bool)
+	var ids []int
+	for c := range wm.topics[channelTopic(slug)] {
+		if !seen[c.userID] && !wm.isInvisible(c.userID) {
+			seen[c.userID] = true
+			ids = append(ids, c.userID)
+		}
+	}
+	return ids
+}
+
+// inChannel reports whether userID has a connection in the channel. It
+// must be called with wm.mu held.
+func (wm *WebSocketManager) inChannel(userID int, slug string) bool {
+	for c := range wm.topics[channelTopic(slug)] {
+		if c.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// userChannels returns the channels userID has a connection in. It must
+// be called with wm.mu held.
+func (wm *WebSocketManager) userChannels(userID int) []string {
+	seen := make(map[string]bool)
+	var slugs []string
+	for _, c := range wm.connections[userID] {
+		for topic := range c.topics {
+			if slug, ok := strings.CutPrefix(topic, "channel:"); ok && !seen[slug] {
+				seen[slug] = true
+				slugs = append(slugs, slug)
+			}
+		}
+	}
+	return slugs
+}
+
+func (wm *WebSocketManager) channelMemberCount(slug string) int {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	return len(wm.channelMemberIDs(slug))
+}
+
+// joinChannel adds c to a channel and returns who is in it, as far as the
+// user may see. The other members are told when the user wasn't in the
+// channel yet, unless they're invisible.
+func (wm *WebSocketManager) joinChannel(c *client, value string) (map[string]interface{}, error) {
+	slug, err := resolveChannel(value)
+	if err != nil {
+		return nil, err
+	}
+
+	wm.mu.Lock()
+	alreadyIn := wm.inChannel(c.userID, slug)
+	err = wm.addSubscriber(channelTopic(slug), c)
+	invisible := wm.isInvisible(c.userID)
+	memberIDs := wm.channelMemberIDs(slug)
+	wm.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if !alreadyIn && !invisible {
+		wm.publishChannelPresence(slug, c.userID, "joined", len(memberIDs))
+	}
+
+	blockers, err := data.GetBlockerIDs(c.userID)
+	if err != nil {
+		return nil, err
+	}
+	// Invisible users still see themselves
+	visibleIDs := []int{}
+	count := len(memberIDs)
+	if invisible {
+		visibleIDs = append(visibleIDs, c.userID)
+		count++
+	}
+	for _, id := range memberIDs {
+		if !blockers[id] {
+			visibleIDs = append(visibleIDs, id)
+		}
+	}
+
+	members, err := data.GetChannelMembers(visibleIDs)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"channel":      slug,
+		"member_count": count,
+		"members":      members,
+	}, nil
+}
+
+// leaveChannel removes c from a channel. The other members are told when
+// it was the user's last connection in it.
+func (wm *WebSocketManager) leaveChannel(c *client, value string) (string, error) {
+	slug, err := resolveChannel(value)
+	if err != nil {
+		return "", err
+	}
+
+	wm.mu.Lock()
+	wasIn := c.topics[channelTopic(slug)]
+	wm.removeSubscriber(channelTopic(slug), c)
+	delete(c.topics, channelTopic(slug))
+	stillIn := wm.inChannel(c.userID, slug)
+	invisible := wm.isInvisible(c.userID)
+	count := len(wm.channelMemberIDs(slug))
+	wm.mu.Unlock()
+
+	if wasIn && !stillIn && !invisible {
+		wm.publishChannelPresence(slug, c.userID, "left", count)
+	}
+	return slug, nil
+}
+
+// publishChannelPresence tells the channel that userID joined or left it,
+// skipping the members who may not see their presence. Callers don't
+// announce invisible users.
+func (wm *WebSocketManager) publishChannelPresence(slug string, userID int, action string, memberCount int) {
+	hidden, err := data.GetPresenceHiddenFrom(userID)
+	if err != nil {
+		log.Printf("Error fetching who can't see user %d's presence: %v", userID, err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"channel":      slug,
+		"user_id":      userID,
+		"action":       action,
+		"member_count": memberCount,
+	}
+	if members, err := data.GetChannelMembers([]int{userID}); err == nil && len(members) > 0 {
+		payload["username"] = members[0].Username
+	}
+
+	wm.publishSkipping(WebSocketMessage{
+		Type:    "channel_presence",
+		Payload: payload,
+	}, hidden, channelTopic(slug))
+}
+
+// sendChannelMessage stores a message from a member of the channel and
+// publishes it to the channel.
+func (wm *WebSocketManager) sendChannelMessage(c *client, value, content string) (data.ChannelMessage, error) {
+	slug, err := resolveChannel(value)
+	if err != nil {
+		return data.ChannelMessage{}, err
+	}
+
+	wm.mu.RLock()
+	joined := c.topics[channelTopic(slug)]
+	wm.mu.RUnlock()
+	if !joined {
+		return data.ChannelMessage{}, errNotInChannel
+	}
+
+	if !channelLimiter.allow(c.userID) {
+		return data.ChannelMessage{}, errRateLimited
+	}
+
+	message, err := data.InsertChannelMessage(slug, c.userID, content)
+	if err != nil {
+		return message, err
+	}
+
+	wm.publish(WebSocketMessage{
+		Type:    "channel_message",
+		Payload: message,
+	}, channelTopic(slug))
+	return message, nil
+}
+
+// channelError maps the channel errors to protocol errors.
+func channelError(err error) error {
+	switch err {
+	case errChannelNotFound:
+		return newProtocolError(errCodeNotFound, "%v", err)
+	case errNotInChannel:
+		return newProtocolError(errCodeForbidden, "%v", err)
+	case errRateLimited, errTooManyTopics:
+		return newProtocolError(errCodeLimitExceeded, "%v", err)
+	}
+	return err
+}
+
+// ChannelsHandler lists the channels with how many users are in each.
+func ChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, isAuth := CheckIfCookieValid(w, r); !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Method not allowed",
+		})
+		return
+	}
+
+	categories, err := data.GetCategories(false)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch channels",
+		})
+		return
+	}
+
+	channels := []channelInfo{}
+	for _, category := range categories {
+		channels = append(channels, channelInfo{
+			Slug:        category.Slug,
+			Name:        category.Name,
+			Description: category.Description,
+			MemberCount: wsManager.channelMemberCount(category.Slug),
+		})
+	}
+
+	json.NewEncoder(w).Encode(channels)
+}
+
+// ChannelMessagesHandler serves the history of a channel, newest page
+// first: GET /api/channels/{slug}/messages?before_id=&limit=
+func ChannelMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, isAuth := CheckIfCookieValid(w, r); !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Method not allowed",
+		})
+		return
+	}
+
+	slug, err := resolveChannel(r.PathValue("slug"))
+	if err != nil {
+		if err == errChannelNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Channel not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch messages"})
+		return
+	}
+
+	query := r.URL.Query()
+	beforeID := 0
+	if value := query.Get("before_id"); value != "" {
+		beforeID, err = strconv.Atoi(value)
+		if err != nil || beforeID < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid before_id"})
+			return
+		}
+	}
+
+	limit := channelPageSize
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxChannelPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	messages, err := data.GetChannelMessages(slug, beforeID, limit)
+	if err != nil {
+		log.Printf("Error fetching messages of channel %s: %v", slug, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch messages"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"channel":      slug,
+		"messages":     messages,
+		"hasMore":      len(messages) == limit,
+		"member_count": wsManager.channelMemberCount(slug),
+	})
+}
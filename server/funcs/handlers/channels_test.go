@@ -0,0 +1,45 @@
+package forum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	window := 50 * time.Millisecond
+	l := newRateLimiter(2, window)
+
+	if !l.allow(1) || !l.allow(1) {
+		t.Fatal("events within the limit were rejected")
+	}
+	if l.allow(1) {
+		t.Fatal("an event over the limit was allowed")
+	}
+	if !l.allow(2) {
+		t.Fatal("users share their limits")
+	}
+
+	time.Sleep(window)
+	if !l.allow(1) {
+		t.Fatal("the limit didn't reset after the window")
+	}
+}
+
+func TestRateLimiterForgetsIdleUsers(t *testing.T) {
+	window := 50 * time.Millisecond
+	l := newRateLimiter(5, window)
+
+	for userID := 1; userID <= 100; userID++ {
+		l.allow(userID)
+	}
+	time.Sleep(window)
+
+	// The first event after a window sweeps the idle users
+	l.allow(1000)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) != 1 {
+		t.Errorf("the limiter still tracks %d users, want only the last sender", len(l.events))
+	}
+}
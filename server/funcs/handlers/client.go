@@ -0,0 +1,163 @@
+package forum
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer.
+	pongWait = 60 * time.Second
+	// Pings are sent more often than pongWait so a live peer never times out.
+	pingPeriod = pongWait * 9 / 10
+)
+
+// client is one websocket connection. Gorilla connections support a
+// single concurrent writer, so only writePump writes to conn; everyone
+// else queues frames with enqueue.
+type client struct {
+	userID int
+	token  string
+	conn   *websocket.Conn
+	send   chan []byte
+	// done is closed to stop writePump, which then flushes send and
+	// closes the connection.
+	done      chan struct{}
+	closeOnce sync.Once
+	// stopped is closed once writePump has closed the connection.
+	stopped chan struct{}
+	// topics the client is subscribed to, guarded by the manager's mu.
+	topics map[string]bool
+	// lastHeartbeat is when the peer last answered a ping or sent a
+	// frame, in Unix nanoseconds.
+	lastHeartbeat atomic.Int64
+}
+
+// newClient wraps conn. sendQueueSize frames can be queued for it before
+// it's considered too slow and evicted.
+func newClient(userID int, token string, conn *websocket.Conn, sendQueueSize int) *client {
+	c := &client{
+		userID:  userID,
+		token:   token,
+		conn:    conn,
+		send:    make(chan []byte, sendQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		topics:  make(map[string]bool),
+	}
+	c.heartbeat()
+	return c
+}
+
+// heartbeat records that the peer is alive.
+func (c *client) heartbeat() {
+	c.lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+// silentFor returns how long the peer has been silent.
+func (c *client) silentFor() time.Duration {
+	return time.Since(time.Unix(0, c.lastHeartbeat.Load()))
+}
+
+// enqueue queues a frame without blocking. A client whose buffer is full
+// is too slow to keep up and gets disconnected.
+func (c *client) enqueue(frame []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		log.Printf("Evicting slow websocket client of user %d", c.userID)
+		c.close()
+		return false
+	}
+}
+
+func (c *client) sendMessage(msg WebSocketMessage) bool {
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msg.Type, err)
+		return false
+	}
+	return c.enqueue(frame)
+}
+
+// close stops the client after the queued frames are written.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// writePump writes the queued frames and the keepalive pings to the
+// connection. It's the only goroutine writing to conn.
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		close(c.stopped)
+	}()
+
+	for {
+		select {
+		case frame := <-c.send:
+			if err := c.write(websocket.TextMessage, frame); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.write(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			c.flush()
+			c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// flush writes whatever is still queued.
+func (c *client) flush() {
+	for {
+		select {
+		case frame := <-c.send:
+			if err := c.write(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (c *client) write(messageType int, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// prepareReads sets the largest frame accepted and the deadline that
+// pongs extend, so peers that vanish without a close frame are dropped
+// after pongWait.
+func (c *client) prepareReads(maxMessageSize int64) {
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.heartbeat()
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
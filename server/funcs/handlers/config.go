@@ -0,0 +1,9 @@
+package forum
+
+import config "forum/funcs/config"
+
+// Init points the handlers' WebSocketManager at c, which must be valid.
+// It must be called before serving.
+func Init(c *config.Config) {
+	wsManager = NewWebSocketManager(c)
+}
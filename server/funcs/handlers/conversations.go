@@ -0,0 +1,489 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	data "forum/funcs/database"
+)
+
+const maxGroupMembers = 50
+
+var (
+	errNotConversationMember = errors.New("conversation not found")
+	errNotConversationOwner  = errors.New("only the owner can do this")
+	errNotGroupConversation  = errors.New("direct conversations can't be changed")
+)
+
+// ConversationsHandler serves /api/conversations:
+//
+//	GET ?id=   a conversation with its members
+//	POST       create a group {name, avatar, member_ids}
+//	PATCH ?id= rename a group or change its avatar {name, avatar}, owner only
+func ConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		getConversation(w, r, userID)
+	case http.MethodPost:
+		createGroup(w, r, userID)
+	case http.MethodPatch:
+		updateGroup(w, r, userID)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Method not allowed",
+		})
+	}
+}
+
+func getConversation(w http.ResponseWriter, r *http.Request, userID int) {
+	conversationID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+	if _, err := data.GetConversationRole(conversationID, userID); err != nil {
+		writeConversationError(w, conversationError(err), "Failed to fetch conversation")
+		return
+	}
+
+	conversation, err := data.GetConversation(conversationID)
+	if err != nil {
+		writeConversationError(w, err, "Failed to fetch conversation")
+		return
+	}
+
+	json.NewEncoder(w).Encode(conversation.SeenBy(userID))
+}
+
+func createGroup(w http.ResponseWriter, r *http.Request, userID int) {
+	var request struct {
+		Name      string `json:"name"`
+		Avatar    string `json:"avatar"`
+		MemberIDs []int  `json:"member_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	request.Avatar = strings.TrimSpace(request.Avatar)
+	if errMsg := GroupValidation(request.Name, request.Avatar); errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+		return
+	}
+
+	memberIDs, errMsg := validMemberIDs(request.MemberIDs, userID)
+	if errMsg == "" && len(memberIDs)+1 > maxGroupMembers {
+		errMsg = "Too many members"
+	}
+	if errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+		return
+	}
+
+	conversationID, err := data.CreateGroupConversation(userID, request.Name, request.Avatar, memberIDs)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to create conversation",
+		})
+		return
+	}
+
+	conversation, err := wsManager.publishConversationUpdate(conversationID)
+	if err != nil {
+		writeConversationError(w, err, "Failed to fetch conversation")
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(conversation.SeenBy(userID))
+}
+
+func updateGroup(w http.ResponseWriter, r *http.Request, userID int) {
+	conversationID, _ := strconv.Atoi(r.URL.Query().Get("id"))
+
+	var request struct {
+		Name   string `json:"name"`
+		Avatar string `json:"avatar"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	request.Avatar = strings.TrimSpace(request.Avatar)
+	if errMsg := GroupValidation(request.Name, request.Avatar); errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+		return
+	}
+
+	if err := requireGroupOwner(conversationID, userID); err != nil {
+		writeConversationError(w, err, "Failed to update conversation")
+		return
+	}
+
+	if err := data.UpdateConversation(conversationID, request.Name, request.Avatar); err != nil {
+		writeConversationError(w, err, "Failed to update conversation")
+		return
+	}
+
+	conversation, err := wsManager.publishConversationUpdate(conversationID)
+	if err != nil {
+		writeConversationError(w, err, "Failed to fetch conversation")
+		return
+	}
+
+	json.NewEncoder(w).Encode(conversation.SeenBy(userID))
+}
+
+// InviteHandler adds users to a group: POST {conversation_id, user_ids}.
+// Only the owner can invite.
+func InviteHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ConversationID int   `json:"conversation_id"`
+		UserIDs        []int `json:"user_ids"`
+	}
+	userID, ok := decodeMembershipRequest(w, r, &request)
+	if !ok {
+		return
+	}
+
+	if err := requireGroupOwner(request.ConversationID, userID); err != nil {
+		writeConversationError(w, err, "Failed to invite users")
+		return
+	}
+
+	userIDs, errMsg := validMemberIDs(request.UserIDs, userID)
+	if errMsg == "" && len(userIDs) == 0 {
+		errMsg = "No users to invite"
+	}
+	if errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+		return
+	}
+
+	count, err := data.CountConversationMembers(request.ConversationID)
+	if err != nil {
+		writeConversationError(w, err, "Failed to invite users")
+		return
+	}
+	if count+len(userIDs) > maxGroupMembers {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Too many members"})
+		return
+	}
+
+	added, err := data.AddConversationMembers(request.ConversationID, userIDs)
+	if err != nil {
+		writeConversationError(w, err, "Failed to invite users")
+		return
+	}
+
+	conversation, err := wsManager.publishConversationUpdate(request.ConversationID)
+	if err != nil {
+		writeConversationError(w, err, "Failed to fetch conversation")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"conversation": conversation.SeenBy(userID),
+		"added":        added,
+	})
+}
+
+// LeaveHandler removes the current user from a group: POST {conversation_id}.
+// If the owner leaves, the longest standing member takes over.
+func LeaveHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ConversationID int `json:"conversation_id"`
+	}
+	userID, ok := decodeMembershipRequest(w, r, &request)
+	if !ok {
+		return
+	}
+
+	if err := requireGroupMember(request.ConversationID, userID); err != nil {
+		writeConversationError(w, err, "Failed to leave conversation")
+		return
+	}
+
+	if err := wsManager.removeMember(request.ConversationID, userID); err != nil {
+		writeConversationError(w, err, "Failed to leave conversation")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+	})
+}
+
+// KickHandler removes a member from a group: POST {conversation_id, user_id}.
+// Only the owner can kick.
+func KickHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ConversationID int `json:"conversation_id"`
+		UserID         int `json:"user_id"`
+	}
+	userID, ok := decodeMembershipRequest(w, r, &request)
+	if !ok {
+		return
+	}
+
+	if request.UserID == userID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Use leave to leave a conversation"})
+		return
+	}
+
+	if err := requireGroupOwner(request.ConversationID, userID); err != nil {
+		writeConversationError(w, err, "Failed to remove member")
+		return
+	}
+
+	if _, err := data.GetConversationRole(request.ConversationID, request.UserID); err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "User is not a member"})
+			return
+		}
+		writeConversationError(w, err, "Failed to remove member")
+		return
+	}
+
+	if err := wsManager.removeMember(request.ConversationID, request.UserID); err != nil {
+		writeConversationError(w, err, "Failed to remove member")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+	})
+}
+
+// decodeMembershipRequest checks the method and session of the invite,
+// leave and kick endpoints and decodes their body.
+func decodeMembershipRequest(w http.ResponseWriter, r *http.Request, request interface{}) (int, bool) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return 0, false
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Method not allowed",
+		})
+		return 0, false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request format",
+		})
+		return 0, false
+	}
+
+	return userID, true
+}
+
+func GroupValidation(name, avatar string) string {
+	if length := utf8.RuneCountInString(name); length < 1 || length > 50 {
+		return "Group name must be between 1 and 50 characters"
+	}
+
+	if len(avatar) > 300 {
+		return "Avatar URL is too long"
+	}
+	if avatar != "" && !strings.HasPrefix(avatar, "/") && !strings.HasPrefix(avatar, "https://") {
+		return "Avatar must be a site path or an https URL"
+	}
+
+	return ""
+}
+
+// validMemberIDs dedupes the ids, drops selfID and checks that the users
+// exist and that selfID could message each of them, so a group can't get
+// around a block or DM privacy.
+func validMemberIDs(ids []int, selfID int) ([]int, string) {
+	seen := make(map[int]bool)
+	var valid []int
+	for _, id := range ids {
+		if id == selfID || seen[id] {
+			continue
+		}
+		seen[id] = true
+		if id <= 0 || !data.UserExists(id) {
+			return nil, "Unknown user " + strconv.Itoa(id)
+		}
+		if err := checkCanMessage(selfID, id); err == errCannotMessage {
+			return nil, "You can't add user " + strconv.Itoa(id)
+		} else if err != nil {
+			log.Printf("Error checking whether user %d can message user %d: %v", selfID, id, err)
+			return nil, "Failed to check user " + strconv.Itoa(id)
+		}
+		valid = append(valid, id)
+	}
+	return valid, ""
+}
+
+func requireGroupMember(conversationID, userID int) error {
+	if _, err := data.GetConversationRole(conversationID, userID); err != nil {
+		return conversationError(err)
+	}
+
+	kind, err := data.GetConversationType(conversationID)
+	if err != nil {
+		return err
+	}
+	if kind != data.ConversationGroup {
+		return errNotGroupConversation
+	}
+	return nil
+}
+
+func requireGroupOwner(conversationID, userID int) error {
+	if err := requireGroupMember(conversationID, userID); err != nil {
+		return err
+	}
+
+	role, err := data.GetConversationRole(conversationID, userID)
+	if err != nil {
+		return conversationError(err)
+	}
+	if role != data.RoleOwner {
+		return errNotConversationOwner
+	}
+	return nil
+}
+
+func conversationError(err error) error {
+	if err == sql.ErrNoRows {
+		return errNotConversationMember
+	}
+	return err
+}
+
+func writeConversationError(w http.ResponseWriter, err error, fallback string) {
+	switch err {
+	case errNotConversationMember, sql.ErrNoRows:
+		w.WriteHeader(http.StatusNotFound)
+		err = errNotConversationMember
+	case errNotConversationOwner:
+		w.WriteHeader(http.StatusForbidden)
+	case errNotGroupConversation:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		log.Printf("%s: %v", fallback, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		err = errors.New(fallback)
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": err.Error(),
+	})
+}
+
+// sendToConversation sends msg to every member of a conversation except
+// skipUserID, and returns the members it reached.
+func (wm *WebSocketManager) sendToConversation(conversationID int, msg WebSocketMessage, skipUserID int) ([]int, error) {
+	memberIDs, err := data.GetConversationMemberIDs(conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	var reached []int
+	for _, memberID := range memberIDs {
+		if memberID != skipUserID && wm.sendToUser(memberID, msg) {
+			reached = append(reached, memberID)
+		}
+	}
+	return reached, nil
+}
+
+// publishConversationUpdate sends the conversation, with its members, to
+// each member as they see it, and returns it unfiltered.
+func (wm *WebSocketManager) publishConversationUpdate(conversationID int) (data.ConversationInfo, error) {
+	conversation, err := data.GetConversation(conversationID)
+	if err != nil {
+		return conversation, err
+	}
+
+	for _, member := range conversation.Members {
+		wm.sendToUser(member.UserID, WebSocketMessage{
+			Type:    "conversation_updated",
+			Payload: conversation.SeenBy(member.UserID),
+		})
+	}
+	return conversation, nil
+}
+
+// removeMember removes a user from a group, tells them with a
+// conversation_removed event and the remaining members with
+// conversation_updated.
+func (wm *WebSocketManager) removeMember(conversationID, userID int) error {
+	if _, err := data.RemoveConversationMember(conversationID, userID); err != nil {
+		return conversationError(err)
+	}
+
+	wm.sendToUser(userID, WebSocketMessage{
+		Type:    "conversation_removed",
+		Payload: map[string]int{"conversation_id": conversationID},
+	})
+
+	_, err := wm.publishConversationUpdate(conversationID)
+	return err
+}
+
+// handleGroupMessage stores a message sent to a group and fans it out to
+// the members.
+func (wm *WebSocketManager) handleGroupMessage(senderID, conversationID int, content string) (data.Message, error) {
+	if err := requireGroupMember(conversationID, senderID); err != nil {
+		return data.Message{}, err
+	}
+
+	messageID, err := data.InsertGroupMessage(conversationID, senderID, content)
+	if err != nil {
+		return data.Message{}, err
+	}
+
+	message, err := data.GetMessage(messageID)
+	if err != nil {
+		return data.Message{}, err
+	}
+
+	wm.deliverMessage(message)
+	return message, nil
+}
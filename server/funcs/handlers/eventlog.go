@@ -0,0 +1,123 @@
+package forum
+
+import (
+	"time"
+
+	config "forum/funcs/config"
+)
+
+// Durable events sent to a user get a per-user sequence number in their
+// "seq" field and are kept in a bounded log, so a client that lost its
+// connection can reconnect to /api/ws?last_seq=N and have every event
+// after N replayed. Ephemeral events (typing_status, online_status, topic
+// events) have no seq and aren't replayed.
+//
+// When the events after last_seq are no longer in the log, for example
+// after a restart, the client is sent a resync_required frame instead and
+// should refetch its state over REST. The logs of users who stay
+// disconnected longer than eventLogRetention are dropped.
+
+// eventLogSize must stay below the send queue size so a full replay fits
+// in the client's queue, which config.Validate checks.
+const eventLogSize = config.EventLogSize
+
+// eventLogRetention is how long the log of a user without connections
+// is kept for them to come back.
+const eventLogRetention = 15 * time.Minute
+
+var durableEvents = map[string]bool{
+	"new_message":              true,
+	"message_delivered":        true,
+	"message_read":             true,
+	"message_edited":           true,
+	"message_deleted":          true,
+	"conversation_updated":     true,
+	"conversation_removed":     true,
+	"message_request_accepted": true,
+	"notification":             true,
+	"new_post":                 true,
+}
+
+type loggedEvent struct {
+	seq   int64
+	frame []byte
+}
+
+type eventLog struct {
+	lastSeq int64
+	// events holds the latest events, oldest first.
+	events []loggedEvent
+	// idleSince is when the user was last left without connections.
+	idleSince time.Time
+}
+
+func (l *eventLog) append(seq int64, frame []byte) {
+	l.lastSeq = seq
+	l.events = append(l.events, loggedEvent{seq: seq, frame: frame})
+	if len(l.events) > eventLogSize {
+		l.events = append([]loggedEvent(nil), l.events[len(l.events)-eventLogSize:]...)
+	}
+}
+
+// since returns the frames of the events after seq, and false if some of
+// them were already dropped from the log.
+func (l *eventLog) since(seq int64) ([][]byte, bool) {
+	if seq > l.lastSeq {
+		return nil, false
+	}
+	if len(l.events) > 0 && seq < l.events[0].seq-1 {
+		return nil, false
+	}
+
+	var frames [][]byte
+	for _, event := range l.events {
+		if event.seq > seq {
+			frames = append(frames, event.frame)
+		}
+	}
+	return frames, true
+}
+
+// eventLog returns the log of userID, creating it if needed. It must be
+// called with wm.mu held for writing.
+func (wm *WebSocketManager) eventLog(userID int) *eventLog {
+	l := wm.logs[userID]
+	if l == nil {
+		l = &eventLog{idleSince: time.Now()}
+		wm.logs[userID] = l
+	}
+	return l
+}
+
+// pruneEventLogs drops the logs of the users who have had no connection
+// for eventLogRetention. They get a resync_required frame if they come
+// back with a last_seq.
+func (wm *WebSocketManager) pruneEventLogs(now time.Time) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	for userID, l := range wm.logs {
+		if len(wm.connections[userID]) == 0 && now.Sub(l.idleSince) > eventLogRetention {
+			delete(wm.logs, userID)
+		}
+	}
+}
+
+// replay queues the events c missed after lastSeq, or a resync_required
+// frame when they can't be replayed. It must be called with wm.mu held
+// for writing, so no new event is logged in between.
+func (wm *WebSocketManager) replay(c *client, lastSeq int64) {
+	l := wm.eventLog(c.userID)
+	frames, ok := l.since(lastSeq)
+	if !ok {
+		c.sendMessage(WebSocketMessage{
+			Type:    "resync_required",
+			Payload: map[string]int64{"seq": l.lastSeq},
+		})
+		return
+	}
+
+	for _, frame := range frames {
+		c.enqueue(frame)
+	}
+}
@@ -0,0 +1,156 @@
+package forum
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventLogSince(t *testing.T) {
+	l := &eventLog{}
+	for seq := int64(1); seq <= eventLogSize+10; seq++ {
+		l.append(seq, []byte(fmt.Sprint(seq)))
+	}
+	if len(l.events) != eventLogSize {
+		t.Fatalf("the log holds %d events, want %d", len(l.events), eventLogSize)
+	}
+
+	tests := []struct {
+		seq    int64
+		want   int
+		wantOK bool
+	}{
+		{seq: eventLogSize + 10, want: 0, wantOK: true},
+		{seq: eventLogSize + 5, want: 5, wantOK: true},
+		{seq: 10, want: eventLogSize, wantOK: true},
+		// Event 10 was dropped
+		{seq: 9, wantOK: false},
+		// A seq from before a restart
+		{seq: eventLogSize + 11, wantOK: false},
+	}
+	for _, tt := range tests {
+		frames, ok := l.since(tt.seq)
+		if ok != tt.wantOK || len(frames) != tt.want {
+			t.Errorf("since(%d): %d frames, %v; want %d, %v", tt.seq, len(frames), ok, tt.want, tt.wantOK)
+		}
+		if ok && len(frames) > 0 && string(frames[0]) != fmt.Sprint(tt.seq+1) {
+			t.Errorf("since(%d) starts at %s", tt.seq, frames[0])
+		}
+	}
+}
+
+// dialWithSeq connects with token, asking for the events after lastSeq.
+func dialWithSeq(t *testing.T, server *httptest.Server, token string, lastSeq int64) *testClient {
+	t.Helper()
+	return dialTestURL(t, fmt.Sprintf("ws%s?last_seq=%d", strings.TrimPrefix(server.URL, "http"), lastSeq), token)
+}
+
+// TestDisconnectDuringSend drops a connection while events are being sent
+// to it and checks that reconnecting with the last seq seen delivers
+// every event exactly once.
+func TestDisconnectDuringSend(t *testing.T) {
+	const events = 100
+
+	server := newTestServer(t)
+	userID, token := newTestUser(t)
+	first := dialTestClient(t, server, token)
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 1; i <= events; i++ {
+			wsManager.sendToUser(userID, WebSocketMessage{Type: "notification", Payload: i})
+			if i%10 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}()
+
+	// Hang up after some of the events
+	seen := make(map[int64]bool)
+	var lastSeq int64
+	for len(seen) < events/4 {
+		frame := first.expect("notification")
+		seen[frame.Seq] = true
+		lastSeq = frame.Seq
+	}
+	first.conn.Close()
+	for frame := range first.frames {
+		if frame.Type == "notification" {
+			seen[frame.Seq] = true
+			lastSeq = frame.Seq
+		}
+	}
+	<-sent
+
+	second := dialWithSeq(t, server, token, lastSeq)
+	for lastSeq < events {
+		frame := second.expect("notification")
+		if seen[frame.Seq] {
+			t.Fatalf("event %d was delivered twice", frame.Seq)
+		}
+		if frame.Seq != lastSeq+1 {
+			t.Fatalf("got event %d after %d", frame.Seq, lastSeq)
+		}
+		seen[frame.Seq] = true
+		lastSeq = frame.Seq
+	}
+	if len(seen) != events {
+		t.Errorf("got %d events, want %d", len(seen), events)
+	}
+	second.expectNone("notification")
+}
+
+// TestEventLogsOfDisconnectedUsersExpire checks that the logs of users
+// gone for longer than eventLogRetention are dropped, and that they are
+// asked to resync when they come back.
+func TestEventLogsOfDisconnectedUsersExpire(t *testing.T) {
+	server := newTestServer(t)
+	onlineID, onlineToken := newTestUser(t)
+	goneID, goneToken := newTestUser(t)
+
+	online := dialTestClient(t, server, onlineToken)
+	gone := dialTestClient(t, server, goneToken)
+	wsManager.sendToUser(onlineID, WebSocketMessage{Type: "notification", Payload: "hi"})
+	wsManager.sendToUser(goneID, WebSocketMessage{Type: "notification", Payload: "hi"})
+	online.expect("notification")
+	lastSeq := gone.expect("notification").Seq
+
+	gone.conn.Close()
+	for range gone.frames {
+	}
+	// The server notices the disconnect on its own
+	deadline := time.Now().Add(5 * time.Second)
+	for wsManager.isOnline(goneID) {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection wasn't removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Events sent while away are kept for a while
+	wsManager.sendToUser(goneID, WebSocketMessage{Type: "notification", Payload: "missed"})
+
+	hasLog := func(userID int) bool {
+		wsManager.mu.RLock()
+		defer wsManager.mu.RUnlock()
+		return wsManager.logs[userID] != nil
+	}
+
+	wsManager.pruneEventLogs(time.Now())
+	if !hasLog(goneID) {
+		t.Fatal("the log was dropped before eventLogRetention")
+	}
+
+	wsManager.pruneEventLogs(time.Now().Add(eventLogRetention + time.Second))
+	if hasLog(goneID) {
+		t.Error("the log of the disconnected user was kept")
+	}
+	if !hasLog(onlineID) {
+		t.Error("the log of the connected user was dropped")
+	}
+
+	back := dialWithSeq(t, server, goneToken, lastSeq)
+	back.expect("resync_required")
+}
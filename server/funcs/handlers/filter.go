@@ -3,78 +3,189 @@ package forum
 import (
 	"database/sql"
 	"encoding/json"
+	config "forum/funcs/config"
 	data "forum/funcs/database"
 	types "forum/funcs/types"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func FilterHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func FilterHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-	filter := strings.ToLower(r.URL.Query().Get("type"))
-	offset := r.URL.Query().Get("offset")
+		userID := 0
+		if cookie, err := r.Cookie("Token"); err == nil {
+			userID, _ = data.GetUserIDFromToken(cookie.Value)
+		}
 
-	if filter != "" && !data.AllCategories[strings.ToLower(filter)] &&
-		filter != "created" && filter != "liked" {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid filter type",
-		})
-		return
+		opts, errMsg := parseFeedFilters(r.URL.Query())
+		if errMsg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": errMsg,
+			})
+			return
+		}
+
+		if (opts.CreatedByMe || opts.LikedByMe || opts.Following) && userID == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Authentication required for this filter",
+			})
+			return
+		}
+
+		opts.UserID = userID
+		opts.Limit = cfg.PostsPageSize
+
+		query, args := data.BuildPostQuery(opts)
+		posts, err := data.GetPosts(userID, cfg.ImagesDir, query, args...)
+
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("Error getting posts:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to fetch posts",
+			})
+			return
+		}
+
+		response := struct {
+			Posts      []types.POST `json:"posts"`
+			IsLoggedIn bool         `json:"isLoggedIn"`
+			HasMore    bool         `json:"hasMore"`
+			AsOf       time.Time    `json:"asOf"`
+		}{
+			Posts:      posts,
+			IsLoggedIn: userID > 0,
+			HasMore:    len(posts) == opts.Limit,
+			AsOf:       opts.AsOf,
+		}
+
+		err = json.NewEncoder(w).Encode(response)
+		if err != nil {
+			log.Println("Error encoding response:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+// parseFeedFilters reads the feed filters from the query string:
+//
+//	type=created|liked|following|<category>  the original single filter
+//	category=news&category=tech    any of these categories (or comma separated)
+//	author=<username>
+//	liked=1, created=1             posts I liked / wrote
+//	following=1                    posts from users I follow
+//	from=YYYY-MM-DD, to=YYYY-MM-DD
+//	has_image=1
+//	sort=new|old|top|hot|comments, window=day|week|month|all
+//	as_of=<RFC 3339 time>          the asOf of the first page, for the next ones
+//	offset=<n>
+//
+// and returns an error message when one of them is invalid.
+func parseFeedFilters(q url.Values) (types.QueryOptions, string) {
+	var opts types.QueryOptions
+
+	switch filter := strings.ToLower(q.Get("type")); filter {
+	case "":
+	case "created":
+		opts.CreatedByMe = true
+	case "liked":
+		opts.LikedByMe = true
+	case "following":
+		opts.Following = true
+	default:
+		opts.Categories = append(opts.Categories, filter)
+	}
+
+	for _, value := range q["category"] {
+		for _, category := range strings.Split(value, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				opts.Categories = append(opts.Categories, strings.ToLower(category))
+			}
+		}
 	}
 
-	userID := 0
-	if cookie, err := r.Cookie("Token"); err == nil {
-		userID, _ = data.GetUserIDFromToken(cookie.Value)
+	for _, category := range opts.Categories {
+		if _, err := data.ResolveCategory(category); err != nil {
+			return opts, "Invalid filter type"
+		}
 	}
 
-	if (filter == "created" || filter == "liked") && userID == 0 {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Authentication required for this filter",
-		})
-		return
+	opts.Author = strings.ToLower(strings.TrimSpace(q.Get("author")))
+	opts.LikedByMe = opts.LikedByMe || isTrue(q.Get("liked"))
+	opts.CreatedByMe = opts.CreatedByMe || isTrue(q.Get("created"))
+	opts.Following = opts.Following || isTrue(q.Get("following"))
+	opts.HasImage = isTrue(q.Get("has_image"))
+
+	opts.From = q.Get("from")
+	opts.To = q.Get("to")
+	if !isDate(opts.From) || !isDate(opts.To) {
+		return opts, "Dates must use the YYYY-MM-DD format"
+	}
+
+	if opts.From != "" && opts.To != "" && opts.From > opts.To {
+		return opts, "The start date must be before the end date"
 	}
 
-	// Parse offset
-	offsetInt := 0
-	if offset != "" {
-		offsetInt, _ = strconv.Atoi(offset)
+	if errMsg := parseFeedSort(q, &opts); errMsg != "" {
+		return opts, errMsg
 	}
 
-	opts := types.QueryOptions{
-		UserID: userID,
-		Filter: filter,
-		Limit:  4,
-		Offset: offsetInt,
+	if offset := q.Get("offset"); offset != "" {
+		opts.Offset, _ = strconv.Atoi(offset)
 	}
 
-	query, args := data.BuildPostQuery(opts)
-	posts, err := data.GetPosts(userID, query, args...)
+	return opts, ""
+}
+
+// parseFeedSort reads the sort mode, time window and as_of of a feed. The
+// first page is pinned to now; the client passes the asOf it got back
+// with the next pages so scores and windows don't move under the offset.
+func parseFeedSort(q url.Values, opts *types.QueryOptions) string {
+	opts.Sort = strings.ToLower(q.Get("sort"))
+	if opts.Sort == "" {
+		opts.Sort = "new"
+	}
+	if !data.IsFeedSort(opts.Sort) {
+		return "Invalid sort mode"
+	}
 
-	if err != nil && err != sql.ErrNoRows {
-		log.Println("Error getting posts:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to fetch posts",
-		})
-		return
+	opts.Window = strings.ToLower(q.Get("window"))
+	if opts.Window == "" {
+		opts.Window = "all"
+	}
+	if !data.IsFeedWindow(opts.Window) {
+		return "Invalid time window"
 	}
 
-	response := struct {
-		Posts      []types.POST `json:"posts"`
-		IsLoggedIn bool         `json:"isLoggedIn"`
-	}{
-		Posts:      posts,
-		IsLoggedIn: userID > 0,
+	opts.AsOf = time.Now().UTC().Truncate(time.Second)
+	if value := q.Get("as_of"); value != "" {
+		asOf, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return "as_of must be an RFC 3339 time"
+		}
+		opts.AsOf = asOf.UTC()
 	}
 
-	err = json.NewEncoder(w).Encode(response)
-	if err != nil {
-		log.Println("Error encoding response:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	return ""
+}
+
+func isDate(value string) bool {
+	if value == "" {
+		return true
 	}
+	_, err := time.Parse("2006-01-02", value)
+	return err == nil
+}
+
+func isTrue(value string) bool {
+	b, _ := strconv.ParseBool(value)
+	return b
 }
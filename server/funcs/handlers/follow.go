@@ -0,0 +1,185 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	data "forum/funcs/database"
+)
+
+// FollowHandler follows (POST {"user_id": n}) or unfollows
+// (DELETE ?user_id=n) another user.
+func FollowHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		var request struct {
+			UserID int `json:"user_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID"})
+			return
+		}
+
+		if request.UserID == userID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "You can't follow yourself"})
+			return
+		}
+
+		if !data.UserExists(request.UserID) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+			return
+		}
+
+		if data.IsBlockedEither(userID, request.UserID) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "You can't follow this user"})
+			return
+		}
+
+		created, err := data.Follow(userID, request.UserID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to follow user"})
+			return
+		}
+
+		if created {
+			go notify(request.UserID, userID, "new_follower", "new_follower", map[string]interface{}{
+				"user_id": userID,
+			})
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	case http.MethodDelete:
+		followeeID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil || followeeID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID"})
+			return
+		}
+
+		if err := data.Unfollow(userID, followeeID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to unfollow user"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// ProfileHandler returns a user's profile with their first followers and
+// followed users: /api/profile?user_id=n (defaults to the current user).
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	viewerID, _ := CheckIfCookieValid(w, r)
+
+	userID := viewerID
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		userID, _ = strconv.Atoi(value)
+	}
+	if userID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID"})
+		return
+	}
+
+	profile, err := data.GetProfile(userID, viewerID, 10)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch profile"})
+		return
+	}
+
+	presence := wsManager.presenceFor(viewerID, userID)
+	profile.IsOnline = presence.IsOnline
+	profile.Status = presence.Status
+	profile.StatusText = presence.StatusText
+	profile.LastSeen = presence.LastSeen
+	// Users see the status they picked, even invisible
+	if viewerID == userID {
+		if own, err := data.GetPresence(userID); err == nil {
+			profile.Status = own.Status
+			profile.StatusText = own.StatusText
+		}
+	}
+
+	json.NewEncoder(w).Encode(profile)
+}
+
+// FollowersHandler pages through a user's followers.
+func FollowersHandler(w http.ResponseWriter, r *http.Request) {
+	followList(w, r, data.GetFollowers)
+}
+
+// FollowingHandler pages through the users a user follows.
+func FollowingHandler(w http.ResponseWriter, r *http.Request) {
+	followList(w, r, data.GetFollowing)
+}
+
+func followList(w http.ResponseWriter, r *http.Request, list func(userID, limit, offset int) ([]data.FollowUser, error)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user ID"})
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit := 20
+
+	users, err := list(userID, limit, offset)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch users"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":   users,
+		"hasMore": len(users) == limit,
+	})
+}
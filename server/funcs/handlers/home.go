@@ -3,74 +3,91 @@ package forum
 import (
 	"database/sql"
 	"encoding/json"
+	config "forum/funcs/config"
 	data "forum/funcs/database"
 	types "forum/funcs/types"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-func Home(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func Home(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
 
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
-		return
-	}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+			return
+		}
 
-	// Get user ID from cookie if exists
-	userID := 0
-	if c, err := r.Cookie("Token"); err == nil {
-		userID, _ = data.GetUserIDFromToken(c.Value)
-	}
+		// Get user ID from cookie if exists
+		userID := 0
+		if c, err := r.Cookie("Token"); err == nil {
+			userID, _ = data.GetUserIDFromToken(c.Value)
+		}
 
-	// Get pagination parameters
-	offset := 0
-	limit := 4
-	if offsetParam := r.URL.Query().Get("offset"); offsetParam != "" {
-		if parsedOffset, err := strconv.Atoi(offsetParam); err == nil {
-			offset = parsedOffset
+		// Get pagination parameters
+		offset := 0
+		limit := cfg.PostsPageSize
+		if offsetParam := r.URL.Query().Get("offset"); offsetParam != "" {
+			if parsedOffset, err := strconv.Atoi(offsetParam); err == nil {
+				offset = parsedOffset
+			}
 		}
-	}
 
-	// Get filter type if exists
-	filterType := r.URL.Query().Get("type")
+		// Get filter type if exists
+		filterType := r.URL.Query().Get("type")
 
-	opts := types.QueryOptions{
-		UserID: userID,
-		Limit:  limit,
-		Offset: offset,
-		Filter: filterType,
-	}
+		opts := types.QueryOptions{
+			UserID: userID,
+			Limit:  limit,
+			Offset: offset,
+			Filter: filterType,
+		}
 
-	query, args := data.BuildPostQuery(opts)
-	posts, err := data.GetPosts(userID, query, args...)
-	if err != nil && err != sql.ErrNoRows {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch posts"})
-		return
-	}
+		if errMsg := parseFeedSort(r.URL.Query(), &opts); errMsg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": errMsg})
+			return
+		}
 
-	// Only include categories in initial load (offset = 0)
-	var categories []string
-	if offset == 0 {
-		categories = DefaultCategories
-	}
+		query, args := data.BuildPostQuery(opts)
+		posts, err := data.GetPosts(userID, cfg.ImagesDir, query, args...)
+		if err != nil && err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch posts"})
+			return
+		}
 
-	response := struct {
-		Posts      []types.POST `json:"posts"`
-		IsLoggedIn bool         `json:"isLoggedIn"`
-		Categories []string     `json:"categories,omitempty"`
-		HasMore    bool         `json:"hasMore"`
-	}{
-		Posts:      posts,
-		IsLoggedIn: userID > 0,
-		Categories: categories,
-		HasMore:    len(posts) == limit,
-	}
+		// Only include categories in initial load (offset = 0)
+		var categories []string
+		if offset == 0 {
+			categories, err = data.GetCategoryNames()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch categories"})
+				return
+			}
+		}
+
+		response := struct {
+			Posts      []types.POST `json:"posts"`
+			IsLoggedIn bool         `json:"isLoggedIn"`
+			Categories []string     `json:"categories,omitempty"`
+			HasMore    bool         `json:"hasMore"`
+			AsOf       time.Time    `json:"asOf"`
+		}{
+			Posts:      posts,
+			IsLoggedIn: userID > 0,
+			Categories: categories,
+			HasMore:    len(posts) == limit,
+			AsOf:       opts.AsOf,
+		}
 
-	if err = json.NewEncoder(w).Encode(response); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		if err = json.NewEncoder(w).Encode(response); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		}
 	}
 }
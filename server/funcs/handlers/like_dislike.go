@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	data "forum/funcs/database"
 	"net/http"
+	"strconv"
 )
 
 func HandleLikeDislike(w http.ResponseWriter, r *http.Request) {
@@ -34,7 +35,7 @@ func HandleLikeDislike(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := data.AddInteractions(user_id, commentid, action, types)
+	interaction, err := data.AddInteractions(user_id, commentid, action, types)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -42,4 +43,11 @@ func HandleLikeDislike(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+
+	if targetID, err := strconv.Atoi(commentid); err == nil {
+		go publishReactionUpdated(types, targetID)
+		if interaction == 1 {
+			go notifyLike(user_id, types, targetID)
+		}
+	}
 }
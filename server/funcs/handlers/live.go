@@ -0,0 +1,65 @@
+package forum
+
+import (
+	"log"
+	"strconv"
+
+	data "forum/funcs/database"
+	types "forum/funcs/types"
+)
+
+// publishPostCreated sends a new post to the feed subscribers and to the
+// subscribers of its categories.
+func (wm *WebSocketManager) publishPostCreated(postID int, categories []string) {
+	query, args := data.BuildPostQuery(types.QueryOptions{PostID: strconv.Itoa(postID)})
+	posts, err := data.GetPosts(0, wm.cfg.ImagesDir, query, args...)
+	if err != nil || len(posts) == 0 {
+		log.Printf("Error fetching created post %d: %v", postID, err)
+		return
+	}
+
+	topics := []string{"feed"}
+	for _, slug := range categories {
+		topics = append(topics, categoryTopic(slug))
+	}
+
+	wm.publishAbout(posts[0].USER_ID, WebSocketMessage{
+		Type:    "post_created",
+		Payload: posts[0],
+	}, topics...)
+}
+
+// publishCommentCreated sends a new comment to the subscribers of its post.
+func publishCommentCreated(postID int, comment types.COMMENT) {
+	wsManager.publishAbout(comment.USER_ID, WebSocketMessage{
+		Type: "comment_created",
+		Payload: map[string]interface{}{
+			"post_id": postID,
+			"comment": comment,
+		},
+	}, postTopic(postID))
+}
+
+// publishReactionUpdated sends the new like and dislike counts of a post
+// or comment to the subscribers of the post.
+func publishReactionUpdated(kind string, targetID int) {
+	postID := targetID
+	if kind == "comment" {
+		var err error
+		if _, postID, err = data.GetCommentAuthor(targetID); err != nil {
+			return
+		}
+	}
+
+	likes, dislikes := data.GetReactionCounts(kind, targetID)
+	wsManager.publish(WebSocketMessage{
+		Type: "reaction_updated",
+		Payload: map[string]interface{}{
+			"post_id":  postID,
+			"type":     kind,
+			"id":       targetID,
+			"likes":    likes,
+			"dislikes": dislikes,
+		},
+	}, postTopic(postID))
+}
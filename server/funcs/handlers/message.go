@@ -2,61 +2,105 @@ package forum
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
+	config "forum/funcs/config"
 	data "forum/funcs/database"
 )
 
-func MessagingHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func MessagingHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check authentication
+		userID, isAuth := CheckIfCookieValid(w, r)
+		if !isAuth {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Authentication required",
+			})
+			return
+		}
 
-	// Check authentication
-	userID, isAuth := CheckIfCookieValid(w, r)
-	if !isAuth {
-		w.WriteHeader(http.StatusUnauthorized)
+		switch r.Method {
+		case http.MethodGet:
+			// Get conversations or messages
+			if chatID := r.URL.Query().Get("chat_id"); chatID != "" {
+				getMessages(w, r, userID, chatID, cfg.MessagesPageSize)
+			} else if conversationID := r.URL.Query().Get("conversation_id"); conversationID != "" {
+				getGroupMessages(w, r, userID, conversationID, cfg.MessagesPageSize)
+			} else if messageID := r.URL.Query().Get("message_id"); messageID != "" {
+				getMessageHistory(w, userID, messageID)
+			} else {
+				getConversations(w, userID)
+			}
+		case http.MethodPost:
+			// Send new message
+			sendMessage(w, r, userID)
+		case http.MethodPatch:
+			editMessage(w, r, userID)
+		case http.MethodDelete:
+			deleteMessage(w, r, userID)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Method not allowed",
+			})
+		}
+
+	}
+}
+
+// getMessages retrieves messages for a specific chat
+func getMessages(w http.ResponseWriter, r *http.Request, userID int, chatID string, limit int) {
+	otherUserID, err := strconv.Atoi(chatID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Authentication required",
+			"error": "Invalid chat ID",
 		})
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		// Get conversations or messages
-		if chatID := r.URL.Query().Get("chat_id"); chatID != "" {
-			getMessages(w, r, userID, chatID)
-		} else {
-			getConversations(w, userID)
-		}
-	case http.MethodPost:
-		// Send new message
-		sendMessage(w, r, userID)
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	// Get pagination parameters
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+
+	messages, err := data.GetMessages(userID, otherUserID, limit, offset)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Method not allowed",
+			"error": "Failed to fetch messages",
 		})
+		return
 	}
 
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages": messages,
+		"hasMore":  len(messages) == limit,
+	})
 }
 
-// getMessages retrieves messages for a specific chat
-func getMessages(w http.ResponseWriter, r *http.Request, userID int, chatID string) {
-	otherUserID, err := strconv.Atoi(chatID)
+// getGroupMessages retrieves messages of a group the user is a member of
+func getGroupMessages(w http.ResponseWriter, r *http.Request, userID int, conversationIDParam string, limit int) {
+	conversationID, err := strconv.Atoi(conversationIDParam)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Invalid chat ID",
+			"error": "Invalid conversation ID",
 		})
 		return
 	}
 
-	// Get pagination parameters
+	if _, err := data.GetConversationRole(conversationID, userID); err != nil {
+		writeConversationError(w, conversationError(err), "Failed to fetch messages")
+		return
+	}
+
 	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
-	limit := 10
 
-	messages, err := data.GetMessages(userID, otherUserID, limit, offset)
+	messages, err := data.GetConversationMessages(conversationID, limit, offset)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -71,7 +115,8 @@ func getMessages(w http.ResponseWriter, r *http.Request, userID int, chatID stri
 	})
 }
 
-// getConversations retrieves all conversations for the user
+// getConversations retrieves the conversations and message requests of
+// the user. Other users are found through /api/users.
 func getConversations(w http.ResponseWriter, userID int) {
 	// Get conversations with messages
 	conversations, err := data.GetConversations(userID)
@@ -83,22 +128,22 @@ func getConversations(w http.ResponseWriter, userID int) {
 		return
 	}
 
-	// Get new users (without messages) in alphabetical order
-	newUsers, err := data.GetNewUsers(userID)
+	// Get message requests from users who never talked to us
+	requests, err := data.GetMessageRequests(userID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
-			"error": "Failed to fetch new users",
+			"error": "Failed to fetch message requests",
 		})
 		return
 	}
 
 	response := struct {
 		Conversations []data.Conversation `json:"conversations"`
-		NewUsers      []data.Conversation `json:"newUsers"`
+		Requests      []data.Conversation `json:"requests"`
 	}{
 		Conversations: conversations,
-		NewUsers:      newUsers,
+		Requests:      requests,
 	}
 
 	json.NewEncoder(w).Encode(response)
@@ -109,8 +154,10 @@ func sendMessage(w http.ResponseWriter, r *http.Request, senderID int) {
 	
 	// Parse request body
 	var msgRequest struct {
-		ReceiverID int    `json:"receiver_id"`
-		Content    string `json:"content"`
+		ReceiverID int `json:"receiver_id"`
+		// Set instead of ReceiverID for group messages
+		ConversationID int    `json:"conversation_id"`
+		Content        string `json:"content"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&msgRequest); err != nil {
@@ -130,6 +177,21 @@ func sendMessage(w http.ResponseWriter, r *http.Request, senderID int) {
 		return
 	}
 
+	if msgRequest.ConversationID > 0 {
+		message, err := wsManager.handleGroupMessage(senderID, msgRequest.ConversationID, msgRequest.Content)
+		if err != nil {
+			writeConversationError(w, err, "Failed to send message")
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": message,
+			"id":      message.ID,
+			"status":  "success",
+		})
+		return
+	}
+
 	if msgRequest.ReceiverID <= 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -138,6 +200,29 @@ func sendMessage(w http.ResponseWriter, r *http.Request, senderID int) {
 		return
 	}
 
+	if !data.UserExists(msgRequest.ReceiverID) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Receiver not found",
+		})
+		return
+	}
+
+	if err := checkCanMessage(senderID, msgRequest.ReceiverID); err != nil {
+		if err == errCannotMessage {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			err = errors.New("Failed to send message")
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	wsManager.acceptOnReply(senderID, msgRequest.ReceiverID)
+
 	// Insert message
 	messageID, err := data.InsertMessage(senderID, msgRequest.ReceiverID, msgRequest.Content)
 	if err != nil {
@@ -149,8 +234,8 @@ func sendMessage(w http.ResponseWriter, r *http.Request, senderID int) {
 	}
 
 	// Get the complete message details to return
-	messages, err := data.GetMessages(senderID, msgRequest.ReceiverID, 1, 0)
-	if err != nil || len(messages) == 0 {
+	message, err := data.GetMessage(messageID)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
 			"error": "Failed to fetch sent message",
@@ -158,8 +243,10 @@ func sendMessage(w http.ResponseWriter, r *http.Request, senderID int) {
 		return
 	}
 
+	go wsManager.deliverMessage(message)
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": messages[0],
+		"message": message,
 		"id":      messageID,
 		"status":  "success",
 	})
@@ -217,6 +304,10 @@ func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse request body
 	var request struct {
 		SenderID int `json:"sender_id"`
+		// Set instead of SenderID to mark a group read
+		ConversationID int `json:"conversation_id"`
+		// Optional, the last message read. Defaults to the latest one.
+		MessageID int `json:"message_id"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -227,8 +318,27 @@ func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Mark messages as read
-	err := data.MarkMessagesAsRead(userID, request.SenderID)
+	if request.ConversationID > 0 {
+		if err := requireGroupMember(request.ConversationID, userID); err != nil {
+			writeConversationError(w, err, "Failed to mark messages as read")
+			return
+		}
+		if _, err := data.MarkConversationRead(userID, request.ConversationID, request.MessageID); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "Failed to mark messages as read",
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+		return
+	}
+
+	// Mark messages as read and tell the sender
+	messageIDs, err := wsManager.markMessagesRead(userID, request.SenderID, request.MessageID)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{
@@ -237,7 +347,122 @@ func MarkMessagesAsReadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "success",
+		"message_ids": messageIDs,
+	})
+}
+
+// editMessage handles PATCH /api/messages with {message_id, content}.
+func editMessage(w http.ResponseWriter, r *http.Request, userID int) {
+	var request struct {
+		MessageID int    `json:"message_id"`
+		Content   string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.MessageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	content, err := validateMessageContent(request.Content)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	message, err := wsManager.editMessage(userID, request.MessageID, content)
+	if err != nil {
+		writeMessageChangeError(w, err, "Failed to edit message")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"status":  "success",
+	})
+}
+
+// deleteMessage handles DELETE /api/messages?message_id=
+func deleteMessage(w http.ResponseWriter, r *http.Request, userID int) {
+	messageID, err := strconv.Atoi(r.URL.Query().Get("message_id"))
+	if err != nil || messageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid message ID",
+		})
+		return
+	}
+
+	message, err := wsManager.deleteMessage(userID, messageID)
+	if err != nil {
+		writeMessageChangeError(w, err, "Failed to delete message")
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"status":  "success",
+	})
+}
+
+func writeMessageChangeError(w http.ResponseWriter, err error, fallback string) {
+	switch err {
+	case errMessageNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case errNotMessageSender, errEditWindowClosed:
+		w.WriteHeader(http.StatusForbidden)
+	case errMessageDeleted:
+		w.WriteHeader(http.StatusGone)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		err = errors.New(fallback)
+	}
 	json.NewEncoder(w).Encode(map[string]string{
-		"status": "success",
+		"error": err.Error(),
+	})
+}
+
+// getMessageHistory returns a message with its previous contents, to
+// the members of its conversation.
+func getMessageHistory(w http.ResponseWriter, userID int, messageIDParam string) {
+	messageID, err := strconv.Atoi(messageIDParam)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid message ID",
+		})
+		return
+	}
+
+	message, err := data.GetMessage(messageID)
+	if err == nil && message.SenderID != userID {
+		_, err = data.GetConversationRole(message.ConversationID, userID)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Message not found",
+		})
+		return
+	}
+
+	edits, err := data.GetMessageEdits(messageID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch message history",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"edits":   edits,
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,101 @@
+package forum
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	data "forum/funcs/database"
+)
+
+var (
+	errMessageNotFound  = errors.New("message not found")
+	errNotMessageSender = errors.New("only the sender can change a message")
+	errEditWindowClosed = errors.New("the message can no longer be changed")
+	errMessageDeleted   = errors.New("the message was deleted")
+)
+
+// changeableMessage returns the message if userID may still edit or
+// delete it.
+func (wm *WebSocketManager) changeableMessage(userID, messageID int) (data.Message, error) {
+	message, err := data.GetMessage(messageID)
+	if err == sql.ErrNoRows {
+		return data.Message{}, errMessageNotFound
+	}
+	if err != nil {
+		return data.Message{}, err
+	}
+
+	switch {
+	case message.SenderID != userID:
+		// Don't tell other users whether the message exists
+		if _, err := data.GetConversationRole(message.ConversationID, userID); err != nil {
+			return data.Message{}, errMessageNotFound
+		}
+		return data.Message{}, errNotMessageSender
+	case message.IsDeleted:
+		return data.Message{}, errMessageDeleted
+	case time.Since(message.SentAt) > wm.cfg.MessageEditWindow:
+		return data.Message{}, errEditWindowClosed
+	}
+	return message, nil
+}
+
+// editMessage replaces the content of one of userID's messages and pushes
+// a message_edited event to the members of its conversation.
+func (wm *WebSocketManager) editMessage(userID, messageID int, content string) (data.Message, error) {
+	if _, err := wm.changeableMessage(userID, messageID); err != nil {
+		return data.Message{}, err
+	}
+
+	if err := data.EditMessage(messageID, content); err == sql.ErrNoRows {
+		return data.Message{}, errMessageDeleted
+	} else if err != nil {
+		return data.Message{}, err
+	}
+
+	return wm.publishMessageChange("message_edited", messageID)
+}
+
+// deleteMessage leaves a tombstone in place of one of userID's messages
+// and pushes a message_deleted event to the members of its conversation.
+func (wm *WebSocketManager) deleteMessage(userID, messageID int) (data.Message, error) {
+	if _, err := wm.changeableMessage(userID, messageID); err != nil {
+		return data.Message{}, err
+	}
+
+	if err := data.DeleteMessage(messageID); err == sql.ErrNoRows {
+		return data.Message{}, errMessageDeleted
+	} else if err != nil {
+		return data.Message{}, err
+	}
+
+	return wm.publishMessageChange("message_deleted", messageID)
+}
+
+func (wm *WebSocketManager) publishMessageChange(eventType string, messageID int) (data.Message, error) {
+	message, err := data.GetMessage(messageID)
+	if err != nil {
+		return data.Message{}, err
+	}
+
+	if _, err := wm.sendToConversation(message.ConversationID, WebSocketMessage{
+		Type:    eventType,
+		Payload: message,
+	}, 0); err != nil {
+		log.Printf("Error publishing %s of message %d: %v", eventType, messageID, err)
+	}
+	return message, nil
+}
+
+// messageChangeError maps the edit and delete errors to protocol errors.
+func messageChangeError(err error) error {
+	switch err {
+	case errMessageNotFound, errMessageDeleted:
+		return newProtocolError(errCodeNotFound, "%v", err)
+	case errNotMessageSender, errEditWindowClosed:
+		return newProtocolError(errCodeForbidden, "%v", err)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	data "forum/funcs/database"
+)
+
+// MessageRequestsHandler lists the message requests sent to the current
+// user (GET) or answers one (POST {"conversation_id": n, "action": a}),
+// where the action is accept, decline or block. Blocking also declines.
+func MessageRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		requests, err := data.GetMessageRequests(userID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch message requests"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"requests": requests,
+		})
+	case http.MethodPost:
+		var request struct {
+			ConversationID int    `json:"conversation_id"`
+			Action         string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.ConversationID <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+			return
+		}
+
+		status := data.RequestDeclined
+		switch request.Action {
+		case "accept":
+			status = data.RequestAccepted
+		case "decline", "block":
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "action must be accept, decline or block"})
+			return
+		}
+
+		_, requesterID, err := data.GetRequestStatus(request.ConversationID)
+		if err == nil {
+			err = data.SetRequestStatus(request.ConversationID, userID, status)
+		}
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Message request not found"})
+			return
+		}
+		if err == nil && request.Action == "block" {
+			err = data.Block(userID, requesterID)
+		}
+		if err != nil {
+			log.Printf("Error answering message request %d: %v", request.ConversationID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to answer message request"})
+			return
+		}
+
+		if status == data.RequestAccepted {
+			wsManager.requestAccepted(request.ConversationID, userID, requesterID)
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// acceptOnReply accepts the request receiverID sent senderID, if any,
+// since replying to a request accepts it.
+func (wm *WebSocketManager) acceptOnReply(senderID, receiverID int) {
+	conversationID, err := data.AcceptRequestFrom(senderID, receiverID)
+	if err != nil {
+		log.Printf("Error accepting message request of user %d: %v", receiverID, err)
+		return
+	}
+	if conversationID > 0 {
+		wm.requestAccepted(conversationID, senderID, receiverID)
+	}
+}
+
+// requestAccepted tells the requester their request was accepted, and
+// sends them what was held back until then: the delivery receipts and
+// the recipient's online status.
+func (wm *WebSocketManager) requestAccepted(conversationID, recipientID, requesterID int) {
+	wm.sendToUser(requesterID, WebSocketMessage{
+		Type: "message_request_accepted",
+		Payload: map[string]int{
+			"conversation_id": conversationID,
+			"user_id":         recipientID,
+		},
+	})
+
+	if wm.isOnline(recipientID) {
+		wm.deliverPendingMessages(recipientID)
+	}
+	wm.sendPresenceTo(requesterID, recipientID)
+}
@@ -0,0 +1,252 @@
+package forum
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	data "forum/funcs/database"
+)
+
+// notify stores a notification for userID and pushes it as a
+// "notification" frame when they are online. Users are never notified
+// about their own actions nor about users they blocked. groupKey
+// merges unread notifications about the same thing, see
+// data.AddNotification.
+func notify(userID, actorID int, kind, groupKey string, payload map[string]interface{}) {
+	if userID <= 0 || userID == actorID || data.HasBlocked(userID, actorID) {
+		return
+	}
+
+	n, err := data.AddNotification(userID, actorID, kind, groupKey, payload)
+	if err != nil {
+		log.Printf("Error storing %s notification for user %d: %v", kind, userID, err)
+		return
+	}
+
+	// Users in do-not-disturb find it in their notifications later
+	if wsManager.isDoNotDisturb(userID) {
+		return
+	}
+
+	wsManager.sendToUser(userID, WebSocketMessage{
+		Type:    "notification",
+		Payload: n,
+	})
+}
+
+func notifyComment(actorID, postID, commentID int) {
+	authorID, title, err := data.GetPostAuthor(postID)
+	if err != nil {
+		return
+	}
+	notify(authorID, actorID, "post_comment", fmt.Sprintf("post_comment:%d", postID), map[string]interface{}{
+		"post_id":    postID,
+		"comment_id": commentID,
+		"title":      title,
+	})
+}
+
+func notifyLike(actorID int, kind string, targetID int) {
+	if kind == "post" {
+		authorID, title, err := data.GetPostAuthor(targetID)
+		if err != nil {
+			return
+		}
+		notify(authorID, actorID, "post_like", fmt.Sprintf("post_like:%d", targetID), map[string]interface{}{
+			"post_id": targetID,
+			"title":   title,
+		})
+		return
+	}
+
+	authorID, postID, err := data.GetCommentAuthor(targetID)
+	if err != nil {
+		return
+	}
+	notify(authorID, actorID, "comment_like", fmt.Sprintf("comment_like:%d", targetID), map[string]interface{}{
+		"post_id":    postID,
+		"comment_id": targetID,
+	})
+}
+
+// notifyMessage stores a notification for DMs sent to offline users;
+// online users already get the new_message frame.
+func notifyMessage(senderID, receiverID int) {
+	if wsManager.isOnline(receiverID) {
+		return
+	}
+	notify(receiverID, senderID, "new_message", fmt.Sprintf("new_message:%d", senderID), map[string]interface{}{
+		"sender_id": senderID,
+	})
+}
+
+// notifyGroupMessage is notifyMessage for group conversations.
+func notifyGroupMessage(senderID, receiverID, conversationID int) {
+	if wsManager.isOnline(receiverID) {
+		return
+	}
+	notify(receiverID, senderID, "group_message", fmt.Sprintf("group_message:%d", conversationID), map[string]interface{}{
+		"sender_id":       senderID,
+		"conversation_id": conversationID,
+	})
+}
+
+// NotificationsHandler lists the user's notifications, newest first.
+// ?unread=1 only returns unread ones.
+func NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Method not allowed",
+		})
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	unreadOnly, _ := strconv.ParseBool(r.URL.Query().Get("unread"))
+	limit := 20
+
+	notifications, err := data.GetNotifications(userID, unreadOnly, limit, offset)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch notifications",
+		})
+		return
+	}
+
+	count, err := data.GetUnreadNotificationsCount(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch notifications",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": notifications,
+		"unread_count":  count,
+		"hasMore":       len(notifications) == limit,
+	})
+}
+
+func UnreadNotificationsCountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	count, err := data.GetUnreadNotificationsCount(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to fetch unread notifications count",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]int{
+		"count": count,
+	})
+}
+
+// MarkNotificationsAsReadHandler marks the notifications listed in
+// {"ids": [...]} as read.
+func MarkNotificationsAsReadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Method not allowed",
+		})
+		return
+	}
+
+	var request struct {
+		IDs []int `json:"ids"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	if err := data.MarkNotificationsAsRead(userID, request.IDs); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to mark notifications as read",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+	})
+}
+
+func MarkAllNotificationsAsReadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Method not allowed",
+		})
+		return
+	}
+
+	if err := data.MarkAllNotificationsAsRead(userID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Failed to mark notifications as read",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+	})
+}
@@ -0,0 +1,331 @@
+package forum
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	data "forum/funcs/database"
+)
+
+// The manager's connections and presence are the source of truth for who
+// is online; user_sessions mirrors them for the queries that need it.
+// Everyone is marked offline at startup, and RunPresenceMonitor keeps the
+// mirror and last_seen up to date, so a crash leaves last_seen at most
+// presenceCheckTime old and nobody online after the restart.
+const (
+	// Online users who send nothing for idleAfter show as away.
+	idleAfter         = 5 * time.Minute
+	maxStatusTextLen  = 100
+	presenceCheckTime = 30 * time.Second
+	// Users show offline once they have had no connection for
+	// offlineGrace, so reloading a page doesn't flicker their status.
+	offlineGrace = time.Second
+	// Connections silent for heartbeatTimeout are dropped. The read
+	// deadline normally drops them after pongWait already.
+	heartbeatTimeout = pongWait + writeWait
+)
+
+// presenceState is what the manager knows about a user's presence. It is
+// kept after the user disconnects, for their last seen time.
+type presenceState struct {
+	status     string // what the user picked, see data.IsPresenceStatus
+	statusText string
+	lastActive time.Time
+	idle       bool
+	lastSeen   time.Time
+}
+
+// presenceInfo is the presence of a user as others see it, the payload of
+// online_status events.
+type presenceInfo struct {
+	UserID     int        `json:"user_id"`
+	IsOnline   bool       `json:"is_online"`
+	Status     string     `json:"status"`
+	StatusText string     `json:"status_text,omitempty"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+}
+
+type presencePayload struct {
+	Status     string `json:"status"`
+	StatusText string `json:"status_text"`
+}
+
+func (p *presencePayload) validate() error {
+	if !data.IsPresenceStatus(p.Status) {
+		return errors.New("status must be online, away, dnd or invisible")
+	}
+	if len([]rune(p.StatusText)) > maxStatusTextLen {
+		return errors.New("status_text is too long")
+	}
+	return nil
+}
+
+// loadPresence reads the presence userID picked last time, unless the
+// manager already knows it.
+func (wm *WebSocketManager) loadPresence(userID int) {
+	wm.mu.RLock()
+	_, known := wm.presence[userID]
+	wm.mu.RUnlock()
+	if known {
+		wm.markActive(userID)
+		return
+	}
+
+	stored, err := data.GetPresence(userID)
+	if err != nil {
+		log.Printf("Error fetching presence of user %d: %v", userID, err)
+	}
+
+	wm.mu.Lock()
+	if _, known := wm.presence[userID]; !known {
+		wm.presence[userID] = &presenceState{
+			status:     stored.Status,
+			statusText: stored.StatusText,
+			lastActive: time.Now(),
+			lastSeen:   stored.LastSeen,
+		}
+	}
+	wm.mu.Unlock()
+}
+
+// visiblePresence returns userID's presence as others see it. It must be
+// called with wm.mu held.
+func (wm *WebSocketManager) visiblePresence(userID int) presenceInfo {
+	info := presenceInfo{UserID: userID, Status: data.PresenceOffline}
+	state, known := wm.presence[userID]
+	if !known {
+		return info
+	}
+
+	if len(wm.connections[userID]) == 0 || state.status == data.PresenceInvisible {
+		if !state.lastSeen.IsZero() {
+			lastSeen := state.lastSeen
+			info.LastSeen = &lastSeen
+		}
+		return info
+	}
+
+	info.IsOnline = true
+	info.Status = state.status
+	info.StatusText = state.statusText
+	if state.status == data.PresenceOnline && state.idle {
+		info.Status = data.PresenceAway
+	}
+	return info
+}
+
+// isInvisible reports whether userID picked the invisible status. It must
+// be called with wm.mu held.
+func (wm *WebSocketManager) isInvisible(userID int) bool {
+	state, known := wm.presence[userID]
+	return known && state.status == data.PresenceInvisible
+}
+
+// presenceFor returns userID's presence as viewerID sees it: offline when
+// they may not see it, see data.CanSeePresence.
+func (wm *WebSocketManager) presenceFor(viewerID, userID int) presenceInfo {
+	if !data.CanSeePresence(viewerID, userID) {
+		return presenceInfo{UserID: userID, Status: data.PresenceOffline}
+	}
+
+	wm.mu.RLock()
+	info := wm.visiblePresence(userID)
+	wm.mu.RUnlock()
+
+	// Users not seen since startup were last seen before it
+	if !info.IsOnline && info.LastSeen == nil {
+		if stored, err := data.GetPresence(userID); err == nil && !stored.LastSeen.IsZero() {
+			info.LastSeen = &stored.LastSeen
+		}
+	}
+	return info
+}
+
+// isDoNotDisturb reports whether userID asked not to be notified.
+func (wm *WebSocketManager) isDoNotDisturb(userID int) bool {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+
+	state, known := wm.presence[userID]
+	return known && state.status == data.PresenceDND
+}
+
+// markActive records activity of userID, bringing them back from away.
+func (wm *WebSocketManager) markActive(userID int) {
+	wm.mu.Lock()
+	state, known := wm.presence[userID]
+	wasIdle := known && state.idle
+	if known {
+		state.lastActive = time.Now()
+		state.idle = false
+	}
+	wm.mu.Unlock()
+
+	if wasIdle {
+		wm.broadcastOnlineStatus(userID)
+	}
+}
+
+// markSeen records that userID was online until now.
+func (wm *WebSocketManager) markSeen(userID int) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	if state, known := wm.presence[userID]; known {
+		state.lastSeen = time.Now()
+	}
+}
+
+// setPresence changes the status userID picked and tells who may see it.
+func (wm *WebSocketManager) setPresence(userID int, status, statusText string) (presencePayload, error) {
+	wm.loadPresence(userID)
+
+	wm.mu.Lock()
+	state := wm.presence[userID]
+	wasVisible := state.status != data.PresenceInvisible
+	state.status = status
+	state.statusText = statusText
+	state.lastActive = time.Now()
+	state.idle = false
+	if wasVisible && status == data.PresenceInvisible {
+		state.lastSeen = time.Now()
+	}
+	isOnline := wm.visiblePresence(userID).IsOnline
+	isVisible := status != data.PresenceInvisible
+	// Channels saw the user join, or never did
+	channels := make(map[string]int)
+	if wasVisible != isVisible {
+		for _, slug := range wm.userChannels(userID) {
+			channels[slug] = len(wm.channelMemberIDs(slug))
+		}
+	}
+	wm.mu.Unlock()
+
+	if err := data.SetPresenceStatus(userID, status, statusText, isOnline); err != nil {
+		return presencePayload{}, err
+	}
+
+	wm.broadcastOnlineStatus(userID)
+	for slug, count := range channels {
+		action := "left"
+		if isVisible {
+			action = "joined"
+		}
+		wm.publishChannelPresence(slug, userID, action, count)
+	}
+	return presencePayload{Status: status, StatusText: statusText}, nil
+}
+
+// scheduleOffline shows userID offline after offlineGrace, unless they
+// reconnected by then.
+func (wm *WebSocketManager) scheduleOffline(userID int) {
+	time.AfterFunc(offlineGrace, func() {
+		// Shutdown marks everyone offline at once
+		if wm.isOnline(userID) || wm.isShuttingDown() {
+			return
+		}
+		wm.markSeen(userID)
+		data.UpdateUserOnlineStatus(userID, false)
+		wm.broadcastOnlineStatus(userID)
+	})
+}
+
+// dropSilentClients closes the connections whose peer stopped answering
+// pings, which removes them once their read loop ends.
+func (wm *WebSocketManager) dropSilentClients() {
+	var silent []*client
+	wm.mu.RLock()
+	for _, connections := range wm.connections {
+		for _, c := range connections {
+			if c.silentFor() > heartbeatTimeout {
+				silent = append(silent, c)
+			}
+		}
+	}
+	wm.mu.RUnlock()
+
+	for _, c := range silent {
+		log.Printf("Dropping websocket client of user %d after %v without heartbeat", c.userID, c.silentFor().Round(time.Second))
+		c.close()
+	}
+}
+
+// syncPresence writes who is online to user_sessions, refreshing their
+// last_seen and fixing any flag that drifted from the manager's state.
+func (wm *WebSocketManager) syncPresence() {
+	var online []int
+	wm.mu.RLock()
+	for userID := range wm.connections {
+		if wm.visiblePresence(userID).IsOnline {
+			online = append(online, userID)
+		}
+	}
+	wm.mu.RUnlock()
+
+	if err := data.SyncOnlineUsers(online); err != nil {
+		log.Printf("Error syncing online users: %v", err)
+	}
+}
+
+// markIdleUsers shows the online users inactive for idleAfter as away.
+func (wm *WebSocketManager) markIdleUsers() {
+	var idle []int
+	wm.mu.Lock()
+	for userID, state := range wm.presence {
+		if !state.idle && len(wm.connections[userID]) > 0 && time.Since(state.lastActive) >= idleAfter {
+			state.idle = true
+			if state.status == data.PresenceOnline {
+				idle = append(idle, userID)
+			}
+		}
+	}
+	wm.mu.Unlock()
+
+	for _, userID := range idle {
+		wm.broadcastOnlineStatus(userID)
+	}
+}
+
+// ResetPresence marks everyone offline, for startup.
+func ResetPresence() error {
+	reset, err := data.ResetOnlineStatus()
+	if err != nil {
+		return err
+	}
+	if reset > 0 {
+		log.Printf("Marked %d users left online by the last run offline", reset)
+	}
+	return nil
+}
+
+// RunPresenceMonitor drops dead connections, marks idle users away,
+// persists who is online and drops stale event logs every
+// presenceCheckTime. It never returns.
+func RunPresenceMonitor() {
+	ticker := time.NewTicker(presenceCheckTime)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		wsManager.dropSilentClients()
+		wsManager.markIdleUsers()
+		wsManager.syncPresence()
+		wsManager.pruneEventLogs(time.Now())
+	}
+}
+
+func handleSetPresenceFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload presencePayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+	return wm.setPresence(c.userID, payload.Status, payload.StatusText)
+}
+
+// handleActivityFrame handles the activity frames clients send while the
+// user interacts with the page, which keep them from showing as away.
+// Every other frame counts as activity too.
+func handleActivityFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	return nil, nil
+}
@@ -0,0 +1,504 @@
+package forum
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	data "forum/funcs/database"
+)
+
+// Clients send frames of the form
+//
+//	{"v": 1, "type": "new_message", "request_id": "c-17", "payload": {...}}
+//
+// A frame with a request_id is answered with an ack carrying the result,
+//
+//	{"type": "ack", "request_id": "c-17", "payload": {...}}
+//
+// or with an error frame, which is also sent for rejected frames that
+// have no request_id:
+//
+//	{"type": "error", "request_id": "c-17", "payload": {"code": "invalid_payload", "message": "..."}}
+//
+// "v" defaults to protocolVersion when omitted. The server announces the
+// version it speaks in a hello frame right after the connection opens.
+const protocolVersion = 1
+
+const maxMessageLength = 1000
+
+// Error codes of error frames.
+const (
+	errCodeInvalidFrame       = "invalid_frame"
+	errCodeUnsupportedVersion = "unsupported_version"
+	errCodeUnknownType        = "unknown_type"
+	errCodeInvalidPayload     = "invalid_payload"
+	errCodeNotFound           = "not_found"
+	errCodeForbidden          = "forbidden"
+	errCodeLimitExceeded      = "limit_exceeded"
+	errCodeInternal           = "internal_error"
+)
+
+type clientFrame struct {
+	Version   int             `json:"v"`
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+type protocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *protocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newProtocolError(code, format string, args ...interface{}) *protocolError {
+	return &protocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// frameHandler handles a decoded frame and returns the payload of its ack.
+// A *protocolError is sent back as is, any other error as internal_error.
+type frameHandler func(wm *WebSocketManager, c *client, payload json.RawMessage) (interface{}, error)
+
+var frameHandlers = map[string]frameHandler{
+	"new_message":     handleNewMessageFrame,
+	"edit_message":    handleEditMessageFrame,
+	"delete_message":  handleDeleteMessageFrame,
+	"typing":          handleTypingFrame,
+	"mark_read":       handleMarkReadFrame,
+	"subscribe":       handleSubscribeFrame,
+	"join_channel":    handleJoinChannelFrame,
+	"leave_channel":   handleLeaveChannelFrame,
+	"channel_message": handleChannelMessageFrame,
+	"unsubscribe":     handleUnsubscribeFrame,
+	"reconnect":       handleStatusFrame(true),
+	"offline_status":  handleStatusFrame(false),
+	"set_presence":    handleSetPresenceFrame,
+	"activity":        handleActivityFrame,
+}
+
+// validator is implemented by the payloads that need more checks than
+// decoding does.
+type validator interface {
+	validate() error
+}
+
+// Frames about a conversation name either the other user of a direct
+// conversation in receiver_id or a group in conversation_id.
+type newMessagePayload struct {
+	ReceiverID     int    `json:"receiver_id"`
+	ConversationID int    `json:"conversation_id"`
+	Content        string `json:"content"`
+}
+
+func (p *newMessagePayload) validate() error {
+	if err := validateTarget(p.ReceiverID, p.ConversationID, "receiver_id"); err != nil {
+		return err
+	}
+	content, err := validateMessageContent(p.Content)
+	p.Content = content
+	return err
+}
+
+// validateMessageContent trims a message and checks its length.
+func validateMessageContent(content string) (string, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return "", errors.New("content cannot be empty")
+	}
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		return "", fmt.Errorf("content is longer than %d characters", maxMessageLength)
+	}
+	return content, nil
+}
+
+// validateTarget checks that exactly one of userID and conversationID is
+// set.
+func validateTarget(userID, conversationID int, field string) error {
+	if userID < 0 || conversationID < 0 {
+		return errors.New("ids must be positive")
+	}
+	if (userID == 0) == (conversationID == 0) {
+		return fmt.Errorf("either %s or conversation_id is required", field)
+	}
+	return nil
+}
+
+type editMessagePayload struct {
+	MessageID int    `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+func (p *editMessagePayload) validate() error {
+	if p.MessageID <= 0 {
+		return errors.New("message_id is required")
+	}
+	content, err := validateMessageContent(p.Content)
+	p.Content = content
+	return err
+}
+
+type deleteMessagePayload struct {
+	MessageID int `json:"message_id"`
+}
+
+func (p *deleteMessagePayload) validate() error {
+	if p.MessageID <= 0 {
+		return errors.New("message_id is required")
+	}
+	return nil
+}
+
+type typingPayload struct {
+	ReceiverID     int  `json:"receiver_id"`
+	ConversationID int  `json:"conversation_id"`
+	IsTyping       bool `json:"is_typing"`
+}
+
+func (p *typingPayload) validate() error {
+	return validateTarget(p.ReceiverID, p.ConversationID, "receiver_id")
+}
+
+type markReadPayload struct {
+	SenderID       int `json:"sender_id"`
+	ConversationID int `json:"conversation_id"`
+	// MessageID is the last message read, the latest one when omitted.
+	MessageID int `json:"message_id"`
+}
+
+func (p *markReadPayload) validate() error {
+	if err := validateTarget(p.SenderID, p.ConversationID, "sender_id"); err != nil {
+		return err
+	}
+	if p.MessageID < 0 {
+		return errors.New("message_id is invalid")
+	}
+	return nil
+}
+
+type topicPayload struct {
+	Topic string `json:"topic"`
+}
+
+func (p *topicPayload) validate() error {
+	if p.Topic == "" {
+		return errors.New("topic is required")
+	}
+	return nil
+}
+
+type channelPayload struct {
+	Channel string `json:"channel"`
+}
+
+func (p *channelPayload) validate() error {
+	if p.Channel == "" {
+		return errors.New("channel is required")
+	}
+	return nil
+}
+
+type channelMessagePayload struct {
+	Channel string `json:"channel"`
+	Content string `json:"content"`
+}
+
+func (p *channelMessagePayload) validate() error {
+	if p.Channel == "" {
+		return errors.New("channel is required")
+	}
+	content, err := validateMessageContent(p.Content)
+	p.Content = content
+	return err
+}
+
+type statusPayload struct {
+	IsOnline bool `json:"is_online"`
+}
+
+// decodePayload decodes raw into v, rejecting unknown fields, and
+// validates the result.
+func decodePayload(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		raw = []byte("{}")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return newProtocolError(errCodeInvalidPayload, "%v", err)
+	}
+
+	if val, ok := v.(validator); ok {
+		if err := val.validate(); err != nil {
+			return newProtocolError(errCodeInvalidPayload, "%v", err)
+		}
+	}
+	return nil
+}
+
+// dispatchFrame decodes a frame read from c, runs its handler and answers
+// with an ack or an error frame.
+func (wm *WebSocketManager) dispatchFrame(c *client, p []byte) {
+	var frame clientFrame
+	if err := json.Unmarshal(p, &frame); err != nil {
+		c.sendError("", newProtocolError(errCodeInvalidFrame, "frame is not valid JSON"))
+		return
+	}
+
+	if frame.Version != 0 && frame.Version != protocolVersion {
+		c.sendError(frame.RequestID, newProtocolError(errCodeUnsupportedVersion,
+			"protocol version %d is not supported, use %d", frame.Version, protocolVersion))
+		return
+	}
+
+	handler, ok := frameHandlers[frame.Type]
+	if !ok {
+		c.sendError(frame.RequestID, newProtocolError(errCodeUnknownType, "unknown frame type %q", frame.Type))
+		return
+	}
+
+	if frame.Type != "offline_status" {
+		wm.markActive(c.userID)
+	}
+
+	result, err := handler(wm, c, frame.Payload)
+	if err != nil {
+		var protoErr *protocolError
+		if !errors.As(err, &protoErr) {
+			log.Printf("Error handling %s frame of user %d: %v", frame.Type, c.userID, err)
+			protoErr = newProtocolError(errCodeInternal, "the request could not be completed")
+		}
+		c.sendError(frame.RequestID, protoErr)
+		return
+	}
+
+	if frame.RequestID != "" {
+		c.sendMessage(WebSocketMessage{
+			Type:      "ack",
+			RequestID: frame.RequestID,
+			Payload:   result,
+		})
+	}
+}
+
+func (c *client) sendError(requestID string, err *protocolError) {
+	c.sendMessage(WebSocketMessage{
+		Type:      "error",
+		RequestID: requestID,
+		Payload:   err,
+	})
+}
+
+func handleNewMessageFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload newMessagePayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+	if payload.ConversationID != 0 {
+		message, err := wm.handleGroupMessage(c.userID, payload.ConversationID, payload.Content)
+		if err != nil {
+			return nil, groupFrameError(err)
+		}
+		return map[string]interface{}{"message": message}, nil
+	}
+
+	if payload.ReceiverID == c.userID {
+		return nil, newProtocolError(errCodeInvalidPayload, "you can't message yourself")
+	}
+	if !data.UserExists(payload.ReceiverID) {
+		return nil, newProtocolError(errCodeNotFound, "receiver not found")
+	}
+	if err := checkCanMessage(c.userID, payload.ReceiverID); err == errCannotMessage {
+		return nil, newProtocolError(errCodeForbidden, "%v", err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	message, err := wm.handleNewMessage(c.userID, payload.ReceiverID, payload.Content)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"message": message}, nil
+}
+
+func handleEditMessageFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload editMessagePayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	message, err := wm.editMessage(c.userID, payload.MessageID, payload.Content)
+	if err != nil {
+		return nil, messageChangeError(err)
+	}
+	return map[string]interface{}{"message": message}, nil
+}
+
+func handleDeleteMessageFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload deleteMessagePayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	message, err := wm.deleteMessage(c.userID, payload.MessageID)
+	if err != nil {
+		return nil, messageChangeError(err)
+	}
+	return map[string]interface{}{"message": message}, nil
+}
+
+func handleTypingFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload typingPayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	if payload.ConversationID != 0 {
+		if err := requireGroupMember(payload.ConversationID, c.userID); err != nil {
+			return nil, groupFrameError(err)
+		}
+		wm.handleGroupTyping(c.userID, payload.ConversationID, payload.IsTyping)
+		return nil, nil
+	}
+
+	if data.IsBlockedEither(c.userID, payload.ReceiverID) {
+		return nil, newProtocolError(errCodeForbidden, "%v", errCannotMessage)
+	}
+	wm.handleTypingStatus(c.userID, payload.ReceiverID, payload.IsTyping)
+	return nil, nil
+}
+
+func handleMarkReadFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload markReadPayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	if payload.ConversationID != 0 {
+		if err := requireGroupMember(payload.ConversationID, c.userID); err != nil {
+			return nil, groupFrameError(err)
+		}
+		if _, err := data.MarkConversationRead(c.userID, payload.ConversationID, payload.MessageID); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"conversation_id": payload.ConversationID}, nil
+	}
+
+	messageIDs, err := wm.markMessagesRead(c.userID, payload.SenderID, payload.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"message_ids": messageIDs}, nil
+}
+
+func handleSubscribeFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload topicPayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	if err := wm.handleSubscribe(c, payload.Topic); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func handleUnsubscribeFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload topicPayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	wm.handleUnsubscribe(c, payload.Topic)
+	return payload, nil
+}
+
+func handleJoinChannelFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload channelPayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	result, err := wm.joinChannel(c, payload.Channel)
+	if err != nil {
+		return nil, channelError(err)
+	}
+	return result, nil
+}
+
+func handleLeaveChannelFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload channelPayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	slug, err := wm.leaveChannel(c, payload.Channel)
+	if err != nil {
+		return nil, channelError(err)
+	}
+	return channelPayload{Channel: slug}, nil
+}
+
+func handleChannelMessageFrame(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+	var payload channelMessagePayload
+	if err := decodePayload(raw, &payload); err != nil {
+		return nil, err
+	}
+
+	message, err := wm.sendChannelMessage(c, payload.Channel, payload.Content)
+	if err != nil {
+		return nil, channelError(err)
+	}
+	return map[string]interface{}{"message": message}, nil
+}
+
+// handleStatusFrame handles the reconnect and offline_status frames,
+// which set the sender online and offline. Going online shows the status
+// the user picked, see set_presence.
+func handleStatusFrame(isOnline bool) frameHandler {
+	return func(wm *WebSocketManager, c *client, raw json.RawMessage) (interface{}, error) {
+		var payload statusPayload
+		if err := decodePayload(raw, &payload); err != nil {
+			return nil, err
+		}
+
+		if !isOnline {
+			wm.markSeen(c.userID)
+			if err := data.UpdateUserOnlineStatus(c.userID, false); err != nil {
+				return nil, err
+			}
+			now := time.Now()
+			wm.publishPresence(presenceInfo{UserID: c.userID, Status: data.PresenceOffline, LastSeen: &now})
+			return statusPayload{IsOnline: false}, nil
+		}
+
+		info := wm.presenceFor(c.userID, c.userID)
+		if err := data.UpdateUserOnlineStatus(c.userID, info.IsOnline); err != nil {
+			return nil, err
+		}
+		wm.publishPresence(info)
+		return statusPayload{IsOnline: true}, nil
+	}
+}
+
+// groupFrameError maps the errors of group checks to protocol errors.
+func groupFrameError(err error) error {
+	switch err {
+	case errNotConversationMember:
+		return newProtocolError(errCodeNotFound, "conversation not found")
+	case errNotConversationOwner:
+		return newProtocolError(errCodeForbidden, "%v", err)
+	case errNotGroupConversation:
+		return newProtocolError(errCodeInvalidPayload, "use receiver_id for direct conversations")
+	}
+	return err
+}
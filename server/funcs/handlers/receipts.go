@@ -0,0 +1,121 @@
+package forum
+
+import (
+	"log"
+	"time"
+
+	data "forum/funcs/database"
+)
+
+// deliverMessage sends a new message to both sides' connections. When the
+// receiver is connected the message is marked delivered and the sender
+// gets a message_delivered event, otherwise the receiver is notified.
+// Group messages go to every member and have no delivery receipts.
+func (wm *WebSocketManager) deliverMessage(message data.Message) {
+	notification := WebSocketMessage{
+		Type:    "new_message",
+		Payload: message,
+	}
+
+	if message.ReceiverID == 0 {
+		wm.deliverGroupMessage(message, notification)
+		return
+	}
+
+	delivered := wm.sendToUser(message.ReceiverID, notification)
+	wm.sendToUser(message.SenderID, notification)
+
+	if !delivered {
+		notifyMessage(message.SenderID, message.ReceiverID)
+		return
+	}
+	// Requests get their receipts once accepted
+	if data.IsRequestPendingFor(message.ConversationID, message.ReceiverID) {
+		return
+	}
+
+	changed, err := data.MarkMessageDelivered(message.ID)
+	if err != nil {
+		log.Printf("Error marking message %d delivered: %v", message.ID, err)
+		return
+	}
+	if changed {
+		wm.sendDeliveredReceipts([]data.MessageReceipt{{MessageID: message.ID, SenderID: message.SenderID}}, message.ReceiverID)
+	}
+}
+
+func (wm *WebSocketManager) deliverGroupMessage(message data.Message, notification WebSocketMessage) {
+	memberIDs, err := data.GetConversationMemberIDs(message.ConversationID)
+	if err != nil {
+		log.Printf("Error fetching members of conversation %d: %v", message.ConversationID, err)
+		return
+	}
+
+	for _, memberID := range memberIDs {
+		if !wm.sendToUser(memberID, notification) && memberID != message.SenderID {
+			notifyGroupMessage(message.SenderID, memberID, message.ConversationID)
+		}
+	}
+}
+
+// deliverPendingMessages marks the messages sent to userID while they
+// were offline as delivered and tells their senders.
+func (wm *WebSocketManager) deliverPendingMessages(userID int) {
+	receipts, err := data.MarkPendingMessagesDelivered(userID)
+	if err != nil {
+		log.Printf("Error marking pending messages of user %d delivered: %v", userID, err)
+		return
+	}
+	wm.sendDeliveredReceipts(receipts, userID)
+}
+
+func (wm *WebSocketManager) sendDeliveredReceipts(receipts []data.MessageReceipt, receiverID int) {
+	deliveredAt := time.Now().UTC()
+	for senderID, messageIDs := range groupReceipts(receipts) {
+		wm.sendToUser(senderID, WebSocketMessage{
+			Type: "message_delivered",
+			Payload: map[string]interface{}{
+				"receiver_id":  receiverID,
+				"message_ids":  messageIDs,
+				"delivered_at": deliveredAt,
+			},
+		})
+	}
+}
+
+// markMessagesRead marks what senderID sent to readerID as read, up to
+// the message upToID or all of it when upToID is 0, and sends the sender
+// a message_read event. It returns the ids of the messages that changed.
+func (wm *WebSocketManager) markMessagesRead(readerID, senderID, upToID int) ([]int, error) {
+	// Reading a request doesn't tell its sender
+	if conversationID, err := data.GetDirectConversationID(readerID, senderID); err == nil &&
+		data.IsRequestPendingFor(conversationID, readerID) {
+		return nil, nil
+	}
+
+	receipts, err := data.MarkMessagesAsRead(readerID, senderID, upToID)
+	if err != nil {
+		return nil, err
+	}
+
+	messageIDs := groupReceipts(receipts)[senderID]
+	if len(messageIDs) > 0 {
+		wm.sendToUser(senderID, WebSocketMessage{
+			Type: "message_read",
+			Payload: map[string]interface{}{
+				"reader_id":   readerID,
+				"message_ids": messageIDs,
+				"read_at":     time.Now().UTC(),
+			},
+		})
+	}
+	return messageIDs, nil
+}
+
+func groupReceipts(receipts []data.MessageReceipt) map[int][]int {
+	bySender := make(map[int][]int)
+	for _, receipt := range receipts {
+		bySender[receipt.SenderID] = append(bySender[receipt.SenderID], receipt.MessageID)
+	}
+	return bySender
+}
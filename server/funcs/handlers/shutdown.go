@@ -0,0 +1,75 @@
+package forum
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	data "forum/funcs/database"
+)
+
+// Clients told the server is shutting down wait between reconnectAfter
+// and reconnectAfter+reconnectJitter before reconnecting, so they don't
+// all come back at once.
+const (
+	reconnectAfter  = 2 * time.Second
+	reconnectJitter = 3 * time.Second
+)
+
+// Shutdown closes every websocket connection after a server_shutdown
+// frame telling the client when to reconnect, waits until their queued
+// frames are written or ctx ends, and marks everyone offline. New
+// websocket connections are refused from then on.
+func Shutdown(ctx context.Context) error {
+	return wsManager.shutdown(ctx)
+}
+
+func (wm *WebSocketManager) shutdown(ctx context.Context) error {
+	wm.mu.Lock()
+	wm.shuttingDown = true
+	var clients []*client
+	for _, connections := range wm.connections {
+		clients = append(clients, connections...)
+	}
+	wm.mu.Unlock()
+
+	for _, c := range clients {
+		c.sendMessage(WebSocketMessage{
+			Type: "server_shutdown",
+			Payload: map[string]interface{}{
+				"message":            "The server is restarting",
+				"reconnect_after_ms": (reconnectAfter + time.Duration(rand.Int63n(int64(reconnectJitter)))).Milliseconds(),
+			},
+		})
+		c.close()
+	}
+
+	// writePump flushes the queue and sends the close frame
+	for _, c := range clients {
+		select {
+		case <-c.stopped:
+		case <-ctx.Done():
+			log.Printf("Gave up flushing %d websocket clients: %v", len(clients), ctx.Err())
+			return markEveryoneOffline()
+		}
+	}
+	log.Printf("Closed %d websocket connections", len(clients))
+
+	return markEveryoneOffline()
+}
+
+func markEveryoneOffline() error {
+	n, err := data.MarkAllOffline()
+	if err != nil {
+		return err
+	}
+	log.Printf("Marked %d users offline", n)
+	return nil
+}
+
+func (wm *WebSocketManager) isShuttingDown() bool {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	return wm.shuttingDown
+}
@@ -0,0 +1,167 @@
+package forum
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	data "forum/funcs/database"
+)
+
+// SubscriptionsHandler lists the user's category subscriptions (GET),
+// sets the mode of one (PUT {"category": "news", "mode": "digest"}) or
+// removes one (DELETE ?category=news).
+func SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		subscriptions, err := data.GetSubscriptions(userID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch subscriptions"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"subscriptions": subscriptions,
+		})
+	case http.MethodPut, http.MethodPost:
+		var request struct {
+			Category string `json:"category"`
+			Mode     string `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
+			return
+		}
+
+		if request.Mode == "" {
+			request.Mode = "instant"
+		}
+		request.Mode = strings.ToLower(request.Mode)
+		if !data.SubscriptionModes[request.Mode] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Mode must be instant, digest or muted"})
+			return
+		}
+
+		category, err := data.ResolveCategory(request.Category)
+		if err != nil || category.Archived {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid category selected"})
+			return
+		}
+
+		if err := data.Subscribe(userID, category.Slug, request.Mode); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update subscription"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	case http.MethodDelete:
+		category, err := data.ResolveCategory(r.URL.Query().Get("category"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid category selected"})
+			return
+		}
+
+		if err := data.Unsubscribe(userID, category.Slug); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update subscription"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "success",
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+	}
+}
+
+// notifyCategorySubscribers tells instant subscribers of the post's
+// categories about it: a new_post frame when they are online and not in
+// do-not-disturb, a stored notification otherwise. Each post gets its own
+// notification.
+func notifyCategorySubscribers(authorID int, author string, postID int, title string, categories []string) {
+	subscribers, err := data.GetInstantSubscribers(categories, authorID)
+	if err != nil {
+		log.Printf("Error fetching subscribers for post %d: %v", postID, err)
+		return
+	}
+
+	payload := map[string]interface{}{
+		"post_id":    postID,
+		"title":      title,
+		"author_id":  authorID,
+		"author":     author,
+		"categories": categories,
+	}
+
+	for _, userID := range subscribers {
+		if data.HasBlocked(userID, authorID) {
+			continue
+		}
+		if wsManager.isOnline(userID) && !wsManager.isDoNotDisturb(userID) {
+			wsManager.sendToUser(userID, WebSocketMessage{
+				Type:    "new_post",
+				Payload: payload,
+			})
+			continue
+		}
+
+		notify(userID, authorID, "new_post", fmt.Sprintf("new_post:%d", postID), payload)
+	}
+}
+
+// RunCategoryDigests sends the digest subscribers a summary of the new
+// posts in their categories every interval. It never returns.
+func RunCategoryDigests(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		digests, err := data.CollectCategoryDigests()
+		if err != nil {
+			log.Printf("Error collecting category digests: %v", err)
+			continue
+		}
+
+		byUser := make(map[int][]map[string]interface{})
+		var users []int
+		for _, d := range digests {
+			if _, ok := byUser[d.UserID]; !ok {
+				users = append(users, d.UserID)
+			}
+			byUser[d.UserID] = append(byUser[d.UserID], map[string]interface{}{
+				"category": d.Category,
+				"name":     d.Name,
+				"posts":    d.Posts,
+			})
+		}
+
+		for _, userID := range users {
+			notify(userID, 0, "category_digest", "", map[string]interface{}{
+				"categories": byUser[userID],
+			})
+		}
+	}
+}
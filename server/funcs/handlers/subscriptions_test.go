@@ -0,0 +1,52 @@
+package forum
+
+import (
+	"testing"
+
+	data "forum/funcs/database"
+)
+
+func TestNewPostAlertsRespectDoNotDisturb(t *testing.T) {
+	server := newTestServer(t)
+	authorID, _ := newTestUser(t)
+	aliceID, aliceToken := newTestUser(t)
+	bobID, bobToken := newTestUser(t)
+	for _, userID := range []int{aliceID, bobID} {
+		if err := data.Subscribe(userID, "news", "instant"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice := dialTestClient(t, server, aliceToken)
+	bob := dialTestClient(t, server, bobToken)
+	if frame := bob.request("set_presence", map[string]string{"status": data.PresenceDND}); frame.Type != "ack" {
+		t.Fatalf("set_presence: got %s %s", frame.Type, frame.Payload)
+	}
+
+	postID := newTestPost(t, authorID)
+	notifyCategorySubscribers(authorID, "author", postID, "title", []string{"news"})
+
+	// Alice is online so the alert is live, Bob finds it stored later
+	alice.expect("new_post")
+	bob.expectNone("new_post")
+	bob.expectNone("notification")
+
+	for _, tt := range []struct {
+		userID int
+		want   int
+	}{
+		{aliceID, 0},
+		{bobID, 1},
+	} {
+		notifications, err := data.GetNotifications(tt.userID, false, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notifications) != tt.want {
+			t.Fatalf("user %d has %d notifications, want %d", tt.userID, len(notifications), tt.want)
+		}
+		if tt.want > 0 && notifications[0].Type != "new_post" {
+			t.Errorf("user %d got a %s notification, want new_post", tt.userID, notifications[0].Type)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	config "forum/funcs/config"
+	data "forum/funcs/database"
+	types "forum/funcs/types"
+)
+
+const maxTrendingWindow = 30 * 24 * time.Hour
+
+// TagFeedHandler serves /api/tags/{tag}, the posts carrying a hashtag.
+func TagFeedHandler(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+			return
+		}
+
+		tag := strings.ToLower(strings.TrimPrefix(r.PathValue("tag"), "#"))
+		if !data.TagRegex.MatchString(tag) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid tag"})
+			return
+		}
+
+		userID := 0
+		if cookie, err := r.Cookie("Token"); err == nil {
+			userID, _ = data.GetUserIDFromToken(cookie.Value)
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit := cfg.PostsPageSize
+
+		opts := types.QueryOptions{
+			UserID: userID,
+			Filter: "tag",
+			Tag:    tag,
+			Limit:  limit,
+			Offset: offset,
+		}
+
+		query, args := data.BuildPostQuery(opts)
+		posts, err := data.GetPosts(userID, cfg.ImagesDir, query, args...)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("Error getting tag posts:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch posts"})
+			return
+		}
+
+		response := struct {
+			Tag        string       `json:"tag"`
+			Posts      []types.POST `json:"posts"`
+			IsLoggedIn bool         `json:"isLoggedIn"`
+			HasMore    bool         `json:"hasMore"`
+		}{
+			Tag:        tag,
+			Posts:      posts,
+			IsLoggedIn: userID > 0,
+			HasMore:    len(posts) == limit,
+		}
+
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// TagSearchHandler autocompletes tags: /api/tags?prefix=go
+func TagSearchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	prefix := strings.TrimPrefix(strings.TrimSpace(r.URL.Query().Get("prefix")), "#")
+	if !data.TagRegex.MatchString(prefix) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid tag prefix"})
+		return
+	}
+
+	tags, err := data.SearchTags(prefix, 10)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to search tags"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tags": tags,
+	})
+}
+
+// TrendingTagsHandler lists the most used tags over a sliding window,
+// given as a duration such as ?window=24h (the default).
+func TrendingTagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	window := 24 * time.Hour
+	if value := r.URL.Query().Get("window"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > maxTrendingWindow {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid window"})
+			return
+		}
+		window = parsed
+	}
+
+	tags, err := data.GetTrendingTags(window, 10)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch trending tags"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window": window.String(),
+		"tags":   tags,
+	})
+}
@@ -0,0 +1,218 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+
+	data "forum/funcs/database"
+)
+
+// Topics a connection can subscribe to with a
+// {"type": "subscribe", "payload": {"topic": "post:42"}} frame, which is
+// answered with an ack or an error frame (see protocol.go):
+//
+//	feed               every new post (post_created)
+//	post:<id>          comments and reactions on a post
+//	category:<slug>    new posts in a category (post_created)
+//	user:<id>:presence a user's online status (online_status)
+//
+// Channel topics are joined with join_channel frames instead, see
+// channels.go.
+const maxTopicsPerConnection = 500
+
+var (
+	postTopicRegex     = regexp.MustCompile(`^post:(\d+)$`)
+	categoryTopicRegex = regexp.MustCompile(`^category:([a-z0-9-]+)$`)
+	presenceTopicRegex = regexp.MustCompile(`^user:(\d+):presence$`)
+
+	errUnknownTopic   = errors.New("unknown topic")
+	errTopicNotFound  = errors.New("topic not found")
+	errTopicForbidden = errors.New("topic not allowed")
+	errTooManyTopics  = errors.New("too many subscriptions")
+)
+
+func postTopic(postID int) string {
+	return fmt.Sprintf("post:%d", postID)
+}
+
+func categoryTopic(slug string) string {
+	return "category:" + slug
+}
+
+func presenceTopic(userID int) string {
+	return fmt.Sprintf("user:%d:presence", userID)
+}
+
+// authorizeTopic checks that the topic exists and that userID may
+// receive its events.
+func authorizeTopic(userID int, topic string) error {
+	if topic == "feed" {
+		return nil
+	}
+
+	if m := postTopicRegex.FindStringSubmatch(topic); m != nil {
+		postID, _ := strconv.Atoi(m[1])
+		if _, _, err := data.GetPostAuthor(postID); err != nil {
+			return notFound(err)
+		}
+		return nil
+	}
+
+	if m := categoryTopicRegex.FindStringSubmatch(topic); m != nil {
+		if _, err := data.ResolveCategory(m[1]); err != nil {
+			return notFound(err)
+		}
+		return nil
+	}
+
+	if m := presenceTopicRegex.FindStringSubmatch(topic); m != nil {
+		targetID, _ := strconv.Atoi(m[1])
+		if !data.UserExists(targetID) {
+			return errTopicNotFound
+		}
+		if !data.CanSeePresence(userID, targetID) {
+			return errTopicForbidden
+		}
+		return nil
+	}
+
+	return errUnknownTopic
+}
+
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return errTopicNotFound
+	}
+	return err
+}
+
+// handleSubscribe subscribes c to topic. Presence subscribers are also
+// sent the current status.
+func (wm *WebSocketManager) handleSubscribe(c *client, topic string) error {
+	err := authorizeTopic(c.userID, topic)
+	if err == nil {
+		err = wm.subscribe(c, topic)
+	}
+
+	if err != nil {
+		log.Printf("User %d can't subscribe to %q: %v", c.userID, topic, err)
+		return topicError(err)
+	}
+
+	if m := presenceTopicRegex.FindStringSubmatch(topic); m != nil {
+		otherID, _ := strconv.Atoi(m[1])
+		c.sendMessage(WebSocketMessage{
+			Type:    "online_status",
+			Payload: wm.presenceFor(c.userID, otherID),
+		})
+	}
+	return nil
+}
+
+// topicError maps the subscription errors to protocol errors.
+func topicError(err error) error {
+	switch err {
+	case errUnknownTopic:
+		return newProtocolError(errCodeInvalidPayload, "%v", err)
+	case errTopicNotFound:
+		return newProtocolError(errCodeNotFound, "%v", err)
+	case errTopicForbidden:
+		return newProtocolError(errCodeForbidden, "%v", err)
+	case errTooManyTopics:
+		return newProtocolError(errCodeLimitExceeded, "%v", err)
+	}
+	return err
+}
+
+func (wm *WebSocketManager) handleUnsubscribe(c *client, topic string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	wm.removeSubscriber(topic, c)
+	delete(c.topics, topic)
+}
+
+func (wm *WebSocketManager) subscribe(c *client, topic string) error {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	return wm.addSubscriber(topic, c)
+}
+
+// addSubscriber must be called with wm.mu held.
+func (wm *WebSocketManager) addSubscriber(topic string, c *client) error {
+	if !c.topics[topic] && len(c.topics) >= maxTopicsPerConnection {
+		return errTooManyTopics
+	}
+	c.topics[topic] = true
+
+	subscribers := wm.topics[topic]
+	if subscribers == nil {
+		subscribers = make(map[*client]bool)
+		wm.topics[topic] = subscribers
+	}
+	subscribers[c] = true
+	return nil
+}
+
+// removeSubscriber must be called with wm.mu held.
+func (wm *WebSocketManager) removeSubscriber(topic string, c *client) {
+	subscribers := wm.topics[topic]
+	if subscribers == nil {
+		return
+	}
+	delete(subscribers, c)
+	if len(subscribers) == 0 {
+		delete(wm.topics, topic)
+	}
+}
+
+// publish sends msg once to every client subscribed to any of the
+// topics. The frame is encoded once and queued, so a slow subscriber
+// doesn't hold up the others.
+func (wm *WebSocketManager) publish(msg WebSocketMessage, topics ...string) {
+	wm.publishSkipping(msg, nil, topics...)
+}
+
+// publishAbout publishes an event about userID's activity, skipping the
+// subscribers who blocked them.
+func (wm *WebSocketManager) publishAbout(userID int, msg WebSocketMessage, topics ...string) {
+	blockers, err := data.GetBlockerIDs(userID)
+	if err != nil {
+		log.Printf("Error fetching blockers of user %d: %v", userID, err)
+		return
+	}
+	wm.publishSkipping(msg, blockers, topics...)
+}
+
+// publishSkipping is publish, leaving out the connections of skipUserIDs.
+func (wm *WebSocketManager) publishSkipping(msg WebSocketMessage, skipUserIDs map[int]bool, topics ...string) {
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msg.Type, err)
+		return
+	}
+
+	var clients []*client
+	sent := make(map[*client]bool)
+	wm.mu.RLock()
+	for _, topic := range topics {
+		for c := range wm.topics[topic] {
+			if sent[c] || skipUserIDs[c.userID] {
+				continue
+			}
+			sent[c] = true
+			clients = append(clients, c)
+		}
+	}
+	wm.mu.RUnlock()
+
+	for _, c := range clients {
+		c.enqueue(frame)
+	}
+}
@@ -0,0 +1,141 @@
+package forum
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	data "forum/funcs/database"
+	types "forum/funcs/types"
+)
+
+// subscribe subscribes c to topic and fails the test unless it's acked.
+func (c *testClient) subscribe(topic string) {
+	c.t.Helper()
+
+	if frame := c.request("subscribe", map[string]string{"topic": topic}); frame.Type != "ack" {
+		c.t.Fatalf("subscribing to %s: got %s %s", topic, frame.Type, frame.Payload)
+	}
+}
+
+func (c *testClient) unsubscribe(topic string) {
+	c.t.Helper()
+
+	if frame := c.request("unsubscribe", map[string]string{"topic": topic}); frame.Type != "ack" {
+		c.t.Fatalf("unsubscribing from %s: got %s %s", topic, frame.Type, frame.Payload)
+	}
+}
+
+func subscriberCount(topic string) int {
+	wsManager.mu.RLock()
+	defer wsManager.mu.RUnlock()
+	return len(wsManager.topics[topic])
+}
+
+func TestSubscribeAndUnsubscribe(t *testing.T) {
+	server := newTestServer(t)
+	userID, token := newTestUser(t)
+	postID := newTestPost(t, userID)
+	topic := postTopic(postID)
+	alice := dialTestClient(t, server, token)
+
+	alice.subscribe(topic)
+	if n := subscriberCount(topic); n != 1 {
+		t.Fatalf("%s has %d subscribers, want 1", topic, n)
+	}
+	publishCommentCreated(postID, types.COMMENT{USER_ID: userID, Content: "first"})
+	alice.expect("comment_created")
+
+	// Subscribing twice doesn't deliver the events twice
+	alice.subscribe(topic)
+	publishCommentCreated(postID, types.COMMENT{USER_ID: userID, Content: "second"})
+	alice.expect("comment_created")
+	alice.expectNone("comment_created")
+
+	alice.unsubscribe(topic)
+	if n := subscriberCount(topic); n != 0 {
+		t.Fatalf("%s still has %d subscribers", topic, n)
+	}
+	publishCommentCreated(postID, types.COMMENT{USER_ID: userID, Content: "third"})
+	alice.expectNone("comment_created")
+}
+
+func TestPublishReachesOnlySubscribers(t *testing.T) {
+	server := newTestServer(t)
+	aliceID, aliceToken := newTestUser(t)
+	_, bobToken := newTestUser(t)
+	postID := newTestPost(t, aliceID)
+
+	alice := dialTestClient(t, server, aliceToken)
+	// Subscriptions belong to a connection, not to the user
+	aliceElsewhere := dialTestClient(t, server, aliceToken)
+	bob := dialTestClient(t, server, bobToken)
+	carol := func() *testClient {
+		_, token := newTestUser(t)
+		return dialTestClient(t, server, token)
+	}()
+
+	alice.subscribe(postTopic(postID))
+	bob.subscribe(postTopic(postID))
+	carol.subscribe(postTopic(newTestPost(t, aliceID)))
+
+	publishCommentCreated(postID, types.COMMENT{USER_ID: aliceID, Content: "hi"})
+
+	var payload struct {
+		PostID int `json:"post_id"`
+	}
+	for _, c := range []*testClient{alice, bob} {
+		frame := c.expect("comment_created")
+		if err := json.Unmarshal(frame.Payload, &payload); err != nil || payload.PostID != postID {
+			t.Errorf("comment_created for post %d, want %d (%v)", payload.PostID, postID, err)
+		}
+	}
+	aliceElsewhere.expectNone("comment_created")
+	carol.expectNone("comment_created")
+}
+
+func TestSubscribeRejectsInvalidTopics(t *testing.T) {
+	server := newTestServer(t)
+	aliceID, token := newTestUser(t)
+	alice := dialTestClient(t, server, token)
+	blockerID, _ := newTestUser(t)
+	if err := data.Block(blockerID, aliceID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		topic    string
+		wantCode string
+	}{
+		{"", errCodeInvalidPayload},
+		{"bogus", errCodeInvalidPayload},
+		{"post:abc", errCodeInvalidPayload},
+		{"category:News!", errCodeInvalidPayload},
+		{"user:1:typing", errCodeInvalidPayload},
+		{"channel:news", errCodeInvalidPayload},
+		{"post:999999", errCodeNotFound},
+		{"category:no-such-category", errCodeNotFound},
+		{"user:999999:presence", errCodeNotFound},
+		// Users who blocked alice hide their presence from her
+		{presenceTopic(blockerID), errCodeForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.topic), func(t *testing.T) {
+			frame := alice.request("subscribe", map[string]string{"topic": tt.topic})
+			if frame.Type != "error" {
+				t.Fatalf("got a %s frame, want an error", frame.Type)
+			}
+			var protoErr protocolError
+			if err := json.Unmarshal(frame.Payload, &protoErr); err != nil {
+				t.Fatal(err)
+			}
+			if protoErr.Code != tt.wantCode {
+				t.Errorf("code %q, want %q (%s)", protoErr.Code, tt.wantCode, protoErr.Message)
+			}
+			if n := subscriberCount(tt.topic); n != 0 {
+				t.Errorf("the rejected topic has %d subscribers", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package forum
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	data "forum/funcs/database"
+)
+
+const (
+	userPageSize    = 20
+	maxUserPageSize = 50
+	suggestionCount = 10
+	maxUserQueryLen = 50
+)
+
+// UsersHandler searches the user directory by name prefix, online users
+// first: GET /api/users?q=&limit=&offset=
+func UsersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := strings.TrimSpace(query.Get("q"))
+	if len(prefix) > maxUserQueryLen {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Search is too long"})
+		return
+	}
+
+	limit := userPageSize
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxUserPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid limit"})
+			return
+		}
+	}
+
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	users, err := data.SearchUsers(userID, prefix, limit, offset)
+	if err != nil {
+		log.Printf("Error searching users for %d: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch users"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":   users,
+		"hasMore": len(users) == limit,
+	})
+}
+
+// UserSuggestionsHandler suggests users to start a conversation with.
+func UserSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, isAuth := CheckIfCookieValid(w, r)
+	if !isAuth {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Authentication required",
+		})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
+		return
+	}
+
+	users, err := data.GetUserSuggestions(userID, suggestionCount)
+	if err != nil {
+		log.Printf("Error fetching suggestions for %d: %v", userID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to fetch suggestions"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users": users,
+	})
+}
@@ -2,44 +2,69 @@ package forum
 
 import (
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 
+	config "forum/funcs/config"
 	data "forum/funcs/database"
 )
 
+// WebSocketMessage is a frame sent to clients, see protocol.go for the
+// frames clients send.
 type WebSocketMessage struct {
-	Type    string      `json:"type"`
+	Type string `json:"type"`
+	// RequestID is set on ack and error frames answering a client frame.
+	RequestID string `json:"request_id,omitempty"`
+	// Seq numbers the durable events of a user, see eventlog.go.
+	Seq     int64       `json:"seq,omitempty"`
 	Payload interface{} `json:"payload"`
 }
 
 type WebSocketManager struct {
-	connections map[int][]*websocket.Conn
+	connections map[int][]*client
 	tokens      map[int]string
-	mu          sync.RWMutex
+	// topics holds the subscribed clients of each topic, see topics.go
+	topics map[string]map[*client]bool
+	// logs holds the durable events of each user, see eventlog.go
+	logs map[int]*eventLog
+	// presence holds the presence of the users seen since startup, see
+	// presence.go
+	presence map[int]*presenceState
+	// shuttingDown is set by Shutdown, see shutdown.go
+	shuttingDown bool
+	mu           sync.RWMutex
+
+	cfg      *config.Config
+	upgrader websocket.Upgrader
 }
 
-var (
-	wsManager = &WebSocketManager{
-		connections: make(map[int][]*websocket.Conn),
-		tokens:      make(map[int]string),
-	}
+var wsManager = NewWebSocketManager(config.Default())
 
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		// basicly this implementation
-		// it just a reminder to properly check it in production
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins in development
+func NewWebSocketManager(c *config.Config) *WebSocketManager {
+	return &WebSocketManager{
+		connections: make(map[int][]*client),
+		tokens:      make(map[int]string),
+		topics:      make(map[string]map[*client]bool),
+		logs:        make(map[int]*eventLog),
+		presence:    make(map[int]*presenceState),
+		cfg:         c,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  c.WSReadBufferSize,
+			WriteBufferSize: c.WSWriteBufferSize,
+			// basicly this implementation
+			// it just a reminder to properly check it in production
+			CheckOrigin: func(r *http.Request) bool {
+				return true // Allow all origins in development
+			},
 		},
 	}
-)
+}
 
 func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	userID, isAuth := CheckIfCookieValid(w, r)
@@ -48,22 +73,37 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if wsManager.isShuttingDown() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// A reconnecting client passes the seq of the last event it got
+	lastSeq := int64(-1)
+	if value := r.URL.Query().Get("last_seq"); value != "" {
+		seq, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seq < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lastSeq = seq
+	}
+
 	// log.Printf("WebSocket connection attempt for user_id: %d", userID)
 	cookie, _ := r.Cookie("Token")
-	fmt.Println("cookie ->", cookie.Value)
 
 	wsManager.mu.Lock()
 	if existingConns, exists := wsManager.connections[userID]; exists {
 		oldToken := wsManager.tokens[userID]
 		if oldToken != cookie.Value {
-			for _, conn := range existingConns {
-				conn.WriteJSON(WebSocketMessage{
+			for _, c := range existingConns {
+				c.sendMessage(WebSocketMessage{
 					Type: "session_expired",
 					Payload: map[string]string{
 						"message": "Session expired due to new login",
 					},
 				})
-				conn.Close()
+				c.close()
 			}
 			delete(wsManager.connections, userID)
 		}
@@ -71,77 +111,121 @@ func HandleWebSocket(w http.ResponseWriter, r *http.Request) {
 	wsManager.mu.Unlock()
 
 	// Upgrade connection to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := wsManager.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading to WebSocket: %v", err)
 		return
 	}
 
 	// Register the new connection
-	wsManager.registerConnection(userID, conn, cookie.Value)
+	c := newClient(userID, cookie.Value, conn, wsManager.cfg.WSSendQueueSize)
+	go c.writePump()
+	if !wsManager.registerConnection(c, lastSeq) {
+		return
+	}
+	wsManager.loadPresence(userID)
 
-	// Update user's online status
-	if err := data.UpdateUserOnlineStatus(userID, true); err != nil {
+	// Update user's online status, which invisible users keep offline
+	if err := data.UpdateUserOnlineStatus(userID, wsManager.presenceFor(userID, userID).IsOnline); err != nil {
 		// log.Printf("Error updating online status for user_id: %d: %v", userID, err)
 	} else {
 		log.Printf("Successfully updated online status for user_id: %d", userID)
 	}
 
 	// Broadcast online status to other users
-	wsManager.broadcastOnlineStatus(userID, true)
+	wsManager.broadcastOnlineStatus(userID)
+
+	// Messages sent while the user was away have now reached them
+	go wsManager.deliverPendingMessages(userID)
 
 	// Handle incoming messages in a goroutine
-	go wsManager.handleMessages(userID, conn)
+	go wsManager.handleMessages(c)
 }
 
-func (wm *WebSocketManager) registerConnection(userID int, conn *websocket.Conn, token string) {
+// registerConnection adds c to the user's connections and greets it with
+// a hello frame carrying the current seq. When lastSeq isn't negative the
+// events after it are replayed first. It closes c and returns false once
+// the server is shutting down.
+func (wm *WebSocketManager) registerConnection(c *client, lastSeq int64) bool {
 	wm.mu.Lock()
 	defer wm.mu.Unlock()
 
-	// Initialize slice if it doesn't exist
-	if _, exists := wm.connections[userID]; !exists {
-		wm.connections[userID] = make([]*websocket.Conn, 0)
+	if wm.shuttingDown {
+		c.close()
+		return false
 	}
 
-	wm.connections[userID] = append(wm.connections[userID], conn)
-	wm.tokens[userID] = token
-}
+	wm.connections[c.userID] = append(wm.connections[c.userID], c)
+	wm.tokens[c.userID] = c.token
 
-func (wm *WebSocketManager) broadcastOnlineStatus(userID int, isOnline bool) {
-	notification := WebSocketMessage{
-		Type: "online_status",
-		Payload: map[string]interface{}{
-			"user_id":   userID,
-			"is_online": isOnline,
+	c.sendMessage(WebSocketMessage{
+		Type: "hello",
+		Payload: map[string]int64{
+			"protocol_version": protocolVersion,
+			"seq":              wm.eventLog(c.userID).lastSeq,
 		},
+	})
+	if lastSeq >= 0 {
+		wm.replay(c, lastSeq)
 	}
+	return true
+}
 
-	wm.broadcastToAll(notification, userID)
+// broadcastOnlineStatus sends the user's current presence to the
+// subscribers of their presence topic who may see it.
+func (wm *WebSocketManager) broadcastOnlineStatus(userID int) {
+	wm.mu.RLock()
+	info := wm.visiblePresence(userID)
+	wm.mu.RUnlock()
+
+	wm.publishPresence(info)
+}
+
+func (wm *WebSocketManager) publishPresence(info presenceInfo) {
+	hidden, err := data.GetPresenceHiddenFrom(info.UserID)
+	if err != nil {
+		log.Printf("Error fetching who can't see user %d's presence: %v", info.UserID, err)
+		return
+	}
+	wm.publishSkipping(WebSocketMessage{
+		Type:    "online_status",
+		Payload: info,
+	}, hidden, presenceTopic(info.UserID))
 }
 
 func (wm *WebSocketManager) broadcastToAll(msg WebSocketMessage, excludeUserID int) {
-	wm.mu.RLock()
-	defer wm.mu.RUnlock()
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msg.Type, err)
+		return
+	}
 
+	var clients []*client
+	wm.mu.RLock()
 	for userID, connections := range wm.connections {
 		if userID != excludeUserID {
-			for _, conn := range connections {
-				if err := conn.WriteJSON(msg); err != nil {
-					log.Printf("Error broadcasting to user %d: %v", userID, err)
-				}
-			}
+			clients = append(clients, connections...)
 		}
 	}
+	wm.mu.RUnlock()
+
+	for _, c := range clients {
+		c.enqueue(frame)
+	}
 }
 
-func (wm *WebSocketManager) handleMessages(userID int, conn *websocket.Conn) {
+// handleMessages is the read loop of a client. It owns the connection's
+// reads; writes go through the client's writePump.
+func (wm *WebSocketManager) handleMessages(c *client) {
+	userID := c.userID
 	defer func() {
-		wm.removeConnection(userID, conn)
+		wm.removeConnection(c)
 	}()
 
+	c.prepareReads(wm.cfg.WSMaxMessageSize)
 	for {
 		// Read Message
-		messageType, p, err := conn.ReadMessage()
+		messageType, p, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err,
 				websocket.CloseGoingAway, // User closed tab/browser
@@ -152,6 +236,8 @@ func (wm *WebSocketManager) handleMessages(userID int, conn *websocket.Conn) {
 			return
 		}
 
+		c.heartbeat()
+
 		if messageType == websocket.TextMessage {
 
 			// Check token validity before processing
@@ -159,9 +245,8 @@ func (wm *WebSocketManager) handleMessages(userID int, conn *websocket.Conn) {
 			currentToken := wm.tokens[userID]
 			wm.mu.RUnlock()
 
-			u, err := data.GetUserIDFromToken(currentToken)
-			if err != nil {
-				conn.WriteJSON(WebSocketMessage{
+			if _, err := data.GetUserIDFromToken(currentToken); err != nil {
+				c.sendMessage(WebSocketMessage{
 					Type: "session_expired",
 					Payload: map[string]string{
 						"message": "Session expired",
@@ -169,54 +254,38 @@ func (wm *WebSocketManager) handleMessages(userID int, conn *websocket.Conn) {
 				})
 				return
 			}
-			fmt.Println("-->", wm.tokens)
-			fmt.Println("-->", u, currentToken)
-
-			var msg WebSocketMessage
-			if err := json.Unmarshal(p, &msg); err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
-				continue
-				// Skip this message, wait for next one. Skips invalid message
-				// Goes back to waiting for next message
-			}
-
-			// Handle different message types
-			switch msg.Type {
-			case "new_message":
-				wm.handleNewMessage(userID, msg.Payload)
-			case "typing":
-				wm.handleTypingStatus(userID, msg.Payload)
-			case "reconnect":
-				if err := data.UpdateUserOnlineStatus(userID, true); err != nil {
-					log.Printf("Error updating online status on reconnect for user_id: %d: %v", userID, err)
-				} else {
-					log.Printf("Successfully updated online status on reconnect for user_id: %d", userID)
-				}
-				wm.broadcastOnlineStatus(userID, true)
-			case "offline_status":
-				if err := data.UpdateUserOnlineStatus(userID, false); err != nil {
-					log.Printf("Error updating offline status for user_id: %d: %v", userID, err)
-				} else {
-					log.Printf("Successfully updated offline status for user_id: %d", userID)
-				}
-				wm.broadcastOnlineStatus(userID, false)
-			}
+			wm.dispatchFrame(c, p)
 		}
 	}
 }
 
-func (wm *WebSocketManager) removeConnection(userID int, conn *websocket.Conn) {
+func (wm *WebSocketManager) removeConnection(c *client) {
+	// Stops the writePump, which closes the connection once the queued
+	// frames are flushed.
+	c.close()
+
 	wm.mu.Lock()
 	defer wm.mu.Unlock()
 
+	for topic := range c.topics {
+		wm.removeSubscriber(topic, c)
+
+		// Tell the channels this was the user's last connection in
+		if slug, ok := strings.CutPrefix(topic, "channel:"); ok && !wm.inChannel(c.userID, slug) && !wm.isInvisible(c.userID) {
+			go wm.publishChannelPresence(slug, c.userID, "left", len(wm.channelMemberIDs(slug)))
+		}
+	}
+	c.topics = make(map[string]bool)
+
+	userID := c.userID
 	connections, exists := wm.connections[userID]
 	if !exists {
 		return
 	}
 
 	// Find and remove the specific connection
-	for i, c := range connections {
-		if c == conn {
+	for i, other := range connections {
+		if other == c {
 			wm.connections[userID] = append(connections[:i], connections[i+1:]...)
 			break
 		}
@@ -226,86 +295,116 @@ func (wm *WebSocketManager) removeConnection(userID int, conn *websocket.Conn) {
 	if len(wm.connections[userID]) == 0 {
 		delete(wm.connections, userID)
 		delete(wm.tokens, userID)
-		// Add a small delay to prevent race condition with reconnection
-		go func() {
-			time.Sleep(1 * time.Second)
-			if _, exists := wm.connections[userID]; !exists {
-				data.UpdateUserOnlineStatus(userID, false)
-				wm.broadcastOnlineStatus(userID, false)
-			}
-		}()
+		if l := wm.logs[userID]; l != nil {
+			l.idleSince = time.Now()
+		}
+		wm.scheduleOffline(userID)
 	}
 
 }
 
-func (wm *WebSocketManager) handleNewMessage(senderID int, payload interface{}) {
-	payloadBytes, _ := json.Marshal(payload)
-	var messageData struct {
-		ReceiverID int    `json:"receiver_id"`
-		Content    string `json:"content"`
-	}
-	if err := json.Unmarshal(payloadBytes, &messageData); err != nil {
-		log.Printf("Error unmarshaling message payload: %v", err)
-		return
-	}
+// handleNewMessage stores a message sent over the websocket and delivers
+// it to both sides' connections.
+func (wm *WebSocketManager) handleNewMessage(senderID, receiverID int, content string) (data.Message, error) {
+	wm.acceptOnReply(senderID, receiverID)
 
 	// Store message in database
-	_, err := data.InsertMessage(senderID, messageData.ReceiverID, messageData.Content)
+	messageID, err := data.InsertMessage(senderID, receiverID, content)
 	if err != nil {
-		log.Printf("Error storing message: %v", err)
-		return
+		return data.Message{}, err
 	}
 
 	// Get complete message details
-	messages, err := data.GetMessages(senderID, messageData.ReceiverID, 1, 0)
-	if err != nil || len(messages) == 0 {
-		log.Printf("Error fetching sent message: %v", err)
-		return
-	}
-
-	// Prepare message notification
-	notification := WebSocketMessage{
-		Type:    "new_message",
-		Payload: messages[0],
+	message, err := data.GetMessage(messageID)
+	if err != nil {
+		return data.Message{}, err
 	}
 
-	// Send to receiver if online
-	wm.sendToUser(messageData.ReceiverID, notification)
-	wm.sendToUser(senderID, notification)
+	wm.deliverMessage(message)
+	return message, nil
 }
 
-func (wm *WebSocketManager) sendToUser(userID int, msg WebSocketMessage) {
+// sendToUser sends msg to every connection of userID and reports whether
+// any of them took it. Durable events are also logged, so they reach the
+// user's next connection if there's none.
+func (wm *WebSocketManager) sendToUser(userID int, msg WebSocketMessage) bool {
+	if durableEvents[msg.Type] {
+		return wm.sendDurable(userID, msg)
+	}
+
 	wm.mu.RLock()
-	connections, exists := wm.connections[userID]
+	connections := append([]*client(nil), wm.connections[userID]...)
 	wm.mu.RUnlock()
 
-	if exists {
-		for _, conn := range connections {
-			if err := conn.WriteJSON(msg); err != nil {
-				log.Printf("Error sending message to user %d: %v", userID, err)
-				wm.removeConnection(userID, conn)
-			}
+	if len(connections) == 0 {
+		return false
+	}
+
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msg.Type, err)
+		return false
+	}
+
+	sent := false
+	for _, c := range connections {
+		if c.enqueue(frame) {
+			sent = true
 		}
 	}
+	return sent
 }
 
-func (wm *WebSocketManager) handleTypingStatus(userID int, payload interface{}) {
-	payloadBytes, _ := json.Marshal(payload)
-	var typingData struct {
-		ReceiverID int  `json:"receiver_id"`
-		IsTyping   bool `json:"is_typing"`
+func (wm *WebSocketManager) sendDurable(userID int, msg WebSocketMessage) bool {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+
+	l := wm.eventLog(userID)
+	msg.Seq = l.lastSeq + 1
+	frame, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error encoding %s message: %v", msg.Type, err)
+		return false
 	}
-	if err := json.Unmarshal(payloadBytes, &typingData); err != nil {
-		return
+	l.append(msg.Seq, frame)
+
+	sent := false
+	for _, c := range wm.connections[userID] {
+		if c.enqueue(frame) {
+			sent = true
+		}
 	}
+	return sent
+}
 
+func (wm *WebSocketManager) isOnline(userID int) bool {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+
+	return len(wm.connections[userID]) > 0
+}
+
+func (wm *WebSocketManager) handleTypingStatus(userID, receiverID int, isTyping bool) {
 	notification := WebSocketMessage{
 		Type: "typing_status",
 		Payload: map[string]interface{}{
 			"user_id":   userID,
-			"is_typing": typingData.IsTyping,
+			"is_typing": isTyping,
 		},
 	}
 
-	wm.sendToUser(typingData.ReceiverID, notification)
+	wm.sendToUser(receiverID, notification)
+}
+
+// handleGroupTyping sends the typing status of userID to the other
+// members of a group.
+func (wm *WebSocketManager) handleGroupTyping(userID, conversationID int, isTyping bool) {
+	wm.sendToConversation(conversationID, WebSocketMessage{
+		Type: "typing_status",
+		Payload: map[string]interface{}{
+			"user_id":         userID,
+			"conversation_id": conversationID,
+			"is_typing":       isTyping,
+		},
+	}, userID)
 }
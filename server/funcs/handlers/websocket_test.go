@@ -0,0 +1,417 @@
+package forum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	config "forum/funcs/config"
+	data "forum/funcs/database"
+	types "forum/funcs/types"
+)
+
+// TestMain runs the tests against a fresh database, shared by the tests
+// like the server shares one.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "forum-handlers")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	c := config.Default()
+	c.DBPath = filepath.Join(dir, "test.db")
+	c.ImagesDir = dir
+	if err := data.Open(c); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if _, err := data.MigrateUp(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	Init(c)
+
+	code := m.Run()
+	data.Db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testUsers counts the users created so their names don't collide.
+var testUsers int
+
+// newTestUser registers a user and logs them in, returning their id and
+// session token.
+func newTestUser(t testing.TB) (int, string) {
+	t.Helper()
+
+	testUsers++
+	name := fmt.Sprintf("user%d", testUsers)
+	userID, err := data.InsertUserInfo(name+"@example.com", "password", name, "Test", "User", "20", "male")
+	if err != nil {
+		t.Fatalf("InsertUserInfo: %v", err)
+	}
+	token, err := data.GenereteTocken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetToken(token, userID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("SetToken: %v", err)
+	}
+	return userID, token
+}
+
+// newTestPost creates a post of userID and returns its id.
+func newTestPost(t testing.TB, userID int) int {
+	t.Helper()
+
+	result, err := data.Db.Exec("INSERT INTO posts (title, content, user_id, img) VALUES ('title', 'content', ?, '')", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, _ := result.LastInsertId()
+	return int(postID)
+}
+
+// newTestServer serves HandleWebSocket until the test ends.
+func newTestServer(t testing.TB) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(HandleWebSocket))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// receivedFrame is a frame read by a testClient, its payload left for
+// the test to decode.
+type receivedFrame struct {
+	Type      string          `json:"type"`
+	RequestID string          `json:"request_id"`
+	Seq       int64           `json:"seq"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// testClient is a websocket client of a test server. A goroutine reads
+// its frames, so waiting for one that never comes doesn't break the
+// connection.
+type testClient struct {
+	t      testing.TB
+	conn   *websocket.Conn
+	frames chan receivedFrame
+}
+
+// dialTestClient connects to server with the session token and waits for
+// the hello frame.
+func dialTestClient(t testing.TB, server *httptest.Server, token string) *testClient {
+	t.Helper()
+	return dialTestURL(t, "ws"+strings.TrimPrefix(server.URL, "http"), token)
+}
+
+func dialTestURL(t testing.TB, url, token string) *testClient {
+	t.Helper()
+
+	header := http.Header{}
+	header.Set("Cookie", "Token="+token)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{t: t, conn: conn, frames: make(chan receivedFrame, 256)}
+	go c.readFrames()
+	c.expect("hello")
+	return c
+}
+
+func (c *testClient) readFrames() {
+	defer close(c.frames)
+	for {
+		_, p, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var frame receivedFrame
+		if json.Unmarshal(p, &frame) == nil {
+			c.frames <- frame
+		}
+	}
+}
+
+func (c *testClient) send(frameType, requestID string, payload interface{}) {
+	c.t.Helper()
+
+	err := c.conn.WriteJSON(map[string]interface{}{
+		"type":       frameType,
+		"request_id": requestID,
+		"payload":    payload,
+	})
+	if err != nil {
+		c.t.Fatalf("sending %s: %v", frameType, err)
+	}
+}
+
+// expect returns the next frame of type frameType, skipping the others.
+func (c *testClient) expect(frameType string) receivedFrame {
+	c.t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for a %s frame", frameType)
+			}
+			if frame.Type == frameType {
+				return frame
+			}
+		case <-timeout:
+			c.t.Fatalf("no %s frame", frameType)
+		}
+	}
+}
+
+// expectNone fails if a frame of type frameType comes in the next 200ms.
+func (c *testClient) expectNone(frameType string) {
+	c.t.Helper()
+
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				return
+			}
+			if frame.Type == frameType {
+				c.t.Fatalf("unexpected %s frame: %s", frameType, frame.Payload)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// request sends a frame and returns its ack or error frame.
+func (c *testClient) request(frameType string, payload interface{}) receivedFrame {
+	c.t.Helper()
+
+	requestID := fmt.Sprintf("%s-%d", frameType, time.Now().UnixNano())
+	c.send(frameType, requestID, payload)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case frame, ok := <-c.frames:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for the answer to %s", frameType)
+			}
+			if frame.RequestID == requestID {
+				return frame
+			}
+		case <-timeout:
+			c.t.Fatalf("%s wasn't answered", frameType)
+		}
+	}
+}
+
+// TestConcurrentClients runs hundreds of clients at once, connecting,
+// sending every kind of frame and hanging up while the server publishes
+// to them. It's meant for the race detector: go test -race.
+func TestConcurrentClients(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stress test")
+	}
+
+	const (
+		users          = 100
+		connsPerUser   = 3
+		roundsPerConn  = 2
+		framesPerRound = 15
+	)
+
+	server := newTestServer(t)
+	userIDs := make([]int, users)
+	tokens := make([]string, users)
+	for i := range userIDs {
+		userIDs[i], tokens[i] = newTestUser(t)
+	}
+	postID := newTestPost(t, userIDs[0])
+
+	done := make(chan struct{})
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			publishCommentCreated(postID, types.COMMENT{USER_ID: userIDs[i%users], Content: "hi"})
+			wsManager.broadcastOnlineStatus(userIDs[i%users])
+			wsManager.sendToUser(userIDs[i%users], WebSocketMessage{Type: "notification", Payload: i})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var evictions atomic.Int32
+	for i := 0; i < users*connsPerUser; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lastSeq := int64(-1)
+			for round := 0; round < roundsPerConn; round++ {
+				var err error
+				lastSeq, err = runStressClient(server, tokens[i%users], userIDs, i, postID, lastSeq, framesPerRound)
+				if err == errEvicted {
+					// Clients that fall behind are dropped by design, they
+					// reconnect and get the missed events replayed
+					evictions.Add(1)
+					continue
+				}
+				if err != nil {
+					t.Errorf("client %d: %v", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	<-published
+	t.Logf("%d connections were evicted as too slow", evictions.Load())
+
+	// The read loops notice the closed connections on their own
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wsManager.mu.RLock()
+		connected, subscribers := 0, len(wsManager.topics[postTopic(postID)])
+		for _, userID := range userIDs {
+			connected += len(wsManager.connections[userID])
+		}
+		wsManager.mu.RUnlock()
+
+		if connected == 0 && subscribers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections and %d subscribers left after the clients hung up", connected, subscribers)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// errEvicted is returned by runStressClient when the server closed the
+// connection before answering every request.
+var errEvicted = errors.New("evicted")
+
+// runStressClient connects with token, replaying the events after
+// lastSeq, sends frames and waits for each to be answered, then hangs
+// up. It returns the last seq it saw.
+func runStressClient(server *httptest.Server, token string, userIDs []int, i, postID int, lastSeq int64, frames int) (int64, error) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	if lastSeq >= 0 {
+		url += fmt.Sprintf("?last_seq=%d", lastSeq)
+	}
+	header := http.Header{}
+	header.Set("Cookie", "Token="+token)
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		return lastSeq, err
+	}
+	defer conn.Close()
+
+	// Read until every request is answered, keeping the seq of the
+	// durable events
+	type result struct {
+		lastSeq int64
+		err     error
+	}
+	answered := make(chan result, 1)
+	go func(seq int64) {
+		pending := frames
+		for pending > 0 {
+			_, p, err := conn.ReadMessage()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				answered <- result{seq, errEvicted}
+				return
+			}
+			if err != nil {
+				answered <- result{seq, fmt.Errorf("%d requests unanswered: %v", pending, err)}
+				return
+			}
+			var frame receivedFrame
+			if err := json.Unmarshal(p, &frame); err != nil {
+				answered <- result{seq, err}
+				return
+			}
+			if frame.Seq > seq {
+				seq = frame.Seq
+			}
+			if frame.RequestID == "" {
+				continue
+			}
+			pending--
+			if frame.Type == "error" && strings.Contains(string(frame.Payload), errCodeInternal) {
+				answered <- result{seq, fmt.Errorf("%s failed: %s", frame.RequestID, frame.Payload)}
+				return
+			}
+		}
+		answered <- result{seq, nil}
+	}(lastSeq)
+
+	other := userIDs[(i+1)%len(userIDs)]
+	statuses := []string{"online", "away", "dnd", "invisible"}
+	for n := 0; n < frames; n++ {
+		var frameType string
+		var payload interface{}
+		switch n % 8 {
+		case 0:
+			frameType, payload = "subscribe", map[string]string{"topic": postTopic(postID)}
+		case 1:
+			frameType, payload = "subscribe", map[string]string{"topic": presenceTopic(other)}
+		case 2:
+			frameType, payload = "join_channel", map[string]string{"channel": "news"}
+		case 3:
+			frameType, payload = "typing", map[string]interface{}{"receiver_id": other, "is_typing": true}
+		case 4:
+			frameType, payload = "new_message", map[string]interface{}{"receiver_id": other, "content": "hello"}
+		case 5:
+			frameType, payload = "set_presence", map[string]string{"status": statuses[(i+n)%len(statuses)]}
+		case 6:
+			frameType, payload = "leave_channel", map[string]string{"channel": "news"}
+		case 7:
+			frameType, payload = "unsubscribe", map[string]string{"topic": presenceTopic(other)}
+		}
+		err := conn.WriteJSON(map[string]interface{}{
+			"type":       frameType,
+			"request_id": fmt.Sprintf("%d-%d", i, n),
+			"payload":    payload,
+		})
+		if err != nil {
+			// The server may have evicted us, the reader tells
+			break
+		}
+	}
+
+	var res result
+	select {
+	case res = <-answered:
+	case <-time.After(30 * time.Second):
+		conn.Close()
+		res = <-answered
+		res.err = errors.New("timed out waiting for answers")
+	}
+	return res.lastSeq, res.err
+}
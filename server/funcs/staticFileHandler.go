@@ -2,13 +2,16 @@ package forum
 
 import "net/http"
 
-func StaticFileHandler(w http.ResponseWriter, r *http.Request) {
-	static := http.StripPrefix("/client/", http.FileServer(http.Dir("../client")))
+// StaticFileHandler serves the files of the client in dir under /client/.
+func StaticFileHandler(dir string) http.HandlerFunc {
+	static := http.StripPrefix("/client/", http.FileServer(http.Dir(dir)))
 
-	if r.URL.Path == "/client/" {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/client/" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
-	static.ServeHTTP(w, r)
+		static.ServeHTTP(w, r)
+	}
 }
@@ -1,5 +1,7 @@
 package forum
 
+import "time"
+
 type POST struct {
 	ID              int
 	USER_ID         int
@@ -8,6 +10,7 @@ type POST struct {
 	CreatedAt       string
 	Content         string
 	Category        []string
+	Tags            []string
 	Likes           int
 	Dislikes        int
 	NbComment       int
@@ -16,12 +19,29 @@ type POST struct {
 }
 
 type QueryOptions struct {
-	UserID int
+	UserID int // the viewer; posts of users they blocked are hidden
 	PostID string
 	Filter string
+	Tag    string
+	// Categories are OR-ed together; every other filter is AND-ed.
+	Categories  []string
+	Author      string
+	LikedByMe   bool
+	CreatedByMe bool
+	Following   bool   // only posts from users I follow
+	From        string // YYYY-MM-DD, inclusive
+	To          string // YYYY-MM-DD, inclusive
+	HasImage    bool
+	Sort        string // new (default), old, top, hot or comments
+	Window      string // day, week, month or all (default)
+	// AsOf pins the feed to a moment so its pages agree: the hot score and
+	// the window are computed at it and later posts are left out. The zero
+	// value means now.
+	AsOf   time.Time
 	Limit  int
 	Offset int
 }
+
 type COMMENT struct {
 	Id              int
 	USER_ID         int
@@ -41,3 +61,17 @@ type User struct {
 	ID       int
 	Password string
 }
+
+type Category struct {
+	ID          int    `json:"id"`
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Position    int    `json:"position"`
+	Archived    bool   `json:"archived"`
+}
+
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
@@ -1,58 +1,161 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	forum "forum/funcs"
+	config "forum/funcs/config"
 	data "forum/funcs/database"
 	handlers "forum/funcs/handlers"
 )
 
 func main() {
-	err := data.CreateDB()
+	cfg, args, err := config.Load(os.Args[1:])
 	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if len(args) > 0 && args[0] == "migrate" {
+		os.Exit(runMigrate(cfg, args[1:]))
+	}
+	if len(args) > 0 {
+		fmt.Println("unexpected arguments:", strings.Join(args, " "))
+		os.Exit(2)
+	}
+
+	if err := data.CreateDB(cfg); err != nil {
 		fmt.Println(err)
 		return
 	}
 
+	handlers.Init(cfg)
+
+	if err := handlers.ResetPresence(); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if cfg.Admin != "" {
+		if err := data.GrantAdmin(cfg.Admin); err != nil {
+			fmt.Println("failed to grant admin to", cfg.Admin, ":", err)
+		}
+	}
+
+	go handlers.RunCategoryDigests(24 * time.Hour)
+	go handlers.RunPresenceMonitor()
+
 	// auth
-	http.HandleFunc("/api/login", handlers.AuthLG(handlers.Login))
+	http.HandleFunc("/api/login", handlers.AuthLG(handlers.Login(cfg)))
 	http.HandleFunc("/api/register", handlers.AuthLG(handlers.Register))
 	http.HandleFunc("/api/logout", handlers.Auth(handlers.Logout))
 	http.HandleFunc("/api/user/status", CheckAuthStatus)
 	http.HandleFunc("/api/user/status/offline", SetUserOfflineHandler)
 
 	// static files
-	http.HandleFunc("/client/", forum.StaticFileHandler)
+	http.HandleFunc("/client/", forum.StaticFileHandler(cfg.ClientDir))
 
-	http.HandleFunc("/api/home", handlers.Home)
-	http.HandleFunc("/api/filter", handlers.FilterHandler)
+	http.HandleFunc("/api/home", handlers.Home(cfg))
+	http.HandleFunc("/api/filter", handlers.FilterHandler(cfg))
 	http.HandleFunc("/api/like-dislike", handlers.HandleLikeDislike)
-
-	http.HandleFunc("/api/comment", handlers.Commenting)
-	http.HandleFunc("/api/comment/more", handlers.LoadMoreComments)
-
-	http.HandleFunc("/api/posting", handlers.Auth(handlers.Posting))
+	http.HandleFunc("/api/categories", handlers.CategoriesHandler)
+	http.HandleFunc("/api/admin/categories", handlers.AuthAdmin(handlers.AdminCategoriesHandler))
+	http.HandleFunc("/api/tags", handlers.TagSearchHandler)
+	http.HandleFunc("/api/tags/{tag}", handlers.TagFeedHandler(cfg))
+	http.HandleFunc("/api/trending-tags", handlers.TrendingTagsHandler)
+
+	// Follows
+	http.HandleFunc("/api/follow", handlers.FollowHandler)
+	http.HandleFunc("/api/profile", handlers.ProfileHandler)
+	http.HandleFunc("/api/followers", handlers.FollowersHandler)
+	http.HandleFunc("/api/following", handlers.FollowingHandler)
+	http.HandleFunc("/api/subscriptions", handlers.SubscriptionsHandler)
+	http.HandleFunc("/api/users", handlers.UsersHandler)
+	http.HandleFunc("/api/users/suggestions", handlers.UserSuggestionsHandler)
+	http.HandleFunc("/api/blocks", handlers.BlocksHandler)
+	http.HandleFunc("/api/settings/privacy", handlers.PrivacyHandler)
+
+	http.HandleFunc("/api/comment", handlers.Commenting(cfg))
+	http.HandleFunc("/api/comment/more", handlers.LoadMoreComments(cfg))
+
+	http.HandleFunc("/api/posting", handlers.Auth(handlers.Posting(cfg)))
 
 	// Messaging routes
-	http.HandleFunc("/api/messages", handlers.MessagingHandler)
+	http.HandleFunc("/api/messages", handlers.MessagingHandler(cfg))
 	http.HandleFunc("/api/messages/unread-count", handlers.UnreadMessagesCountHandler)
 	http.HandleFunc("/api/messages/mark-read", handlers.MarkMessagesAsReadHandler)
+	http.HandleFunc("/api/messages/requests", handlers.MessageRequestsHandler)
+	http.HandleFunc("/api/conversations", handlers.ConversationsHandler)
+	http.HandleFunc("/api/conversations/invite", handlers.InviteHandler)
+	http.HandleFunc("/api/conversations/leave", handlers.LeaveHandler)
+	http.HandleFunc("/api/conversations/kick", handlers.KickHandler)
+	http.HandleFunc("/api/channels", handlers.ChannelsHandler)
+	http.HandleFunc("/api/channels/{slug}/messages", handlers.ChannelMessagesHandler)
 	http.HandleFunc("/api/ws", handlers.HandleWebSocket)
 
+	// Notifications
+	http.HandleFunc("/api/notifications", handlers.NotificationsHandler)
+	http.HandleFunc("/api/notifications/unread-count", handlers.UnreadNotificationsCountHandler)
+	http.HandleFunc("/api/notifications/mark-read", handlers.MarkNotificationsAsReadHandler)
+	http.HandleFunc("/api/notifications/mark-all-read", handlers.MarkAllNotificationsAsReadHandler)
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasPrefix(r.URL.Path, "/api/") {
 			http.NotFound(w, r)
 			return
 		}
-		http.ServeFile(w, r, "../client/index.html")
+		http.ServeFile(w, r, filepath.Join(cfg.ClientDir, "index.html"))
 	})
 
-	fmt.Println("http://localhost:8081/")
-	http.ListenAndServe(":8081", nil)
+	server := &http.Server{Addr: cfg.Addr}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		fmt.Println("listening on", cfg.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Println(err)
+			stop()
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	fmt.Println("shutting down")
+	shutdown(server)
+}
+
+// shutdownTimeout bounds how long shutdown waits for requests and
+// websocket writes to finish.
+const shutdownTimeout = 10 * time.Second
+
+// shutdown stops accepting connections, lets the running requests finish,
+// closes the websockets with a server_shutdown frame, marks everyone
+// offline and closes the database.
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Hijacked websocket connections aren't waited for, handlers.Shutdown
+	// closes them
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("failed to drain http connections:", err)
+	}
+	if err := handlers.Shutdown(ctx); err != nil {
+		fmt.Println("failed to close websockets:", err)
+	}
+	if err := data.Db.Close(); err != nil {
+		fmt.Println("failed to close database:", err)
+	}
 }
 
 // api/user/satus
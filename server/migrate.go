@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	config "forum/funcs/config"
+	data "forum/funcs/database"
+)
+
+const migrateUsage = "usage: forum [flags] migrate [up | down [steps] | status]"
+
+// runMigrate runs the migrate subcommand and returns the exit code.
+func runMigrate(cfg *config.Config, args []string) int {
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	steps := 1
+	if command == "down" && len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Println("invalid number of steps:", args[0])
+			return 2
+		}
+		steps, args = n, args[1:]
+	}
+	if len(args) > 0 {
+		fmt.Println(migrateUsage)
+		return 2
+	}
+
+	if err := data.Open(cfg); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer data.Db.Close()
+
+	switch command {
+	case "up":
+		applied, err := data.MigrateUp()
+		for _, m := range applied {
+			fmt.Println("applied", m)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("already up to date")
+		}
+	case "down":
+		reverted, err := data.MigrateDown(steps)
+		for _, m := range reverted {
+			fmt.Println("reverted", m)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if len(reverted) == 0 {
+			fmt.Println("nothing to revert")
+		}
+	case "status":
+		states, err := data.MigrationStatus()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, state := range states {
+			if state.AppliedAt == nil {
+				fmt.Printf("%s\tpending\n", state.Migration)
+			} else {
+				fmt.Printf("%s\tapplied %s\n", state.Migration, state.AppliedAt.Format("2006-01-02 15:04:05"))
+			}
+		}
+	default:
+		fmt.Println(migrateUsage)
+		return 2
+	}
+	return 0
+}